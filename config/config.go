@@ -3,19 +3,46 @@ package config
 import (
 	"flag"
 	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tomdionysus/trinity/kvstore"
 )
 
 // Config struct hold config information for the node
 type Config struct {
-	Nodes            NodeURLs
-	CA               *string
-	Certificate      *string
-	Port             *int
-	LogLevel         *string
-	MemcacheEnabled  *bool
-	MemcachePort     *int
-	HostAddr         *string
-	DisableHeartbeat *bool
+	Nodes               NodeURLs
+	CA                  *string
+	Certificate         *string
+	Port                *int
+	LogLevel            *string
+	MemcacheEnabled     *bool
+	MemcachePort        *int
+	HostAddr            *string
+	DisableHeartbeat    *bool
+	DataDir             *string
+	WALSync             *string
+	WALSyncInterval     *int
+	SnapshotInterval    *int
+	Storage             *string
+	StorageDevice       *string
+	StorageBlockSize    *int
+	StorageFormat       *bool
+	MaxMemory           *int
+	EvictionPolicy      *string
+	CompressThreshold   *int
+	ReplicationFactor   *int
+	Consistency         *string
+	ReadQuorum          *int
+	WriteQuorum         *int
+	ReadRepairChance    *float64
+	HintWindow          *int
+	AntiEntropyInterval *int
+	AntiEntropyRate     *int
+	RereplicationDelay  *int
+	DataKey             *string
+	MemcacheKeyspaces   KeyspaceValues
+	KeyspaceQuotas      KeyspaceValues
 }
 
 // NewConfig init a new Config struct with default value
@@ -29,8 +56,31 @@ func NewConfig() *Config {
 	inst.Port = flag.Int("port", 13531, "Cluster port")
 	inst.MemcacheEnabled = flag.Bool("memcache", false, "Enable Memcache Server")
 	inst.MemcachePort = flag.Int("memcacheport", 11211, "Memcache port")
+	flag.Var(&inst.MemcacheKeyspaces, "memcache-keyspace", "Keyspace=port of an additional memcache port for a keyspace")
+	flag.Var(&inst.KeyspaceQuotas, "keyspace-quota", "Keyspace=MB limit on the memory used by a keyspace's items")
+	inst.ReplicationFactor = flag.Int("replication-factor", 3, "Number of nodes that hold each key")
+	inst.ReadQuorum = flag.Int("read-quorum", 1, "Number of replicas a read waits for")
+	inst.WriteQuorum = flag.Int("write-quorum", 0, "Number of replicas a write waits for (0 to let -consistency decide)")
+	inst.ReadRepairChance = flag.Float64("read-repair-chance", 0.1, "Probability that a read repairs stale replicas in the background [0-1]")
+	inst.HintWindow = flag.Int("hint-window", 10800, "Seconds that writes missed by an unavailable replica are kept for it")
+	inst.AntiEntropyInterval = flag.Int("anti-entropy-interval", 3600, "Seconds between anti-entropy runs with each peer (0 to disable)")
+	inst.AntiEntropyRate = flag.Int("anti-entropy-rate", 100, "Maximum keys per second repaired by anti-entropy (0 for no limit)")
+	inst.RereplicationDelay = flag.Int("rereplication-delay", 60, "Seconds a lost node must stay disconnected before its keys are re-replicated")
+	inst.Consistency = flag.String("consistency", "WRITE_COMMITTED", "Default consistency mode of writes [WRITE_UNCOMMITTED,WRITE_COMMITTED,WRITE_REPLICATED]")
 	inst.HostAddr = flag.String("hostaddr", "", "Advertised hostname:port")
 	inst.DisableHeartbeat = flag.Bool("disable-heartbeat", false, "[DEV ONLY] Disable heartbeat check to avoid losing connection on breakpoint")
+	inst.DataDir = flag.String("data-dir", "", "Data directory for the write-ahead log (empty for in-memory only)")
+	inst.WALSync = flag.String("wal-sync", "interval", "WAL fsync policy [always,interval,never]")
+	inst.WALSyncInterval = flag.Int("wal-sync-interval", 1000, "WAL fsync interval in ms when -wal-sync is interval")
+	inst.SnapshotInterval = flag.Int("snapshot-interval", 300, "Seconds between KV store snapshots when -data-dir is set (0 to disable)")
+	inst.Storage = flag.String("storage", "memory", "KV storage engine [memory,bplustree,block]")
+	inst.StorageDevice = flag.String("storage-device", "", "Block device or file for the 'block' storage engine")
+	inst.StorageBlockSize = flag.Int("storage-block-size", 4096, "Block size in bytes of the storage device")
+	inst.DataKey = flag.String("data-key", "", "Key file to encrypt the storage device with (empty for no encryption)")
+	inst.StorageFormat = flag.Bool("storage-format", false, "Format the storage device if it is not already formatted")
+	inst.MaxMemory = flag.Int("max-memory", 0, "Approximate limit in MB on the memory used by KV items (0 for no limit)")
+	inst.EvictionPolicy = flag.String("eviction-policy", "lru", "Eviction policy when -max-memory is reached [lru,lfu,random,ttl,noeviction]")
+	inst.CompressThreshold = flag.Int("compress-threshold", 0, "Compress values of at least this many bytes in storage and between nodes (0 to disable)")
 	flag.Parse()
 
 	if *inst.HostAddr == "" {
@@ -47,5 +97,96 @@ func (cfg *Config) Validate() (bool, []error) {
 	if *cfg.Port < 0 || *cfg.Port > 65535 {
 		errs = append(errs, fmt.Errorf("Port %d is invalid (0-65535)", *cfg.Port))
 	}
+	if !kvstore.ValidWALSyncPolicy(*cfg.WALSync) {
+		errs = append(errs, fmt.Errorf("WAL sync policy '%s' is invalid", *cfg.WALSync))
+	}
+	if *cfg.WALSyncInterval <= 0 {
+		errs = append(errs, fmt.Errorf("WAL sync interval %d is invalid (must be > 0)", *cfg.WALSyncInterval))
+	}
+	switch *cfg.Storage {
+	case kvstore.StorageMemory, kvstore.StorageBPlusTree:
+		if *cfg.DataKey != "" {
+			errs = append(errs, fmt.Errorf("-data-key requires storage engine 'block'"))
+		}
+	case kvstore.StorageBlock:
+		if *cfg.StorageDevice == "" {
+			errs = append(errs, fmt.Errorf("Storage engine 'block' requires -storage-device"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Storage engine '%s' is invalid (memory,bplustree,block)", *cfg.Storage))
+	}
+	if *cfg.StorageBlockSize < 128 {
+		errs = append(errs, fmt.Errorf("Storage block size %d is invalid (must be >= 128)", *cfg.StorageBlockSize))
+	}
+	if *cfg.MaxMemory < 0 {
+		errs = append(errs, fmt.Errorf("Max memory %d is invalid (must be >= 0)", *cfg.MaxMemory))
+	}
+	if !kvstore.ValidEvictionPolicy(*cfg.EvictionPolicy) {
+		errs = append(errs, fmt.Errorf("Eviction policy '%s' is invalid", *cfg.EvictionPolicy))
+	}
+	if *cfg.CompressThreshold < 0 {
+		errs = append(errs, fmt.Errorf("Compress threshold %d is invalid (must be >= 0)", *cfg.CompressThreshold))
+	}
+	if *cfg.ReplicationFactor < 1 {
+		errs = append(errs, fmt.Errorf("Replication factor %d is invalid (must be >= 1)", *cfg.ReplicationFactor))
+	} else {
+		if *cfg.ReadQuorum < 1 || *cfg.ReadQuorum > *cfg.ReplicationFactor {
+			errs = append(errs, fmt.Errorf("Read quorum %d is invalid (must be 1 to the replication factor)", *cfg.ReadQuorum))
+		}
+		if *cfg.WriteQuorum < 0 || *cfg.WriteQuorum > *cfg.ReplicationFactor {
+			errs = append(errs, fmt.Errorf("Write quorum %d is invalid (must be 0 to the replication factor)", *cfg.WriteQuorum))
+		}
+	}
+	if *cfg.ReadRepairChance < 0 || *cfg.ReadRepairChance > 1 {
+		errs = append(errs, fmt.Errorf("Read repair chance %g is invalid (must be 0 to 1)", *cfg.ReadRepairChance))
+	}
+	if *cfg.HintWindow <= 0 {
+		errs = append(errs, fmt.Errorf("Hint window %d is invalid (must be > 0)", *cfg.HintWindow))
+	}
+	if *cfg.AntiEntropyInterval < 0 {
+		errs = append(errs, fmt.Errorf("Anti-entropy interval %d is invalid (must be >= 0)", *cfg.AntiEntropyInterval))
+	}
+	if *cfg.AntiEntropyRate < 0 {
+		errs = append(errs, fmt.Errorf("Anti-entropy rate %d is invalid (must be >= 0)", *cfg.AntiEntropyRate))
+	}
+	if *cfg.RereplicationDelay < 0 {
+		errs = append(errs, fmt.Errorf("Rereplication delay %d is invalid (must be >= 0)", *cfg.RereplicationDelay))
+	}
+	switch strings.ToUpper(*cfg.Consistency) {
+	case "WRITE_UNCOMMITTED", "WRITE_COMMITTED", "WRITE_REPLICATED":
+	default:
+		errs = append(errs, fmt.Errorf("Consistency mode '%s' is invalid (WRITE_UNCOMMITTED,WRITE_COMMITTED,WRITE_REPLICATED)", *cfg.Consistency))
+	}
+	// Each keyspace needs a port of its own
+	names := make([]string, 0, len(cfg.MemcacheKeyspaces))
+	for name := range cfg.MemcacheKeyspaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	used := map[int]string{*cfg.Port: "the cluster port", *cfg.MemcachePort: "the memcache port"}
+	for _, name := range names {
+		port := cfg.MemcacheKeyspaces[name]
+		if !kvstore.ValidKeyspace(name) {
+			errs = append(errs, fmt.Errorf("Memcache keyspace '%s' is invalid", name))
+		}
+		if port < 0 || port > 65535 {
+			errs = append(errs, fmt.Errorf("Memcache port %d for keyspace '%s' is invalid (0-65535)", port, name))
+		} else if other, found := used[port]; found {
+			errs = append(errs, fmt.Errorf("Memcache port %d for keyspace '%s' is already %s", port, name, other))
+		} else {
+			used[port] = fmt.Sprintf("the port of keyspace '%s'", name)
+		}
+	}
+	for name, quota := range cfg.KeyspaceQuotas {
+		if !kvstore.ValidKeyspace(name) {
+			errs = append(errs, fmt.Errorf("Quota keyspace '%s' is invalid", name))
+		}
+		if quota < 0 {
+			errs = append(errs, fmt.Errorf("Quota %d for keyspace '%s' is invalid (must be >= 0)", quota, name))
+		}
+	}
+	if *cfg.SnapshotInterval < 0 {
+		errs = append(errs, fmt.Errorf("Snapshot interval %d is invalid (must be >= 0)", *cfg.SnapshotInterval))
+	}
 	return len(errs) == 0, errs
 }
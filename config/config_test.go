@@ -16,6 +16,27 @@ func TestNewConfig(t *testing.T) {
 	assert.Equal(t, false, *inst.MemcacheEnabled)
 	assert.Equal(t, 11211, *inst.MemcachePort)
 	assert.Equal(t, "localhost:13531", *inst.HostAddr)
+	assert.Equal(t, "", *inst.DataDir)
+	assert.Equal(t, "interval", *inst.WALSync)
+	assert.Equal(t, 1000, *inst.WALSyncInterval)
+	assert.Equal(t, 300, *inst.SnapshotInterval)
+	assert.Equal(t, "memory", *inst.Storage)
+	assert.Equal(t, "", *inst.StorageDevice)
+	assert.Equal(t, 4096, *inst.StorageBlockSize)
+	assert.Equal(t, false, *inst.StorageFormat)
+	assert.Equal(t, 0, *inst.MaxMemory)
+	assert.Equal(t, "lru", *inst.EvictionPolicy)
+	assert.Equal(t, 0, *inst.CompressThreshold)
+	assert.Equal(t, 3, *inst.ReplicationFactor)
+	assert.Equal(t, "WRITE_COMMITTED", *inst.Consistency)
+	assert.Equal(t, 1, *inst.ReadQuorum)
+	assert.Equal(t, 0, *inst.WriteQuorum)
+	assert.Equal(t, 0.1, *inst.ReadRepairChance)
+	assert.Equal(t, 10800, *inst.HintWindow)
+	assert.Equal(t, 3600, *inst.AntiEntropyInterval)
+	assert.Equal(t, 100, *inst.AntiEntropyRate)
+	assert.Equal(t, 60, *inst.RereplicationDelay)
+	assert.Equal(t, "", *inst.DataKey)
 
 	// Defaults should validate OK
 	ok, errs := inst.Validate()
@@ -27,4 +48,105 @@ func TestNewConfig(t *testing.T) {
 	ok, errs = inst.Validate()
 	assert.NotNil(t, errs)
 	assert.False(t, ok)
+	*inst.Port = 13531
+
+	// Or the block engine has no device..
+	*inst.Storage = "block"
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.Storage = "memory"
+
+	// Or there is a data key but no block storage..
+	*inst.DataKey = "data.key"
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.DataKey = ""
+
+	// Or the eviction policy is unknown..
+	*inst.EvictionPolicy = "fifo"
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.EvictionPolicy = "lru"
+
+	// Or the compress threshold is negative..
+	*inst.CompressThreshold = -1
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.CompressThreshold = 0
+
+	// Or the replication factor is less than one..
+	*inst.ReplicationFactor = 0
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.ReplicationFactor = 3
+
+	// Or the consistency mode is unknown..
+	*inst.Consistency = "eventual"
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.Consistency = "WRITE_COMMITTED"
+
+	// Or a quorum is more than the replication factor..
+	*inst.ReadQuorum = 4
+	*inst.WriteQuorum = 4
+	ok, errs = inst.Validate()
+	assert.Equal(t, 2, len(errs))
+	assert.False(t, ok)
+	*inst.ReadQuorum = 1
+	*inst.WriteQuorum = 0
+
+	// Or the read repair chance is not a probability..
+	*inst.ReadRepairChance = 1.5
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.ReadRepairChance = 0.1
+
+	// Or the hint window is not positive..
+	*inst.HintWindow = 0
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.HintWindow = 10800
+
+	// Or the anti-entropy interval or rate is negative..
+	*inst.AntiEntropyInterval = -1
+	*inst.AntiEntropyRate = -1
+	ok, errs = inst.Validate()
+	assert.Equal(t, 2, len(errs))
+	assert.False(t, ok)
+	*inst.AntiEntropyInterval = 3600
+	*inst.AntiEntropyRate = 100
+
+	// Or the rereplication delay is negative..
+	*inst.RereplicationDelay = -1
+	ok, errs = inst.Validate()
+	assert.Equal(t, 1, len(errs))
+	assert.False(t, ok)
+	*inst.RereplicationDelay = 60
+
+	// Or a keyspace is invalid..
+	inst.MemcacheKeyspaces = KeyspaceValues{"a b": 11212}
+	inst.KeyspaceQuotas = KeyspaceValues{"ok": -1}
+	ok, errs = inst.Validate()
+	assert.Equal(t, 2, len(errs))
+	assert.False(t, ok)
+	inst.KeyspaceQuotas = KeyspaceValues{"ok": 64}
+
+	// Or keyspaces share a port, or use the cluster or memcache port..
+	inst.MemcacheKeyspaces = KeyspaceValues{"one": 11212, "two": 11212, "three": 13531, "four": 11211}
+	ok, errs = inst.Validate()
+	assert.Equal(t, 3, len(errs))
+	assert.False(t, ok)
+
+	inst.MemcacheKeyspaces = KeyspaceValues{"one": 11212, "two": 11213}
+	ok, errs = inst.Validate()
+	assert.Equal(t, []error{}, errs)
+	assert.True(t, ok)
 }
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyspaceValues holds an integer for each keyspace, given as repeated name=value flags
+type KeyspaceValues map[string]int
+
+// Set parses a name=value pair and adds it to the map
+func (kv *KeyspaceValues) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected keyspace=value")
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("value '%s' is not an integer", parts[1])
+	}
+	if *kv == nil {
+		*kv = KeyspaceValues{}
+	}
+	(*kv)[parts[0]] = n
+	return nil
+}
+
+func (kv *KeyspaceValues) String() string {
+	pairs := []string{}
+	for name, value := range *kv {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, value))
+	}
+	sort.Strings(pairs)
+	return fmt.Sprint(pairs)
+}
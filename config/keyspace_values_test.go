@@ -0,0 +1,19 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyspaceValues(t *testing.T) {
+	inst := &KeyspaceValues{}
+
+	assert.Nil(t, inst.Set("sessions=11212"))
+	assert.Nil(t, inst.Set("cache=64"))
+	assert.Equal(t, "[cache=64 sessions=11212]", inst.String())
+	assert.Equal(t, 11212, (*inst)["sessions"])
+
+	assert.NotNil(t, inst.Set("sessions"))
+	assert.NotNil(t, inst.Set("sessions=many"))
+}
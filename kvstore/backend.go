@@ -0,0 +1,91 @@
+package kvstore
+
+import (
+	bt "github.com/tomdionysus/binarytree"
+	ch "github.com/tomdionysus/consistenthash"
+)
+
+// backend is the storage underneath a KVStore. The KVStore handles expiry, the WAL and snapshots;
+// a backend only stores and retrieves items.
+type backend interface {
+	get(key string) (*Item, bool)
+	set(item *Item) error
+	delete(key string) bool
+	each(fn func(*Item) bool)
+	// sample returns up to n items chosen at random, for eviction.
+	sample(n int) []*Item
+	len() int
+	close() error
+}
+
+// memoryBackend stores items in memory in a binary tree keyed by the MD5 of the key.
+type memoryBackend struct {
+	tree *bt.Tree
+	// index tracks every key in the tree so that it can be enumerated.
+	index map[ch.Key]bool
+}
+
+func newMemoryBackend() *memoryBackend {
+	inst := &memoryBackend{
+		tree:  bt.NewTree(),
+		index: map[ch.Key]bool{},
+	}
+	return inst
+}
+
+func (mb *memoryBackend) get(key string) (*Item, bool) {
+	ok, value := mb.tree.Get(ch.NewMD5Key(key))
+	if !ok {
+		return nil, false
+	}
+	return value.(*Item), true
+}
+
+func (mb *memoryBackend) set(item *Item) error {
+	keymd5 := ch.NewMD5Key(item.Key)
+	mb.tree.Set(keymd5, item)
+	mb.index[keymd5] = true
+	return nil
+}
+
+func (mb *memoryBackend) delete(key string) bool {
+	keymd5 := ch.NewMD5Key(key)
+	if !mb.index[keymd5] {
+		return false
+	}
+	mb.tree.Clear(keymd5)
+	delete(mb.index, keymd5)
+	return true
+}
+
+func (mb *memoryBackend) each(fn func(*Item) bool) {
+	for key := range mb.index {
+		if ok, value := mb.tree.Get(key); ok {
+			if !fn(value.(*Item)) {
+				return
+			}
+		}
+	}
+}
+
+func (mb *memoryBackend) sample(n int) []*Item {
+	// Map iteration starts at a random position.
+	items := make([]*Item, 0, n)
+	for key := range mb.index {
+		if len(items) == n {
+			break
+		}
+		if ok, value := mb.tree.Get(key); ok {
+			items = append(items, value.(*Item))
+		}
+	}
+	return items
+}
+
+func (mb *memoryBackend) len() int {
+	return len(mb.index)
+}
+
+func (mb *memoryBackend) close() error {
+	return nil
+}
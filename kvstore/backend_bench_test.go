@@ -0,0 +1,57 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchmarkKeys is the number of keys preloaded into a backend before each benchmark.
+const benchmarkKeys = 1000000
+
+func preloadBackend(store backend) []string {
+	keys := make([]string, benchmarkKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%08d", i)
+		store.set(&Item{Key: keys[i], Data: []byte("value")})
+	}
+	return keys
+}
+
+func benchmarkBackendSet(b *testing.B, store backend) {
+	keys := preloadBackend(store)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.set(&Item{Key: keys[i%benchmarkKeys], Data: []byte("updated")})
+	}
+}
+
+func benchmarkBackendGet(b *testing.B, store backend) {
+	keys := preloadBackend(store)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.get(keys[i%benchmarkKeys])
+	}
+}
+
+func benchmarkBackendDelete(b *testing.B, store backend) {
+	keys := preloadBackend(store)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i%benchmarkKeys]
+		if !store.delete(key) {
+			// Every key has been deleted once, put it back outside the timer.
+			b.StopTimer()
+			store.set(&Item{Key: key, Data: []byte("value")})
+			b.StartTimer()
+			store.delete(key)
+		}
+	}
+}
+
+func BenchmarkMemoryBackendSet(b *testing.B)    { benchmarkBackendSet(b, newMemoryBackend()) }
+func BenchmarkMemoryBackendGet(b *testing.B)    { benchmarkBackendGet(b, newMemoryBackend()) }
+func BenchmarkMemoryBackendDelete(b *testing.B) { benchmarkBackendDelete(b, newMemoryBackend()) }
+
+func BenchmarkBPlusTreeBackendSet(b *testing.B)    { benchmarkBackendSet(b, newBPlusTreeBackend()) }
+func BenchmarkBPlusTreeBackendGet(b *testing.B)    { benchmarkBackendGet(b, newBPlusTreeBackend()) }
+func BenchmarkBPlusTreeBackendDelete(b *testing.B) { benchmarkBackendDelete(b, newBPlusTreeBackend()) }
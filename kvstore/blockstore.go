@@ -0,0 +1,666 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tomdionysus/trinity/util"
+)
+
+// BlockStoreVersion is the on-disk format version written to the superblock.
+const BlockStoreVersion = 4
+
+// Block Types
+const (
+	blockTypeFree     = 0
+	blockTypeHead     = 1
+	blockTypeOverflow = 2
+)
+
+// Every block in an item chain starts with [type][uint64 next block, 0 = end of chain].
+const blockHeaderSize = 9
+
+// A head block follows the block header with [uint64 sequence][int16 flags][int64 expiry unix nanos, 0 = none]
+// [uint64 item version][encoding, 1 = compressed | 2 = tombstone][uint32 data checksum][uint32 key length][uint32 data length],
+// then the key, then as much of the data as fits.
+const headHeaderSize = blockHeaderSize + 8 + 2 + 8 + 8 + 1 + 4 + 4 + 4
+
+// ReencryptBatchSize is the number of blocks Reencrypt checks each time it takes the store lock.
+const ReencryptBatchSize = 64
+
+// minBlockSize is the smallest block size that can hold a superblock and a useful head block.
+const minBlockSize = 128
+
+var blockStoreMagic = []byte("TRBLKSTR")
+
+// ErrNotFormatted is returned by BlockStore.Open when the device has no valid superblock.
+var ErrNotFormatted = errors.New("Device is not a formatted BlockStore")
+
+// ErrStorageFull is returned when there are not enough free blocks to store an item.
+var ErrStorageFull = errors.New("BlockStore is full")
+
+// BlockStore is a page based storage engine on a DiskIO device.
+//
+// Block 0 is the superblock, followed by a free-space bitmap with one bit per block, followed by data blocks.
+// Each item is stored as a chain of blocks: a head block holding the key, metadata and the start of the
+// data, and overflow blocks holding the rest of the data. On Open, allocated blocks are scanned for heads to
+// build the in-memory key index, and blocks not reachable from a head are freed.
+type BlockStore struct {
+	Logger *util.Logger
+	Device *DiskIO
+
+	blockSize    uint64
+	blockCount   uint64
+	bitmapBlocks uint64
+	dataStart    uint64
+	bitmap       []byte
+	cursor       uint64
+	free         uint64
+	sequence     uint64
+	index        map[string]blockRef
+	mutex        sync.Mutex
+}
+
+// blockRef locates an item's head block.
+type blockRef struct {
+	head     uint64
+	sequence uint64
+}
+
+// NewBlockStore returns a new BlockStore on the given device, which must already be open.
+func NewBlockStore(logger *util.Logger, device *DiskIO) *BlockStore {
+	inst := &BlockStore{
+		Logger:    logger,
+		Device:    device,
+		blockSize: uint64(device.PayloadSize()),
+		index:     map[string]blockRef{},
+	}
+	return inst
+}
+
+// Format writes a new superblock and empty bitmap for a device of blockCount blocks, discarding any existing data.
+func (bs *BlockStore) Format(blockCount uint64) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	if bs.blockSize < minBlockSize {
+		return fmt.Errorf("Block size %d is too small (minimum %d)", bs.blockSize, minBlockSize)
+	}
+	bitsPerBlock := bs.blockSize * 8
+	bs.blockCount = blockCount
+	bs.bitmapBlocks = (blockCount + bitsPerBlock - 1) / bitsPerBlock
+	bs.dataStart = 1 + bs.bitmapBlocks
+	if blockCount <= bs.dataStart {
+		return fmt.Errorf("Device too small to format (%d blocks)", blockCount)
+	}
+
+	bs.bitmap = make([]byte, bs.bitmapBlocks*bs.blockSize)
+	for b := uint64(0); b < bs.dataStart; b++ {
+		bs.setBit(b, true)
+	}
+	bs.free = blockCount - bs.dataStart
+	bs.cursor = bs.dataStart
+	bs.sequence = 0
+	bs.index = map[string]blockRef{}
+
+	for i := uint64(0); i < bs.bitmapBlocks; i++ {
+		if err := bs.writeBitmapBlock(i); err != nil {
+			return err
+		}
+	}
+
+	super := make([]byte, bs.blockSize)
+	copy(super, blockStoreMagic)
+	binary.BigEndian.PutUint32(super[8:12], BlockStoreVersion)
+	binary.BigEndian.PutUint32(super[12:16], uint32(bs.blockSize))
+	binary.BigEndian.PutUint64(super[16:24], bs.blockCount)
+	binary.BigEndian.PutUint64(super[24:32], bs.bitmapBlocks)
+	binary.BigEndian.PutUint64(super[32:40], bs.dataStart)
+	if err := bs.writeBlock(0, super); err != nil {
+		return err
+	}
+
+	bs.Logger.Info("BlockStore", "Formatted %s: %d blocks of %d bytes", bs.Device.DeviceName, blockCount, bs.blockSize)
+	return bs.Device.Sync()
+}
+
+// Open reads the superblock and bitmap and builds the key index. If the device is not formatted and format is
+// true, it is formatted using all of its blocks, otherwise ErrNotFormatted is returned.
+func (bs *BlockStore) Open(format bool) error {
+	super, err := bs.readBlock(0)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(super[:len(blockStoreMagic)], blockStoreMagic) {
+		if !format {
+			return ErrNotFormatted
+		}
+		blocks, err := bs.Device.Blocks()
+		if err != nil {
+			return err
+		}
+		return bs.Format(blocks)
+	}
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	if version := binary.BigEndian.Uint32(super[8:12]); version != BlockStoreVersion {
+		return fmt.Errorf("Unsupported BlockStore version %d", version)
+	}
+	if size := uint64(binary.BigEndian.Uint32(super[12:16])); size != bs.blockSize {
+		return fmt.Errorf("BlockStore block size is %d, device opened with %d", size, bs.blockSize)
+	}
+	bs.blockCount = binary.BigEndian.Uint64(super[16:24])
+	bs.bitmapBlocks = binary.BigEndian.Uint64(super[24:32])
+	bs.dataStart = binary.BigEndian.Uint64(super[32:40])
+
+	bs.bitmap = make([]byte, 0, bs.bitmapBlocks*bs.blockSize)
+	for i := uint64(0); i < bs.bitmapBlocks; i++ {
+		block, err := bs.readBlock(1 + i)
+		if err != nil {
+			return err
+		}
+		bs.bitmap = append(bs.bitmap, block...)
+	}
+
+	return bs.rebuildIndex()
+}
+
+// FreeBlocks returns the number of unallocated blocks.
+func (bs *BlockStore) FreeBlocks() uint64 {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	return bs.free
+}
+
+// Reencrypt rewrites every block of an encrypted device that is not encrypted with the current data key, so that
+// older keys can be retired. The store is locked for ReencryptBatchSize blocks at a time, so reads and writes
+// carry on during re-encryption. It returns the number of blocks rewritten.
+func (bs *BlockStore) Reencrypt() (uint64, error) {
+	keys := bs.Device.Keys
+	if keys == nil {
+		return 0, nil
+	}
+	bs.mutex.Lock()
+	count := bs.blockCount
+	bs.mutex.Unlock()
+
+	var rewritten uint64
+	for start := uint64(0); start < count; start += ReencryptBatchSize {
+		n, err := bs.reencryptBatch(keys.Current(), start, minUint64(start+ReencryptBatchSize, count))
+		rewritten += n
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	if rewritten > 0 {
+		if err := bs.Device.Sync(); err != nil {
+			return rewritten, err
+		}
+	}
+	bs.Logger.Info("BlockStore", "Re-encrypted %d block(s) of %s with key %d", rewritten, bs.Device.DeviceName, keys.Current())
+	return rewritten, nil
+}
+
+// Private - backend
+
+func (bs *BlockStore) get(key string) (*Item, bool) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	ref, found := bs.index[key]
+	if !found {
+		return nil, false
+	}
+	item, _, err := bs.readItem(ref.head)
+	if err != nil {
+		bs.Logger.Error("BlockStore", "Cannot Read [%s] at block %d: %s", key, ref.head, err.Error())
+		return nil, false
+	}
+	return item, true
+}
+
+func (bs *BlockStore) set(item *Item) error {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	headCapacity := bs.blockSize - headHeaderSize
+	if uint64(len(item.Key)) > headCapacity {
+		return fmt.Errorf("Key too long for block size (%d > %d)", len(item.Key), headCapacity)
+	}
+	payload := make([]byte, 0, len(item.Key)+len(item.Data))
+	payload = append(payload, item.Key...)
+	payload = append(payload, item.Data...)
+
+	count := uint64(1)
+	if uint64(len(payload)) > headCapacity {
+		overflowCapacity := bs.blockSize - blockHeaderSize
+		count += (uint64(len(payload)) - headCapacity + overflowCapacity - 1) / overflowCapacity
+	}
+
+	// Blocks are only marked allocated on disk once written, so a crash part way through leaves written blocks
+	// that are free, or unreachable blocks that Open will free, rather than allocated blocks that were never
+	// written or a reachable chain through unallocated blocks.
+	blocks, err := bs.allocate(count)
+	if err != nil {
+		return err
+	}
+
+	bs.sequence++
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := make([]byte, bs.blockSize)
+		if i+1 < len(blocks) {
+			binary.BigEndian.PutUint64(block[1:9], blocks[i+1])
+		}
+		var chunk []byte
+		if i == 0 {
+			block[0] = blockTypeHead
+			binary.BigEndian.PutUint64(block[9:17], bs.sequence)
+			binary.BigEndian.PutUint16(block[17:19], uint16(item.Flags))
+			if item.ExpiresAt != nil {
+				binary.BigEndian.PutUint64(block[19:27], uint64(item.ExpiresAt.UnixNano()))
+			}
+			binary.BigEndian.PutUint64(block[27:35], item.Version)
+			if item.Compressed {
+				block[35] |= encodingCompressed
+			}
+			if item.Tombstone {
+				block[35] |= encodingTombstone
+			}
+			binary.BigEndian.PutUint32(block[36:40], item.Checksum)
+			binary.BigEndian.PutUint32(block[40:44], uint32(len(item.Key)))
+			binary.BigEndian.PutUint32(block[44:48], uint32(len(item.Data)))
+			chunk = payload[:minUint64(headCapacity, uint64(len(payload)))]
+			copy(block[headHeaderSize:], chunk)
+		} else {
+			block[0] = blockTypeOverflow
+			start := headCapacity + uint64(i-1)*(bs.blockSize-blockHeaderSize)
+			end := minUint64(start+bs.blockSize-blockHeaderSize, uint64(len(payload)))
+			copy(block[blockHeaderSize:], payload[start:end])
+		}
+		if err := bs.writeBlock(blocks[i], block); err != nil {
+			bs.release(blocks)
+			return err
+		}
+	}
+	if err := bs.commit(blocks); err != nil {
+		bs.release(blocks)
+		return err
+	}
+
+	old, replaced := bs.index[item.Key]
+	bs.index[item.Key] = blockRef{head: blocks[0], sequence: bs.sequence}
+	if replaced {
+		return bs.freeChain(old.head)
+	}
+	return nil
+}
+
+func (bs *BlockStore) delete(key string) bool {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	ref, found := bs.index[key]
+	if !found {
+		return false
+	}
+	delete(bs.index, key)
+	err := bs.freeChain(ref.head)
+	if err != nil {
+		bs.Logger.Error("BlockStore", "Cannot Free [%s] at block %d: %s", key, ref.head, err.Error())
+	}
+	return true
+}
+
+func (bs *BlockStore) each(fn func(*Item) bool) {
+	bs.mutex.Lock()
+	keys := make([]string, 0, len(bs.index))
+	for key := range bs.index {
+		keys = append(keys, key)
+	}
+	bs.mutex.Unlock()
+
+	for _, key := range keys {
+		if item, found := bs.get(key); found {
+			if !fn(item) {
+				return
+			}
+		}
+	}
+}
+
+func (bs *BlockStore) sample(n int) []*Item {
+	bs.mutex.Lock()
+	keys := make([]string, 0, n)
+	for key := range bs.index {
+		if len(keys) == n {
+			break
+		}
+		keys = append(keys, key)
+	}
+	bs.mutex.Unlock()
+
+	items := make([]*Item, 0, n)
+	for _, key := range keys {
+		if item, found := bs.get(key); found {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (bs *BlockStore) len() int {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	return len(bs.index)
+}
+
+func (bs *BlockStore) close() error {
+	err := bs.Device.Sync()
+	cerr := bs.Device.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Private
+
+// rebuildIndex scans allocated blocks for heads, keeping the highest sequence head for each key, then frees
+// any allocated data blocks not reachable from a live head.
+func (bs *BlockStore) rebuildIndex() error {
+	bs.index = map[string]blockRef{}
+	bs.sequence = 0
+	stale := []uint64{}
+
+	for b := bs.dataStart; b < bs.blockCount; b++ {
+		if !bs.getBit(b) {
+			continue
+		}
+		block, err := bs.readBlock(b)
+		if err != nil {
+			return err
+		}
+		if block[0] != blockTypeHead {
+			continue
+		}
+		sequence := binary.BigEndian.Uint64(block[9:17])
+		keylen := uint64(binary.BigEndian.Uint32(block[40:44]))
+		if keylen > bs.blockSize-headHeaderSize {
+			bs.Logger.Warn("BlockStore", "Block %d has invalid key length, ignoring", b)
+			continue
+		}
+		key := string(block[headHeaderSize : headHeaderSize+keylen])
+		if sequence > bs.sequence {
+			bs.sequence = sequence
+		}
+		if existing, found := bs.index[key]; found {
+			if existing.sequence > sequence {
+				stale = append(stale, b)
+				continue
+			}
+			stale = append(stale, existing.head)
+		}
+		bs.index[key] = blockRef{head: b, sequence: sequence}
+	}
+	for _, head := range stale {
+		bs.Logger.Warn("BlockStore", "Freeing superseded item at block %d", head)
+		if err := bs.freeChain(head); err != nil {
+			return err
+		}
+	}
+
+	// Anything allocated but not reachable was orphaned by an interrupted write.
+	reachable := map[uint64]bool{}
+	for key, ref := range bs.index {
+		for b := ref.head; b != 0; {
+			if b >= bs.blockCount || reachable[b] {
+				return fmt.Errorf("Corrupt block chain for [%s] at block %d", key, b)
+			}
+			reachable[b] = true
+			block, err := bs.readBlock(b)
+			if err != nil {
+				return err
+			}
+			b = binary.BigEndian.Uint64(block[1:9])
+		}
+	}
+	orphans := []uint64{}
+	bs.free = 0
+	for b := bs.dataStart; b < bs.blockCount; b++ {
+		if !bs.getBit(b) {
+			bs.free++
+		} else if !reachable[b] {
+			orphans = append(orphans, b)
+		}
+	}
+	if len(orphans) > 0 {
+		bs.Logger.Warn("BlockStore", "Freeing %d orphaned block(s)", len(orphans))
+		if err := bs.release(orphans); err != nil {
+			return err
+		}
+	}
+	bs.cursor = bs.dataStart
+
+	bs.Logger.Info("BlockStore", "Opened %s: %d item(s), %d of %d blocks free", bs.Device.DeviceName, len(bs.index), bs.free, bs.blockCount)
+	return nil
+}
+
+// readItem reads the item chain starting at the given head block, returning the item and its blocks.
+func (bs *BlockStore) readItem(head uint64) (*Item, []uint64, error) {
+	block, err := bs.readBlock(head)
+	if err != nil {
+		return nil, nil, err
+	}
+	if block[0] != blockTypeHead {
+		return nil, nil, errors.New("Not a head block")
+	}
+	item := &Item{Flags: int16(binary.BigEndian.Uint16(block[17:19]))}
+	if exp := int64(binary.BigEndian.Uint64(block[19:27])); exp != 0 {
+		t := time.Unix(0, exp).UTC()
+		item.ExpiresAt = &t
+	}
+	item.Version = binary.BigEndian.Uint64(block[27:35])
+	item.Compressed = block[35]&encodingCompressed != 0
+	item.Tombstone = block[35]&encodingTombstone != 0
+	item.Checksum = binary.BigEndian.Uint32(block[36:40])
+	keylen := uint64(binary.BigEndian.Uint32(block[40:44]))
+	datalen := uint64(binary.BigEndian.Uint32(block[44:48]))
+	if keylen > bs.blockSize-headHeaderSize {
+		return nil, nil, errors.New("Invalid key length")
+	}
+
+	total := keylen + datalen
+	payload := make([]byte, 0, total)
+	payload = append(payload, block[headHeaderSize:headHeaderSize+minUint64(total, bs.blockSize-headHeaderSize)]...)
+	blocks := []uint64{head}
+	next := binary.BigEndian.Uint64(block[1:9])
+	for uint64(len(payload)) < total {
+		if next == 0 || next >= bs.blockCount || len(blocks) > int(bs.blockCount) {
+			return nil, nil, errors.New("Truncated block chain")
+		}
+		block, err = bs.readBlock(next)
+		if err != nil {
+			return nil, nil, err
+		}
+		if block[0] != blockTypeOverflow {
+			return nil, nil, errors.New("Expected overflow block")
+		}
+		blocks = append(blocks, next)
+		remaining := total - uint64(len(payload))
+		payload = append(payload, block[blockHeaderSize:blockHeaderSize+minUint64(remaining, bs.blockSize-blockHeaderSize)]...)
+		next = binary.BigEndian.Uint64(block[1:9])
+	}
+
+	item.Key = string(payload[:keylen])
+	item.Data = payload[keylen:]
+	return item, blocks, nil
+}
+
+// freeChain marks the head block free on disk, then releases every block in its chain.
+func (bs *BlockStore) freeChain(head uint64) error {
+	blocks := []uint64{}
+	for b := head; b != 0 && b < bs.blockCount && len(blocks) <= int(bs.blockCount); {
+		blocks = append(blocks, b)
+		block, err := bs.readBlock(b)
+		if err != nil {
+			return err
+		}
+		b = binary.BigEndian.Uint64(block[1:9])
+	}
+	if err := bs.writeBlock(head, make([]byte, bs.blockSize)); err != nil {
+		return err
+	}
+	return bs.release(blocks)
+}
+
+// allocate finds and marks count free blocks in memory. The bitmap is persisted by commit once they are written.
+func (bs *BlockStore) allocate(count uint64) ([]uint64, error) {
+	if count > bs.free {
+		return nil, ErrStorageFull
+	}
+	blocks := make([]uint64, 0, count)
+	span := bs.blockCount - bs.dataStart
+	for i := uint64(0); i < span && uint64(len(blocks)) < count; i++ {
+		b := bs.dataStart + (bs.cursor-bs.dataStart+i)%span
+		if !bs.getBit(b) {
+			blocks = append(blocks, b)
+		}
+	}
+	for _, b := range blocks {
+		bs.setBit(b, true)
+	}
+	bs.free -= count
+	bs.cursor = blocks[len(blocks)-1] + 1
+	if bs.cursor >= bs.blockCount {
+		bs.cursor = bs.dataStart
+	}
+	return blocks, nil
+}
+
+// commit persists the bitmap for a written chain of blocks, writing the bitmap block covering the head last so
+// the head is never allocated on disk before the rest of its chain.
+func (bs *BlockStore) commit(blocks []uint64) error {
+	if err := bs.writeBitmapFor(blocks[1:]); err != nil {
+		return err
+	}
+	return bs.writeBitmapFor(blocks[:1])
+}
+
+// release clears the given blocks in the bitmap and persists it.
+func (bs *BlockStore) release(blocks []uint64) error {
+	for _, b := range blocks {
+		if bs.getBit(b) {
+			bs.setBit(b, false)
+			bs.free++
+		}
+	}
+	return bs.writeBitmapFor(blocks)
+}
+
+func (bs *BlockStore) getBit(block uint64) bool {
+	return bs.bitmap[block/8]&(1<<(block%8)) != 0
+}
+
+func (bs *BlockStore) setBit(block uint64, value bool) {
+	if value {
+		bs.bitmap[block/8] |= 1 << (block % 8)
+	} else {
+		bs.bitmap[block/8] &^= 1 << (block % 8)
+	}
+}
+
+// writeBitmapFor writes the bitmap blocks covering the given blocks.
+func (bs *BlockStore) writeBitmapFor(blocks []uint64) error {
+	written := map[uint64]bool{}
+	for _, b := range blocks {
+		index := b / (bs.blockSize * 8)
+		if written[index] {
+			continue
+		}
+		written[index] = true
+		if err := bs.writeBitmapBlock(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *BlockStore) writeBitmapBlock(index uint64) error {
+	return bs.writeBlock(1+index, bs.bitmap[index*bs.blockSize:(index+1)*bs.blockSize])
+}
+
+// readBlock reads a whole block. Reads past the end of a sparse file return zeros. A block of an encrypted device
+// that has never been written also reads as zeros, unless it is allocated, as then it has been erased.
+func (bs *BlockStore) readBlock(block uint64) ([]byte, error) {
+	buffer := make([]byte, bs.blockSize)
+	_, err := bs.Device.ReadBlock(block, buffer)
+	if err == ErrUnwrittenBlock {
+		if bs.allocated(block) {
+			return buffer, fmt.Errorf("Block %d is allocated but has never been written", block)
+		}
+		return buffer, nil
+	}
+	return buffer, err
+}
+
+// allocated returns true if the block is the superblock, a bitmap block, or marked allocated in the bitmap.
+// Before the superblock is read, nothing is allocated.
+func (bs *BlockStore) allocated(block uint64) bool {
+	if block < bs.dataStart {
+		return true
+	}
+	return block/8 < uint64(len(bs.bitmap)) && bs.getBit(block)
+}
+
+func (bs *BlockStore) writeBlock(block uint64, buffer []byte) error {
+	n, err := bs.Device.WriteBlock(block, buffer)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != bs.blockSize {
+		return fmt.Errorf("Short write to block %d (%d bytes)", block, n)
+	}
+	return nil
+}
+
+// reencryptBatch rewrites the blocks from start up to end that are not encrypted with the current key.
+func (bs *BlockStore) reencryptBatch(current uint32, start uint64, end uint64) (uint64, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	var rewritten uint64
+	for b := start; b < end; b++ {
+		id, err := bs.Device.KeyID(b)
+		if err != nil {
+			return rewritten, err
+		}
+		if id == 0 && bs.allocated(b) {
+			return rewritten, fmt.Errorf("Block %d is allocated but has never been written", b)
+		}
+		if id == 0 || id == current {
+			continue
+		}
+		block, err := bs.readBlock(b)
+		if err != nil {
+			return rewritten, err
+		}
+		if err := bs.writeBlock(b, block); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
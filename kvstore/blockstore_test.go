@@ -0,0 +1,134 @@
+package kvstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+// newSparseDevice creates a sparse file of the given number of blocks and returns its path.
+func newSparseDevice(t *testing.T, blocks int64, blockSize int64) string {
+	file, err := ioutil.TempFile("", "trinity-blockstore")
+	assert.Nil(t, err)
+	assert.Nil(t, file.Truncate(blocks*blockSize))
+	assert.Nil(t, file.Close())
+	return file.Name()
+}
+
+func openBlockStore(t *testing.T, path string, format bool) *BlockStore {
+	dio := NewDiskIO(path, 256)
+	assert.Nil(t, dio.Open())
+	inst := NewBlockStore(util.NewLogger("error"), dio)
+	assert.Nil(t, inst.Open(format))
+	return inst
+}
+
+func TestBlockStoreNotFormatted(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	dio := NewDiskIO(path, 256)
+	assert.Nil(t, dio.Open())
+	defer dio.Close()
+	inst := NewBlockStore(util.NewLogger("error"), dio)
+
+	assert.Equal(t, ErrNotFormatted, inst.Open(false))
+}
+
+func TestBlockStoreSetGetDelete(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	inst := openBlockStore(t, path, true)
+	free := inst.FreeBlocks()
+	assert.Equal(t, uint64(62), free)
+
+	expiry := time.Now().Add(time.Hour).UTC()
+	large := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, 200)
+	assert.Nil(t, inst.set(&Item{Key: "small", Data: []byte{9}, Flags: 3, ExpiresAt: &expiry}))
+	assert.Nil(t, inst.set(&Item{Key: "large", Data: large}))
+	assert.True(t, inst.FreeBlocks() < free-2)
+
+	item, found := inst.get("small")
+	assert.True(t, found)
+	assert.Equal(t, []byte{9}, item.Data)
+	assert.Equal(t, int16(3), item.Flags)
+	assert.Equal(t, expiry.UnixNano(), item.ExpiresAt.UnixNano())
+
+	item, found = inst.get("large")
+	assert.True(t, found)
+	assert.Equal(t, large, item.Data)
+
+	// Overwriting frees the old chain
+	assert.Nil(t, inst.set(&Item{Key: "large", Data: []byte{1}}))
+	assert.Equal(t, free-2, inst.FreeBlocks())
+
+	assert.True(t, inst.delete("small"))
+	assert.False(t, inst.delete("small"))
+	_, found = inst.get("small")
+	assert.False(t, found)
+	assert.Equal(t, free-1, inst.FreeBlocks())
+
+	assert.Nil(t, inst.close())
+}
+
+func TestBlockStoreReopen(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	inst := openBlockStore(t, path, true)
+	large := bytes.Repeat([]byte{7}, 1000)
+	assert.Nil(t, inst.set(&Item{Key: "one", Data: []byte{1}}))
+	assert.Nil(t, inst.set(&Item{Key: "two", Data: large}))
+	assert.Nil(t, inst.set(&Item{Key: "one", Data: []byte{2}, Version: 42}))
+	free := inst.FreeBlocks()
+	assert.Nil(t, inst.close())
+
+	inst = openBlockStore(t, path, false)
+	defer inst.close()
+
+	assert.Equal(t, free, inst.FreeBlocks())
+	item, found := inst.get("one")
+	assert.True(t, found)
+	assert.Equal(t, []byte{2}, item.Data)
+	assert.Equal(t, uint64(42), item.Version)
+	item, found = inst.get("two")
+	assert.True(t, found)
+	assert.Equal(t, large, item.Data)
+}
+
+func TestBlockStoreFull(t *testing.T) {
+	path := newSparseDevice(t, 8, 256)
+	defer os.Remove(path)
+
+	inst := openBlockStore(t, path, true)
+	defer inst.close()
+
+	assert.Equal(t, ErrStorageFull, inst.set(&Item{Key: "big", Data: make([]byte, 256*8)}))
+	assert.Equal(t, uint64(6), inst.FreeBlocks())
+}
+
+func TestBlockKVStore(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	logger := util.NewLogger("error")
+	inst := NewBlockKVStore(logger, openBlockStore(t, path, true))
+	assert.Nil(t, inst.Init())
+	inst.Set("one", []byte{0, 1, 2}, 1, nil)
+	assert.Nil(t, inst.Close())
+
+	inst = NewBlockKVStore(logger, openBlockStore(t, path, false))
+	assert.Nil(t, inst.Init())
+	defer inst.Close()
+
+	val, flag, ok := inst.Get("one")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0, 1, 2}, val)
+	assert.Equal(t, int16(1), flag)
+}
@@ -0,0 +1,328 @@
+package kvstore
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// bplusTreeOrder is the maximum number of keys in a B+tree node.
+const bplusTreeOrder = 64
+
+// bplusTreeMinKeys is the minimum number of keys in a non-root B+tree node.
+const bplusTreeMinKeys = bplusTreeOrder / 2
+
+// bplusNode is a node in a bplusTree. Internal nodes have len(keys)+1 children, where every key in
+// children[i] is less than keys[i] and every key in children[i+1] is greater than or equal to it.
+// Leaves hold the items and are linked in key order.
+type bplusNode struct {
+	leaf     bool
+	keys     []string
+	children []*bplusNode
+	items    []*Item
+	prev     *bplusNode
+	next     *bplusNode
+}
+
+// bplusTree is an in memory B+tree of items ordered by their raw key bytes.
+type bplusTree struct {
+	root *bplusNode
+	size int
+}
+
+func newBPlusTree() *bplusTree {
+	return &bplusTree{root: &bplusNode{leaf: true}}
+}
+
+// get returns the item for the key.
+func (tree *bplusTree) get(key string) (*Item, bool) {
+	leaf := tree.findLeaf(key)
+	i := sort.SearchStrings(leaf.keys, key)
+	if i < len(leaf.keys) && leaf.keys[i] == key {
+		return leaf.items[i], true
+	}
+	return nil, false
+}
+
+// random returns an item chosen by a random descent. Items in sparser leaves are somewhat more likely to be
+// chosen, which is close enough for eviction sampling. The tree must not be empty.
+func (tree *bplusTree) random() *Item {
+	node := tree.root
+	for !node.leaf {
+		node = node.children[rand.Intn(len(node.children))]
+	}
+	return node.items[rand.Intn(len(node.items))]
+}
+
+// set inserts or replaces the item for its key.
+func (tree *bplusTree) set(item *Item) {
+	sep, right := tree.insert(tree.root, item)
+	if right != nil {
+		tree.root = &bplusNode{
+			keys:     []string{sep},
+			children: []*bplusNode{tree.root, right},
+		}
+	}
+}
+
+// delete removes the item for the key, returning whether it was present.
+func (tree *bplusTree) delete(key string) bool {
+	found := tree.remove(tree.root, key)
+	if !tree.root.leaf && len(tree.root.keys) == 0 {
+		tree.root = tree.root.children[0]
+	}
+	return found
+}
+
+// ascend calls fn for every item with a key greater than or equal to start, in ascending order, until fn returns false.
+func (tree *bplusTree) ascend(start string, fn func(*Item) bool) {
+	leaf := tree.findLeaf(start)
+	i := sort.SearchStrings(leaf.keys, start)
+	for leaf != nil {
+		for ; i < len(leaf.keys); i++ {
+			if !fn(leaf.items[i]) {
+				return
+			}
+		}
+		leaf, i = leaf.next, 0
+	}
+}
+
+// descend calls fn for every item with a key less than or equal to start, in descending order, until fn returns
+// false. If last is true, start is ignored and iteration begins at the greatest key.
+func (tree *bplusTree) descend(start string, last bool, fn func(*Item) bool) {
+	var leaf *bplusNode
+	var i int
+	if last {
+		leaf = tree.root
+		for !leaf.leaf {
+			leaf = leaf.children[len(leaf.children)-1]
+		}
+		i = len(leaf.keys) - 1
+	} else {
+		leaf = tree.findLeaf(start)
+		i = sort.Search(len(leaf.keys), func(j int) bool { return leaf.keys[j] > start }) - 1
+	}
+	for leaf != nil {
+		for ; i >= 0; i-- {
+			if !fn(leaf.items[i]) {
+				return
+			}
+		}
+		leaf = leaf.prev
+		if leaf != nil {
+			i = len(leaf.keys) - 1
+		}
+	}
+}
+
+// Private
+
+// childIndex returns the index of the child of an internal node that may contain the key.
+func (node *bplusNode) childIndex(key string) int {
+	return sort.Search(len(node.keys), func(i int) bool { return node.keys[i] > key })
+}
+
+func (tree *bplusTree) findLeaf(key string) *bplusNode {
+	node := tree.root
+	for !node.leaf {
+		node = node.children[node.childIndex(key)]
+	}
+	return node
+}
+
+// insert adds the item below node, returning the separator and new right sibling if node was split.
+func (tree *bplusTree) insert(node *bplusNode, item *Item) (string, *bplusNode) {
+	if node.leaf {
+		i := sort.SearchStrings(node.keys, item.Key)
+		if i < len(node.keys) && node.keys[i] == item.Key {
+			node.items[i] = item
+			return "", nil
+		}
+		node.keys = append(node.keys, "")
+		copy(node.keys[i+1:], node.keys[i:])
+		node.keys[i] = item.Key
+		node.items = append(node.items, nil)
+		copy(node.items[i+1:], node.items[i:])
+		node.items[i] = item
+		tree.size++
+
+		if len(node.keys) <= bplusTreeOrder {
+			return "", nil
+		}
+		mid := len(node.keys) / 2
+		right := &bplusNode{
+			leaf:  true,
+			keys:  append([]string{}, node.keys[mid:]...),
+			items: append([]*Item{}, node.items[mid:]...),
+			prev:  node,
+			next:  node.next,
+		}
+		if node.next != nil {
+			node.next.prev = right
+		}
+		node.next = right
+		node.keys = node.keys[:mid:mid]
+		node.items = node.items[:mid:mid]
+		return right.keys[0], right
+	}
+
+	i := node.childIndex(item.Key)
+	sep, child := tree.insert(node.children[i], item)
+	if child == nil {
+		return "", nil
+	}
+	node.keys = append(node.keys, "")
+	copy(node.keys[i+1:], node.keys[i:])
+	node.keys[i] = sep
+	node.children = append(node.children, nil)
+	copy(node.children[i+2:], node.children[i+1:])
+	node.children[i+1] = child
+
+	if len(node.keys) <= bplusTreeOrder {
+		return "", nil
+	}
+	mid := len(node.keys) / 2
+	sep = node.keys[mid]
+	right := &bplusNode{
+		keys:     append([]string{}, node.keys[mid+1:]...),
+		children: append([]*bplusNode{}, node.children[mid+1:]...),
+	}
+	node.keys = node.keys[:mid:mid]
+	node.children = node.children[: mid+1 : mid+1]
+	return sep, right
+}
+
+// remove deletes the key below node, rebalancing any child left with too few keys.
+func (tree *bplusTree) remove(node *bplusNode, key string) bool {
+	if node.leaf {
+		i := sort.SearchStrings(node.keys, key)
+		if i == len(node.keys) || node.keys[i] != key {
+			return false
+		}
+		node.keys = append(node.keys[:i], node.keys[i+1:]...)
+		copy(node.items[i:], node.items[i+1:])
+		node.items[len(node.items)-1] = nil
+		node.items = node.items[:len(node.items)-1]
+		tree.size--
+		return true
+	}
+
+	i := node.childIndex(key)
+	found := tree.remove(node.children[i], key)
+	if found && len(node.children[i].keys) < bplusTreeMinKeys {
+		node.rebalance(i)
+	}
+	return found
+}
+
+// rebalance fixes an underfull child i by borrowing from or merging with a sibling.
+func (node *bplusNode) rebalance(i int) {
+	child := node.children[i]
+	if i > 0 && len(node.children[i-1].keys) > bplusTreeMinKeys {
+		left := node.children[i-1]
+		last := len(left.keys) - 1
+		if child.leaf {
+			child.keys = append([]string{left.keys[last]}, child.keys...)
+			child.items = append([]*Item{left.items[last]}, child.items...)
+			left.keys, left.items = left.keys[:last], left.items[:last]
+			node.keys[i-1] = child.keys[0]
+		} else {
+			child.keys = append([]string{node.keys[i-1]}, child.keys...)
+			child.children = append([]*bplusNode{left.children[last+1]}, child.children...)
+			node.keys[i-1] = left.keys[last]
+			left.keys, left.children = left.keys[:last], left.children[:last+1]
+		}
+		return
+	}
+	if i < len(node.children)-1 && len(node.children[i+1].keys) > bplusTreeMinKeys {
+		right := node.children[i+1]
+		if child.leaf {
+			child.keys = append(child.keys, right.keys[0])
+			child.items = append(child.items, right.items[0])
+			right.keys, right.items = right.keys[1:], right.items[1:]
+			node.keys[i] = right.keys[0]
+		} else {
+			child.keys = append(child.keys, node.keys[i])
+			child.children = append(child.children, right.children[0])
+			node.keys[i] = right.keys[0]
+			right.keys, right.children = right.keys[1:], right.children[1:]
+		}
+		return
+	}
+	if i > 0 {
+		node.merge(i - 1)
+	} else {
+		node.merge(i)
+	}
+}
+
+// merge combines children i and i+1 into child i.
+func (node *bplusNode) merge(i int) {
+	left, right := node.children[i], node.children[i+1]
+	if left.leaf {
+		left.keys = append(left.keys, right.keys...)
+		left.items = append(left.items, right.items...)
+		left.next = right.next
+		if right.next != nil {
+			right.next.prev = left
+		}
+	} else {
+		left.keys = append(append(left.keys, node.keys[i]), right.keys...)
+		left.children = append(left.children, right.children...)
+	}
+	node.keys = append(node.keys[:i], node.keys[i+1:]...)
+	node.children = append(node.children[:i+1], node.children[i+2:]...)
+}
+
+// bplusTreeBackend stores items in memory in a B+tree ordered by key.
+type bplusTreeBackend struct {
+	tree *bplusTree
+}
+
+func newBPlusTreeBackend() *bplusTreeBackend {
+	return &bplusTreeBackend{tree: newBPlusTree()}
+}
+
+func (bb *bplusTreeBackend) get(key string) (*Item, bool) {
+	return bb.tree.get(key)
+}
+
+func (bb *bplusTreeBackend) set(item *Item) error {
+	bb.tree.set(item)
+	return nil
+}
+
+func (bb *bplusTreeBackend) delete(key string) bool {
+	return bb.tree.delete(key)
+}
+
+func (bb *bplusTreeBackend) each(fn func(*Item) bool) {
+	bb.tree.ascend("", fn)
+}
+
+func (bb *bplusTreeBackend) ascend(start string, fn func(*Item) bool) {
+	bb.tree.ascend(start, fn)
+}
+
+func (bb *bplusTreeBackend) descend(start string, last bool, fn func(*Item) bool) {
+	bb.tree.descend(start, last, fn)
+}
+
+func (bb *bplusTreeBackend) sample(n int) []*Item {
+	items := make([]*Item, 0, n)
+	if bb.tree.size == 0 {
+		return items
+	}
+	for len(items) < n {
+		items = append(items, bb.tree.random())
+	}
+	return items
+}
+
+func (bb *bplusTreeBackend) len() int {
+	return bb.tree.size
+}
+
+func (bb *bplusTreeBackend) close() error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package kvstore
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+// checkBPlusNode verifies ordering, fill and separator invariants below node, returning its depth.
+func checkBPlusNode(t *testing.T, node *bplusNode, root bool, lower, upper *string) int {
+	if !root {
+		assert.True(t, len(node.keys) >= bplusTreeMinKeys, "node underfull")
+	}
+	assert.True(t, len(node.keys) <= bplusTreeOrder, "node overfull")
+	assert.True(t, sort.StringsAreSorted(node.keys), "node keys unsorted")
+	for _, key := range node.keys {
+		if lower != nil {
+			assert.True(t, key >= *lower, "key below separator")
+		}
+		if upper != nil {
+			assert.True(t, key < *upper, "key above separator")
+		}
+	}
+	if node.leaf {
+		assert.Equal(t, len(node.keys), len(node.items))
+		return 1
+	}
+	assert.Equal(t, len(node.keys)+1, len(node.children))
+	depth := -1
+	for i, child := range node.children {
+		lo, hi := lower, upper
+		if i > 0 {
+			lo = &node.keys[i-1]
+		}
+		if i < len(node.keys) {
+			hi = &node.keys[i]
+		}
+		d := checkBPlusNode(t, child, false, lo, hi)
+		if depth != -1 {
+			assert.Equal(t, depth, d, "unbalanced tree")
+		}
+		depth = d
+	}
+	return depth + 1
+}
+
+func TestBPlusTreeRandom(t *testing.T) {
+	tree := newBPlusTree()
+	model := map[string]int{}
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", rng.Intn(5000))
+		if rng.Intn(3) == 0 {
+			_, exists := model[key]
+			assert.Equal(t, exists, tree.delete(key))
+			delete(model, key)
+		} else {
+			tree.set(&Item{Key: key, Data: []byte{byte(i)}})
+			model[key] = i
+		}
+	}
+
+	checkBPlusNode(t, tree.root, true, nil, nil)
+	assert.Equal(t, len(model), tree.size)
+
+	keys := []string{}
+	for key := range model {
+		keys = append(keys, key)
+		item, found := tree.get(key)
+		assert.True(t, found)
+		assert.Equal(t, []byte{byte(model[key])}, item.Data)
+	}
+	sort.Strings(keys)
+
+	ascended := []string{}
+	tree.ascend("", func(item *Item) bool {
+		ascended = append(ascended, item.Key)
+		return true
+	})
+	assert.Equal(t, keys, ascended)
+
+	descended := []string{}
+	tree.descend("", true, func(item *Item) bool {
+		descended = append(descended, item.Key)
+		return true
+	})
+	for i, j := 0, len(descended)-1; i < j; i, j = i+1, j-1 {
+		descended[i], descended[j] = descended[j], descended[i]
+	}
+	assert.Equal(t, keys, descended)
+
+	for key := range model {
+		assert.True(t, tree.delete(key))
+	}
+	assert.Equal(t, 0, tree.size)
+	assert.True(t, tree.root.leaf)
+}
+
+func TestBPlusTreeSeek(t *testing.T) {
+	tree := newBPlusTree()
+	for i := 0; i < 1000; i += 2 {
+		tree.set(&Item{Key: fmt.Sprintf("%04d", i)})
+	}
+
+	keys := []string{}
+	tree.ascend("0101", func(item *Item) bool {
+		keys = append(keys, item.Key)
+		return len(keys) < 3
+	})
+	assert.Equal(t, []string{"0102", "0104", "0106"}, keys)
+
+	keys = []string{}
+	tree.descend("0101", false, func(item *Item) bool {
+		keys = append(keys, item.Key)
+		return len(keys) < 3
+	})
+	assert.Equal(t, []string{"0100", "0098", "0096"}, keys)
+}
+
+func TestBPlusTreeKVStore(t *testing.T) {
+	inst := NewBPlusTreeKVStore(util.NewLogger("error"))
+	inst.set(newItem("b", []byte{2}, 0, nil, 0))
+	inst.set(newItem("a", []byte{1}, 0, nil, 0))
+	inst.set(newItem("c", []byte{3}, 0, nil, 0))
+
+	keys := []string{}
+	inst.Iterate(func(item *Item) bool {
+		keys = append(keys, item.Key)
+		return true
+	})
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+	assert.Equal(t, StorageBPlusTree, inst.Stats().Storage)
+}
@@ -0,0 +1,45 @@
+package kvstore
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/tomdionysus/trinity/util"
+)
+
+// ErrCorrupt is returned when an item's data does not match its checksum.
+var ErrCorrupt = errors.New("checksum mismatch")
+
+// newItem returns a new uncompressed item with the checksum of its data.
+func newItem(key string, data []byte, flags int16, expiry *time.Time, version uint64) *Item {
+	return &Item{Key: key, Data: data, Flags: flags, ExpiresAt: expiry, Version: version, Checksum: util.Checksum(data)}
+}
+
+// verify returns the item decompressed, or ErrCorrupt if it cannot be decompressed or does not match its
+// checksum, in which case the item is counted, removed and passed to OnCorruption.
+func (kvs *KVStore) verify(item *Item) (*Item, error) {
+	result, err := kvs.decompress(item)
+	if err == nil && util.Checksum(result.Data) == item.Checksum {
+		return result, nil
+	}
+	atomic.AddUint64(&kvs.corruptions, 1)
+	kvs.Logger.Error("KVStore", "CORRUPT [%s] (v%d) does not match its checksum", item.Key, item.Version)
+	// The caller may hold the store lock
+	go kvs.repair(item)
+	return nil, ErrCorrupt
+}
+
+// repair removes the corrupt item unless it has since been replaced, then calls OnCorruption.
+func (kvs *KVStore) repair(item *Item) {
+	kvs.mutex.Lock()
+	current, found := kvs.store.get(item.Key)
+	if found && current.Version == item.Version && kvs.logWAL(&WALRecord{Op: WALOpDelete, Key: item.Key}) == nil {
+		kvs.remove(item.Key)
+	}
+	kvs.mutex.Unlock()
+
+	if kvs.OnCorruption != nil {
+		kvs.OnCorruption(item.Key)
+	}
+}
@@ -0,0 +1,106 @@
+package kvstore
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+// waitCorruption returns the key passed to OnCorruption, or "" if it is not called within a second.
+func waitCorruption(repaired chan string) string {
+	select {
+	case key := <-repaired:
+		return key
+	case <-time.After(time.Second):
+		return ""
+	}
+}
+
+func TestChecksumCorruption(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	repaired := make(chan string, 1)
+	inst.OnCorruption = func(key string) { repaired <- key }
+
+	inst.Set("key", []byte("value"), 0, nil)
+	stored, _ := inst.store.get("key")
+	assert.Equal(t, util.Checksum([]byte("value")), stored.Checksum)
+	stored.Data[0] ^= 0xff
+
+	_, _, ok := inst.Get("key")
+	assert.False(t, ok)
+	assert.Equal(t, "key", waitCorruption(repaired))
+	assert.Equal(t, uint64(1), inst.Stats().Corruptions)
+
+	// The corrupt item is removed, so an older replica's copy can replace it
+	_, found := inst.store.get("key")
+	assert.False(t, found)
+	_, err := inst.SetVersion("key", []byte("value"), 0, nil, stored.Version)
+	assert.Nil(t, err)
+	val, _, ok := inst.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestChecksumCorruptionCompressed(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	inst.CompressThreshold = 64
+	repaired := make(chan string, 1)
+	inst.OnCorruption = func(key string) { repaired <- key }
+
+	inst.Set("key", bytes.Repeat([]byte("trinity "), 64), 0, nil)
+	stored, _ := inst.store.get("key")
+	assert.True(t, stored.Compressed)
+	stored.Data[len(stored.Data)/2] ^= 0xff
+
+	// Corrupt items are skipped by scans and updates
+	_, ok := inst.Scan(ScanOptions{}).Next()
+	assert.False(t, ok)
+	assert.Equal(t, "key", waitCorruption(repaired))
+	assert.False(t, inst.IsSet("key"))
+	assert.Equal(t, uint64(1), inst.Stats().Corruptions)
+}
+
+func TestChecksumUpdate(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+
+	inst.Set("key", []byte("1"), 0, nil)
+	stored, _ := inst.store.get("key")
+	stored.Data[0] = '2'
+
+	_, err := inst.Incr("key", 1)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, uint64(1), inst.Stats().Corruptions)
+}
+
+func TestChecksumBlockStore(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	blocks := openBlockStore(t, path, true)
+	inst := NewBlockKVStore(util.NewLogger("error"), blocks)
+	defer inst.Close()
+	repaired := make(chan string, 1)
+	inst.OnCorruption = func(key string) { repaired <- key }
+
+	inst.Set("key", []byte("value"), 0, nil)
+	val, _, ok := inst.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), val)
+
+	// Rot a bit of the value on the device
+	head := blocks.index["key"].head
+	block, err := blocks.readBlock(head)
+	assert.Nil(t, err)
+	block[headHeaderSize+len("key")] ^= 0x01
+	assert.Nil(t, blocks.writeBlock(head, block))
+
+	_, _, ok = inst.Get("key")
+	assert.False(t, ok)
+	assert.Equal(t, "key", waitCorruption(repaired))
+	assert.Equal(t, uint64(1), inst.Stats().Corruptions)
+	assert.False(t, inst.IsSet("key"))
+}
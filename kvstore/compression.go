@@ -0,0 +1,47 @@
+package kvstore
+
+import (
+	"sync/atomic"
+
+	"github.com/tomdionysus/trinity/util"
+)
+
+// encodingCompressed marks compressed item data in the WAL and on block storage.
+const encodingCompressed = 1
+
+// compress replaces the item's data with its compressed form if CompressThreshold is set, the data is at
+// least that long, and compression makes it smaller.
+func (kvs *KVStore) compress(item *Item) {
+	if item.Compressed {
+		return
+	}
+	data, compressed := util.CompressIfSmaller(item.Data, kvs.CompressThreshold)
+	if !compressed {
+		return
+	}
+	atomic.AddUint64(&kvs.uncompressedBytes, uint64(len(item.Data)))
+	atomic.AddUint64(&kvs.compressedBytes, uint64(len(data)))
+	item.Data = data
+	item.Compressed = true
+}
+
+// decompress returns the item with its data decompressed, as a copy if it was compressed.
+func (kvs *KVStore) decompress(item *Item) (*Item, error) {
+	if !item.Compressed {
+		return item, nil
+	}
+	data, err := util.Decompress(item.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &Item{Key: item.Key, Data: data, Flags: item.Flags, ExpiresAt: item.ExpiresAt, Version: item.Version, Checksum: item.Checksum}, nil
+}
+
+// CompressionRatio returns the ratio of the original to the compressed size of the values compressed so far,
+// or 0 if none have been.
+func (stats Stats) CompressionRatio() float64 {
+	if stats.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(stats.UncompressedBytes) / float64(stats.CompressedBytes)
+}
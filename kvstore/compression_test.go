@@ -0,0 +1,99 @@
+package kvstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestCompression(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	inst.CompressThreshold = 64
+
+	large := bytes.Repeat([]byte("trinity "), 64)
+	assert.Nil(t, inst.Set("large", large, 1, nil))
+	assert.Nil(t, inst.Set("small", []byte("tiny"), 2, nil))
+
+	stored, _ := inst.store.get("large")
+	assert.True(t, stored.Compressed)
+	assert.True(t, len(stored.Data) < len(large))
+	stored, _ = inst.store.get("small")
+	assert.False(t, stored.Compressed)
+
+	val, flags, ok := inst.Get("large")
+	assert.True(t, ok)
+	assert.Equal(t, large, val)
+	assert.Equal(t, int16(1), flags)
+
+	item, ok := inst.Scan(ScanOptions{Prefix: "large"}).Next()
+	assert.True(t, ok)
+	assert.Equal(t, large, item.Data)
+
+	stats := inst.Stats()
+	assert.Equal(t, uint64(len(large)), stats.UncompressedBytes)
+	assert.True(t, stats.CompressionRatio() > 1)
+}
+
+func TestCompressionUpdate(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	inst.CompressThreshold = 64
+
+	large := bytes.Repeat([]byte("a"), 128)
+	inst.Set("key", large, 0, nil)
+	item, err := inst.Append("key", []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, append(large, 'b'), item.Data)
+
+	val, _, _ := inst.Get("key")
+	assert.Equal(t, append(large, 'b'), val)
+}
+
+func TestCompressionReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("error")
+	large := bytes.Repeat([]byte("trinity "), 64)
+	inst := NewKVStore(logger)
+	inst.CompressThreshold = 64
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	inst.Set("large", large, 0, nil)
+	assert.Nil(t, inst.Close())
+
+	// Compressed items are read back whatever the threshold
+	inst = NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	defer inst.Close()
+
+	val, _, ok := inst.Get("large")
+	assert.True(t, ok)
+	assert.Equal(t, large, val)
+}
+
+func TestCompressionBlockStore(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	logger := util.NewLogger("error")
+	large := bytes.Repeat([]byte("trinity "), 256)
+	inst := NewBlockKVStore(logger, openBlockStore(t, path, true))
+	inst.CompressThreshold = 64
+	assert.Nil(t, inst.Init())
+	inst.Set("large", large, 0, nil)
+	assert.Nil(t, inst.Close())
+
+	inst = NewBlockKVStore(logger, openBlockStore(t, path, false))
+	assert.Nil(t, inst.Init())
+	defer inst.Close()
+
+	val, _, ok := inst.Get("large")
+	assert.True(t, ok)
+	assert.Equal(t, large, val)
+}
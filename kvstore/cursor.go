@@ -0,0 +1,225 @@
+package kvstore
+
+import (
+	"sort"
+	"time"
+)
+
+// ScanPageSize is the number of items a Cursor fetches each time it takes the store lock.
+const ScanPageSize = 100
+
+// ScanOptions selects the items returned by a Cursor. Keys are compared as raw bytes.
+type ScanOptions struct {
+	// Start is the lowest key returned, inclusive. Empty means from the first key.
+	Start string
+	// End is the key at which the scan stops, exclusive. Empty means to the last key.
+	End string
+	// Prefix restricts the scan to keys starting with it, within Start and End.
+	Prefix string
+	// Limit is the maximum number of items returned, or 0 for no limit.
+	Limit int
+	// Reverse returns items in descending key order, from End down to Start.
+	Reverse bool
+	// Tombstones includes the tombstones of deleted keys, as items with Tombstone set, so that the scans of
+	// several replicas can be merged.
+	Tombstones bool
+}
+
+// Cursor iterates over the items selected by a scan, in key order. Each Engine returns its own implementation.
+type Cursor interface {
+	// Next returns the next item, or false when the scan is complete. The item must not be modified.
+	Next() (*Item, bool)
+}
+
+// kvsCursor is the Cursor of a KVStore.
+//
+// Items are fetched a page at a time under the store read lock, so a scan never holds up writes for long.
+// Each page is consistent, no key is returned twice, and keys are always returned in order; a key set or
+// deleted during the scan is seen if it has not yet been passed. On the ordered bplustree storage, keys
+// set during the scan are found; on other storage, the keys in range are listed when the scan starts.
+type kvsCursor struct {
+	kvs     *KVStore
+	options ScanOptions
+
+	lower    string
+	upper    string
+	hasUpper bool
+
+	page    []*Item
+	pos     int
+	last    string
+	started bool
+	done    bool
+	count   int
+
+	// keys is the sorted list of keys in range, for storage that cannot iterate in order.
+	keys []string
+}
+
+// orderedBackend is a backend that can iterate in key order.
+type orderedBackend interface {
+	backend
+	ascend(start string, fn func(*Item) bool)
+	descend(start string, last bool, fn func(*Item) bool)
+}
+
+// Scan returns a Cursor over the items selected by options.
+func (kvs *KVStore) Scan(options ScanOptions) Cursor {
+	inst := &kvsCursor{
+		kvs:     kvs,
+		options: options,
+		lower:   options.Start,
+		upper:   options.End,
+	}
+	inst.hasUpper = options.End != ""
+	if options.Prefix != "" {
+		if options.Prefix > inst.lower {
+			inst.lower = options.Prefix
+		}
+		if end, bounded := prefixEnd(options.Prefix); bounded && (!inst.hasUpper || end < inst.upper) {
+			inst.upper, inst.hasUpper = end, true
+		}
+	}
+	if inst.hasUpper && inst.upper <= inst.lower {
+		inst.done = true
+	}
+	return inst
+}
+
+// Next returns the next item, or false when the scan is complete. The item must not be modified.
+func (cur *kvsCursor) Next() (*Item, bool) {
+	for {
+		if cur.options.Limit > 0 && cur.count >= cur.options.Limit {
+			return nil, false
+		}
+		if cur.pos >= len(cur.page) {
+			if cur.done {
+				return nil, false
+			}
+			cur.fetch()
+			if len(cur.page) == 0 {
+				return nil, false
+			}
+		}
+		item, err := cur.page[cur.pos], error(nil)
+		if !item.Tombstone {
+			item, err = cur.kvs.verify(item)
+		}
+		cur.pos++
+		if err != nil {
+			continue
+		}
+		cur.count++
+		return item, true
+	}
+}
+
+// Private
+
+// fetch reads the next page of items under the store read lock.
+func (cur *kvsCursor) fetch() {
+	cur.page = cur.page[:0]
+	cur.pos = 0
+
+	size := ScanPageSize
+	if cur.options.Limit > 0 && cur.options.Limit-cur.count < size {
+		size = cur.options.Limit - cur.count
+	}
+
+	cur.kvs.mutex.RLock()
+	defer cur.kvs.mutex.RUnlock()
+
+	now := time.Now()
+	if ordered, ok := cur.kvs.store.(orderedBackend); ok {
+		collect := func(item *Item) bool {
+			if cur.started && item.Key == cur.last {
+				return true
+			}
+			if !cur.inRange(item.Key) {
+				cur.done = true
+				return false
+			}
+			if !cur.wanted(item, now) || item.Key == cur.upper && cur.hasUpper {
+				return true
+			}
+			cur.page = append(cur.page, item)
+			return len(cur.page) < size
+		}
+		switch {
+		case !cur.options.Reverse && !cur.started:
+			ordered.ascend(cur.lower, collect)
+		case !cur.options.Reverse:
+			ordered.ascend(cur.last, collect)
+		case cur.started:
+			ordered.descend(cur.last, false, collect)
+		case cur.hasUpper:
+			ordered.descend(cur.upper, false, collect)
+		default:
+			ordered.descend("", true, collect)
+		}
+		if len(cur.page) < size {
+			cur.done = true
+		}
+	} else {
+		if cur.keys == nil {
+			cur.listKeys()
+		}
+		for len(cur.keys) > 0 && len(cur.page) < size {
+			key := cur.keys[0]
+			cur.keys = cur.keys[1:]
+			if item, found := cur.kvs.store.get(key); found && cur.wanted(item, now) {
+				cur.page = append(cur.page, item)
+			}
+		}
+		if len(cur.keys) == 0 {
+			cur.done = true
+		}
+	}
+
+	if len(cur.page) > 0 {
+		cur.last = cur.page[len(cur.page)-1].Key
+		cur.started = true
+	}
+}
+
+// wanted returns true if the item is returned by the scan.
+func (cur *kvsCursor) wanted(item *Item, now time.Time) bool {
+	return item.live(now) || item.Tombstone && cur.options.Tombstones
+}
+
+// inRange returns false once the key has passed the end of the scan in its direction. The upper bound key
+// itself is reported in range when descending so that iteration can continue below it.
+func (cur *kvsCursor) inRange(key string) bool {
+	if cur.options.Reverse {
+		return key >= cur.lower
+	}
+	return !cur.hasUpper || key < cur.upper
+}
+
+// listKeys lists and sorts the keys in range, for storage that cannot iterate in order.
+func (cur *kvsCursor) listKeys() {
+	cur.keys = []string{}
+	cur.kvs.store.each(func(item *Item) bool {
+		if item.Key >= cur.lower && (!cur.hasUpper || item.Key < cur.upper) {
+			cur.keys = append(cur.keys, item.Key)
+		}
+		return true
+	})
+	if cur.options.Reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(cur.keys)))
+	} else {
+		sort.Strings(cur.keys)
+	}
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix, or false if there is none.
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+// scanKeys returns the keys returned by a scan of inst.
+func scanKeys(inst *KVStore, options ScanOptions) []string {
+	keys := []string{}
+	cursor := inst.Scan(options)
+	for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+		keys = append(keys, item.Key)
+	}
+	return keys
+}
+
+func newScanKVStores() map[string]*KVStore {
+	logger := util.NewLogger("error")
+	stores := map[string]*KVStore{
+		StorageMemory:    NewKVStore(logger),
+		StorageBPlusTree: NewBPlusTreeKVStore(logger),
+	}
+	for _, inst := range stores {
+		for i := 0; i < 250; i++ {
+			inst.Set(fmt.Sprintf("key%03d", i), []byte{1}, 0, nil)
+		}
+		inst.Set("other", []byte{1}, 0, nil)
+	}
+	return stores
+}
+
+func TestScanAll(t *testing.T) {
+	for name, inst := range newScanKVStores() {
+		keys := scanKeys(inst, ScanOptions{})
+		assert.Equal(t, 251, len(keys), name)
+		assert.Equal(t, "key000", keys[0], name)
+		assert.Equal(t, "key249", keys[249], name)
+		assert.Equal(t, "other", keys[250], name)
+
+		keys = scanKeys(inst, ScanOptions{Reverse: true})
+		assert.Equal(t, 251, len(keys), name)
+		assert.Equal(t, "other", keys[0], name)
+		assert.Equal(t, "key000", keys[250], name)
+	}
+}
+
+func TestScanRange(t *testing.T) {
+	for name, inst := range newScanKVStores() {
+		assert.Equal(t, []string{"key010", "key011", "key012"}, scanKeys(inst, ScanOptions{Start: "key010", End: "key013"}), name)
+		assert.Equal(t, []string{"key012", "key011", "key010"}, scanKeys(inst, ScanOptions{Start: "key010", End: "key013", Reverse: true}), name)
+		assert.Equal(t, []string{"key248", "key249", "other"}, scanKeys(inst, ScanOptions{Start: "key248"}), name)
+		assert.Equal(t, []string{"key001", "key000"}, scanKeys(inst, ScanOptions{End: "key002", Reverse: true}), name)
+		assert.Equal(t, []string{}, scanKeys(inst, ScanOptions{Start: "key013", End: "key010"}), name)
+	}
+}
+
+func TestScanPrefixLimit(t *testing.T) {
+	for name, inst := range newScanKVStores() {
+		keys := scanKeys(inst, ScanOptions{Prefix: "key1"})
+		assert.Equal(t, 100, len(keys), name)
+		assert.Equal(t, "key100", keys[0], name)
+		assert.Equal(t, "key199", keys[99], name)
+
+		assert.Equal(t, []string{"key199", "key198"}, scanKeys(inst, ScanOptions{Prefix: "key1", Reverse: true, Limit: 2}), name)
+		assert.Equal(t, []string{"key150", "key151"}, scanKeys(inst, ScanOptions{Prefix: "key1", Start: "key150", Limit: 2}), name)
+		assert.Equal(t, 150, len(scanKeys(inst, ScanOptions{Limit: 150})), name)
+		assert.Equal(t, []string{"other"}, scanKeys(inst, ScanOptions{Prefix: "o"}), name)
+	}
+}
+
+func TestScanConcurrentWrites(t *testing.T) {
+	for name, inst := range newScanKVStores() {
+		past := time.Now().Add(-time.Second)
+		inst.set(&Item{Key: "key005", Data: []byte{1}, ExpiresAt: &past})
+
+		cursor := inst.Scan(ScanOptions{Prefix: "key"})
+		seen := map[string]bool{}
+		last := ""
+		for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+			assert.True(t, item.Key > last, name)
+			assert.False(t, seen[item.Key], name)
+			seen[item.Key] = true
+			last = item.Key
+			if item.Key == "key050" {
+				// Delete ahead of, and set behind, the cursor
+				inst.Delete("key200")
+				inst.Set("key000", []byte{2}, 0, nil)
+			}
+		}
+		assert.False(t, seen["key005"], name)
+		assert.False(t, seen["key200"], name)
+		assert.Equal(t, 248, len(seen), name)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	end, ok := prefixEnd("abc")
+	assert.True(t, ok)
+	assert.Equal(t, "abd", end)
+	end, ok = prefixEnd("a\xff")
+	assert.True(t, ok)
+	assert.Equal(t, "b", end)
+	_, ok = prefixEnd("\xff\xff")
+	assert.False(t, ok)
+}
@@ -1,6 +1,7 @@
 package kvstore
 
 import (
+	"encoding/binary"
 	"syscall"
 	// "errors"
 )
@@ -8,6 +9,9 @@ import (
 type DiskIO struct {
 	DeviceName string
 	BlockSize  uint
+	// Keys, if set, encrypts every block written and decrypts every block read. Each block then holds
+	// PayloadSize bytes.
+	Keys *DataKeys
 
 	fileDescriptor int
 }
@@ -33,7 +37,82 @@ func (dio *DiskIO) Close() error {
 	return syscall.Close(dio.fileDescriptor)
 }
 
+// Sync flushes all written blocks to stable storage.
+func (dio *DiskIO) Sync() error {
+	return syscall.Fsync(dio.fileDescriptor)
+}
+
+// Blocks returns the number of whole blocks on the device.
+func (dio *DiskIO) Blocks() (uint64, error) {
+	size, err := syscall.Seek(dio.fileDescriptor, 0, 2)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(size) / uint64(dio.BlockSize), nil
+}
+
+// PayloadSize returns the number of bytes of data each block holds, which is less than BlockSize when
+// the device is encrypted.
+func (dio *DiskIO) PayloadSize() uint {
+	if dio.Keys != nil {
+		return dio.BlockSize - encryptionOverhead
+	}
+	return dio.BlockSize
+}
+
+// ReadBlock reads a block into buffer, which must be PayloadSize bytes, decrypting it if the device is encrypted.
+// On an encrypted device, a block that has never been written reads as zeros and returns ErrUnwrittenBlock.
 func (dio *DiskIO) ReadBlock(blockaddr uint64, buffer []byte) (uint, error) {
+	if dio.Keys == nil {
+		return dio.readRaw(blockaddr, buffer)
+	}
+	raw := make([]byte, dio.BlockSize)
+	_, err := dio.readRaw(blockaddr, raw)
+	if err != nil {
+		return 0, err
+	}
+	err = dio.Keys.open(blockaddr, raw, buffer)
+	if err == ErrUnwrittenBlock {
+		return uint(len(buffer)), err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint(len(buffer)), nil
+}
+
+// WriteBlock writes a block from buffer, which must be PayloadSize bytes, encrypting it with the current key if
+// the device is encrypted.
+func (dio *DiskIO) WriteBlock(blockaddr uint64, buffer []byte) (uint, error) {
+	if dio.Keys == nil {
+		return dio.writeRaw(blockaddr, buffer)
+	}
+	raw := make([]byte, dio.BlockSize)
+	err := dio.Keys.seal(blockaddr, buffer, raw)
+	if err != nil {
+		return 0, err
+	}
+	num, err := dio.writeRaw(blockaddr, raw)
+	if err != nil {
+		return 0, err
+	}
+	if num < dio.BlockSize {
+		return 0, nil
+	}
+	return uint(len(buffer)), nil
+}
+
+// KeyID returns the ID of the key a block is encrypted with, or 0 if it has never been written.
+func (dio *DiskIO) KeyID(blockaddr uint64) (uint32, error) {
+	header := make([]byte, 4)
+	_, err := dio.readRaw(blockaddr, header)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header), nil
+}
+
+func (dio *DiskIO) readRaw(blockaddr uint64, buffer []byte) (uint, error) {
 	var noff int64 = int64(blockaddr) * int64(dio.BlockSize)
 	_, err := syscall.Seek(dio.fileDescriptor, noff, 0)
 	if err != nil {
@@ -46,7 +125,7 @@ func (dio *DiskIO) ReadBlock(blockaddr uint64, buffer []byte) (uint, error) {
 	return uint(num), nil
 }
 
-func (dio *DiskIO) WriteBlock(blockaddr uint64, buffer []byte) (uint, error) {
+func (dio *DiskIO) writeRaw(blockaddr uint64, buffer []byte) (uint, error) {
 	var noff int64 = int64(blockaddr) * int64(dio.BlockSize)
 	_, err := syscall.Seek(dio.fileDescriptor, noff, 0)
 	if err != nil {
@@ -0,0 +1,150 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// An encrypted block is [uint32 key ID][nonce][ciphertext][GCM tag]. Key ID 0 marks a block never written, which
+// is not authenticated, so it is up to the reader to know whether a block should have been written.
+const (
+	encryptionNonceSize = 12
+	encryptionOverhead  = 4 + encryptionNonceSize + 16
+)
+
+// ErrUnknownKey is returned when reading a block encrypted with a key that is not loaded.
+var ErrUnknownKey = errors.New("Block encrypted with unknown data key")
+
+// ErrUnwrittenBlock is returned when reading a block of an encrypted device that has never been written.
+var ErrUnwrittenBlock = errors.New("Block has never been written")
+
+// DataKeys holds the AES keys used to encrypt blocks at rest, by key ID. Blocks are written with the current key,
+// the one with the highest ID, and read with whichever key they were written with, so keys are rotated by adding
+// a new key and re-encrypting.
+type DataKeys struct {
+	current uint32
+	keys    map[uint32]cipher.AEAD
+}
+
+// NewDataKeys returns an empty set of data keys.
+func NewDataKeys() *DataKeys {
+	inst := &DataKeys{
+		keys: map[uint32]cipher.AEAD{},
+	}
+	return inst
+}
+
+// LoadDataKeys reads data keys from a key file. Each line is a key ID greater than 0 and a hex encoded 16, 24 or
+// 32 byte AES key, separated by whitespace. Blank lines and lines starting with # are ignored.
+func LoadDataKeys(path string) (*DataKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inst := NewDataKeys()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key ID and a key", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key ID '%s'", path, line, fields[0])
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: key is not hex", path, line)
+		}
+		if err := inst.Add(uint32(id), key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+	}
+	if len(inst.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return inst, nil
+}
+
+// Add adds an AES key with the given ID, which becomes the current key if it has the highest ID.
+func (dk *DataKeys) Add(id uint32, key []byte) error {
+	if id == 0 {
+		return errors.New("key ID 0 is reserved")
+	}
+	if _, found := dk.keys[id]; found {
+		return fmt.Errorf("duplicate key ID %d", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	dk.keys[id] = aead
+	if id > dk.current {
+		dk.current = id
+	}
+	return nil
+}
+
+// Current returns the ID of the key new blocks are written with.
+func (dk *DataKeys) Current() uint32 {
+	return dk.current
+}
+
+// seal encrypts the payload of a block with the current key into out, which is encryptionOverhead bytes longer.
+// The block address is authenticated so that a block cannot be moved to another address.
+func (dk *DataKeys) seal(blockaddr uint64, payload []byte, out []byte) error {
+	binary.BigEndian.PutUint32(out[0:4], dk.current)
+	nonce := out[4 : 4+encryptionNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	dk.keys[dk.current].Seal(out[4+encryptionNonceSize:4+encryptionNonceSize], nonce, payload, blockAAD(blockaddr))
+	return nil
+}
+
+// open decrypts an encrypted block into payload. A block never written is zeroed and returns ErrUnwrittenBlock.
+func (dk *DataKeys) open(blockaddr uint64, raw []byte, payload []byte) error {
+	id := binary.BigEndian.Uint32(raw[0:4])
+	if id == 0 {
+		for i := range payload {
+			payload[i] = 0
+		}
+		return ErrUnwrittenBlock
+	}
+	aead, found := dk.keys[id]
+	if !found {
+		return ErrUnknownKey
+	}
+	nonce := raw[4 : 4+encryptionNonceSize]
+	_, err := aead.Open(payload[:0], nonce, raw[4+encryptionNonceSize:], blockAAD(blockaddr))
+	if err != nil {
+		return fmt.Errorf("Cannot decrypt block %d with key %d: %s", blockaddr, id, err.Error())
+	}
+	return nil
+}
+
+func blockAAD(blockaddr uint64) []byte {
+	aad := make([]byte, 8)
+	binary.BigEndian.PutUint64(aad, blockaddr)
+	return aad
+}
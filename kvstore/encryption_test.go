@@ -0,0 +1,178 @@
+package kvstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+// newDataKeys returns data keys with a key of repeated bytes for each ID.
+func newDataKeys(t *testing.T, ids ...uint32) *DataKeys {
+	inst := NewDataKeys()
+	for _, id := range ids {
+		assert.Nil(t, inst.Add(id, bytes.Repeat([]byte{byte(id)}, 32)))
+	}
+	return inst
+}
+
+func openEncryptedBlockStore(t *testing.T, path string, keys *DataKeys, format bool) (*BlockStore, error) {
+	dio := NewDiskIO(path, 256)
+	dio.Keys = keys
+	assert.Nil(t, dio.Open())
+	inst := NewBlockStore(util.NewLogger("error"), dio)
+	return inst, inst.Open(format)
+}
+
+func writeKeyFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "trinity-datakey")
+	assert.Nil(t, err)
+	_, err = file.WriteString(contents)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	return file.Name()
+}
+
+func TestLoadDataKeys(t *testing.T) {
+	path := writeKeyFile(t, "# Keys\n1 000102030405060708090a0b0c0d0e0f\n\n3 "+
+		"000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f\n2 000102030405060708090a0b0c0d0e0f\n")
+	defer os.Remove(path)
+
+	keys, err := LoadDataKeys(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), keys.Current())
+	assert.Equal(t, 3, len(keys.keys))
+
+	for _, contents := range []string{"", "1", "0 000102030405060708090a0b0c0d0e0f", "1 nothex", "1 0001",
+		"1 000102030405060708090a0b0c0d0e0f\n1 000102030405060708090a0b0c0d0e0f"} {
+		bad := writeKeyFile(t, contents)
+		_, err = LoadDataKeys(bad)
+		assert.NotNil(t, err, contents)
+		os.Remove(bad)
+	}
+}
+
+func TestEncryptedBlockStore(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	inst, err := openEncryptedBlockStore(t, path, newDataKeys(t, 1), true)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(256-encryptionOverhead), inst.blockSize)
+	secret := bytes.Repeat([]byte("secret"), 100)
+	assert.Nil(t, inst.set(&Item{Key: "key", Data: secret}))
+	assert.Nil(t, inst.close())
+
+	raw, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret")))
+	assert.False(t, bytes.Contains(raw, blockStoreMagic))
+
+	inst, err = openEncryptedBlockStore(t, path, newDataKeys(t, 1), false)
+	assert.Nil(t, err)
+	item, found := inst.get("key")
+	assert.True(t, found)
+	assert.Equal(t, secret, item.Data)
+	inst.close()
+
+	// Without the key, the device is unreadable
+	inst, err = openEncryptedBlockStore(t, path, nil, false)
+	assert.Equal(t, ErrNotFormatted, err)
+	inst.close()
+	inst, err = openEncryptedBlockStore(t, path, newDataKeys(t, 2), false)
+	assert.Equal(t, ErrUnknownKey, err)
+	inst.close()
+}
+
+func TestEncryptedBlockTampered(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	inst, err := openEncryptedBlockStore(t, path, newDataKeys(t, 1), true)
+	assert.Nil(t, err)
+	defer inst.close()
+	assert.Nil(t, inst.set(&Item{Key: "key", Data: []byte("value")}))
+	head := inst.index["key"].head
+
+	raw := make([]byte, 256)
+	_, err = inst.Device.readRaw(head, raw)
+	assert.Nil(t, err)
+	raw[100] ^= 0x01
+	_, err = inst.Device.writeRaw(head, raw)
+	assert.Nil(t, err)
+
+	_, found := inst.get("key")
+	assert.False(t, found)
+
+	// Nor can a block be moved
+	_, err = inst.Device.writeRaw(head+1, raw)
+	assert.Nil(t, err)
+	_, err = inst.readBlock(head + 1)
+	assert.NotNil(t, err)
+}
+
+func TestEncryptedBlockErased(t *testing.T) {
+	path := newSparseDevice(t, 64, 256)
+	defer os.Remove(path)
+
+	inst, err := openEncryptedBlockStore(t, path, newDataKeys(t, 1), true)
+	assert.Nil(t, err)
+	assert.Nil(t, inst.set(&Item{Key: "key", Data: []byte("value")}))
+	head := inst.index["key"].head
+
+	// Free blocks never written read as zeros
+	block, err := inst.readBlock(head + 1)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, inst.blockSize), block)
+
+	// Zeroing the key ID of an allocated block does not erase it undetected
+	_, err = inst.Device.writeRaw(head, make([]byte, 4))
+	assert.Nil(t, err)
+	_, err = inst.readBlock(head)
+	assert.NotNil(t, err)
+	_, found := inst.get("key")
+	assert.False(t, found)
+	_, err = inst.Reencrypt()
+	assert.NotNil(t, err)
+	assert.Nil(t, inst.close())
+
+	_, err = openEncryptedBlockStore(t, path, newDataKeys(t, 1), false)
+	assert.NotNil(t, err)
+}
+
+func TestReencrypt(t *testing.T) {
+	path := newSparseDevice(t, 256, 256)
+	defer os.Remove(path)
+
+	inst, err := openEncryptedBlockStore(t, path, newDataKeys(t, 1), true)
+	assert.Nil(t, err)
+	large := bytes.Repeat([]byte{7}, 1000)
+	assert.Nil(t, inst.set(&Item{Key: "one", Data: []byte{1}}))
+	assert.Nil(t, inst.set(&Item{Key: "two", Data: large}))
+	assert.Nil(t, inst.close())
+
+	// Rotate to key 2
+	inst, err = openEncryptedBlockStore(t, path, newDataKeys(t, 1, 2), false)
+	assert.Nil(t, err)
+	assert.Nil(t, inst.set(&Item{Key: "three", Data: []byte{3}}))
+	count, err := inst.Reencrypt()
+	assert.Nil(t, err)
+	assert.True(t, count > 0)
+	count, err = inst.Reencrypt()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), count)
+	assert.Nil(t, inst.close())
+
+	// Key 1 is no longer needed
+	inst, err = openEncryptedBlockStore(t, path, newDataKeys(t, 2), false)
+	assert.Nil(t, err)
+	defer inst.close()
+	for key, data := range map[string][]byte{"one": {1}, "two": large, "three": {3}} {
+		item, found := inst.get(key)
+		assert.True(t, found, key)
+		assert.Equal(t, data, item.Data)
+	}
+}
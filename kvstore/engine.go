@@ -0,0 +1,82 @@
+package kvstore
+
+import (
+	"time"
+)
+
+// Storage Engines
+const (
+	StorageMemory    = "memory"
+	StorageBPlusTree = "bplustree"
+	StorageBlock     = "block"
+)
+
+// Engine is the interface to a Key Value storage engine, as used by the network layer.
+type Engine interface {
+	// Get returns the value and flags for the key, and whether it was found.
+	Get(key string) ([]byte, int16, bool)
+	// GetItem returns the item for the key, including its version, and whether it was found.
+	GetItem(key string) (*Item, bool)
+	// Lookup returns the item for the key like GetItem, or its tombstone if it has been deleted.
+	Lookup(key string) (*Item, bool)
+	// Set stores the value and flags for the key with a new version, expiring at expiry if it is not nil.
+	Set(key string, value []byte, flags int16, expiry *time.Time) error
+	// SetVersion stores the value with the given version, or a new version if it is 0, unless the current item
+	// is newer. It returns the version of the stored item.
+	SetVersion(key string, value []byte, flags int16, expiry *time.Time, version uint64) (uint64, error)
+	// CompareAndSet stores the value with a new version only if the current item has the expected version.
+	CompareAndSet(key string, value []byte, flags int16, expiry *time.Time, expected uint64) (uint64, error)
+	// Incr atomically adds delta to the decimal value of the key, returning the updated item.
+	Incr(key string, delta uint64) (*Item, error)
+	// Decr atomically subtracts delta from the decimal value of the key, stopping at 0, returning the updated item.
+	Decr(key string, delta uint64) (*Item, error)
+	// Append atomically adds data to the end of the value of the key, returning the updated item.
+	Append(key string, data []byte) (*Item, error)
+	// Prepend atomically adds data to the start of the value of the key, returning the updated item.
+	Prepend(key string, data []byte) (*Item, error)
+	// Delete removes the key with a new version, returning whether it was found.
+	Delete(key string) bool
+	// DeleteVersion removes the key with the given version, or a new version if it is 0, unless the current item
+	// is newer. It returns the version of the delete and whether the key was found.
+	DeleteVersion(key string, version uint64) (uint64, bool, error)
+	// Forget removes the key or its tombstone without leaving a tombstone, unless it is newer than version.
+	Forget(key string, version uint64) bool
+	// IsSet returns whether the key is present.
+	IsSet(key string) bool
+	// Iterate calls fn for every item until fn returns false. Items must not be modified.
+	Iterate(fn func(*Item) bool)
+	// Scan returns a Cursor over the items selected by options, in key order.
+	Scan(options ScanOptions) Cursor
+	// Sync persists every write made so far.
+	Sync() error
+	// Stats returns the current engine statistics.
+	Stats() Stats
+	// Keyspaces returns the statistics of each keyspace.
+	Keyspaces() map[string]KeyspaceStats
+	// SetKeyspaceQuota limits the size of the items in a keyspace, or removes the limit if quota is 0.
+	SetKeyspaceQuota(name string, quota int64)
+	// DropKeyspace deletes every item in a keyspace, returning the number deleted.
+	DropKeyspace(name string) int
+	// Close flushes and closes the underlying storage.
+	Close() error
+}
+
+// Stats holds the statistics of an Engine.
+type Stats struct {
+	Storage   string
+	Items     uint64
+	Memory    uint64
+	MaxMemory uint64
+	Gets      uint64
+	Hits      uint64
+	Sets      uint64
+	Deletes   uint64
+	Expired   uint64
+	Evictions uint64
+	// UncompressedBytes and CompressedBytes are the total sizes of values compressed so far before and after
+	// compression.
+	UncompressedBytes uint64
+	CompressedBytes   uint64
+	// Corruptions is the number of reads that found an item not matching its checksum.
+	Corruptions uint64
+}
@@ -0,0 +1,111 @@
+package kvstore
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Eviction Policies
+const (
+	EvictionLRU        = "lru"
+	EvictionLFU        = "lfu"
+	EvictionRandom     = "random"
+	EvictionTTL        = "ttl"
+	EvictionNoEviction = "noeviction"
+)
+
+// EvictionSamples is the number of items sampled to choose each eviction victim. Sampling approximates the
+// policy without maintaining a global ordering of items on every read.
+const EvictionSamples = 5
+
+// itemOverhead is the approximate memory used by an item and its index entries, excluding key and data.
+const itemOverhead = 96
+
+// ErrOutOfMemory is returned by Set when the store is at its memory limit and nothing can be evicted.
+var ErrOutOfMemory = errors.New("out of memory")
+
+// ValidEvictionPolicy returns true if the given string is a known eviction policy.
+func ValidEvictionPolicy(policy string) bool {
+	switch policy {
+	case EvictionLRU, EvictionLFU, EvictionRandom, EvictionTTL, EvictionNoEviction:
+		return true
+	}
+	return false
+}
+
+// size returns the approximate memory used by the item.
+func (item *Item) size() int64 {
+	return int64(len(item.Key) + len(item.Data) + itemOverhead)
+}
+
+// touch records a read of the item for the LRU and LFU policies. Safe under a shared lock.
+func (item *Item) touch(now time.Time) {
+	atomic.StoreInt64(&item.accessed, now.UnixNano())
+	atomic.AddUint32(&item.hits, 1)
+}
+
+// Private - must be called with kvs.mutex held exclusively
+
+// makeRoom evicts items until adding size bytes in place of replacing bytes fits under MaxMemory. The key being
+// written is never evicted.
+func (kvs *KVStore) makeRoom(key string, size int64, replacing int64) error {
+	if kvs.MaxMemory <= 0 {
+		return nil
+	}
+	for kvs.memory-replacing+size > kvs.MaxMemory {
+		if kvs.EvictionPolicy == EvictionNoEviction || kvs.memory-replacing <= 0 {
+			return ErrOutOfMemory
+		}
+		victim := kvs.chooseVictim(key)
+		if victim == nil {
+			return ErrOutOfMemory
+		}
+		kvs.Logger.Debug("KVStore", "EVICT [%s] (%s)", victim.Key, kvs.EvictionPolicy)
+		err := kvs.logWAL(&WALRecord{Op: WALOpDelete, Key: victim.Key})
+		if err != nil {
+			return err
+		}
+		kvs.remove(victim.Key)
+		atomic.AddUint64(&kvs.evictions, 1)
+	}
+	return nil
+}
+
+// chooseVictim samples items and returns the best one to evict under the policy, or nil if none is eligible.
+// Tombstones are never evicted, as they use no memory and replicas would restore the deleted value without them.
+func (kvs *KVStore) chooseVictim(exclude string) *Item {
+	// A few rounds, in case a sample contains only the excluded key and tombstones or, for TTL, no expiring items.
+	for round := 0; round < 3; round++ {
+		var victim *Item
+		for _, item := range kvs.store.sample(EvictionSamples) {
+			if item.Key == exclude || item.Tombstone {
+				continue
+			}
+			if victim == nil {
+				if kvs.EvictionPolicy != EvictionTTL || item.ExpiresAt != nil {
+					victim = item
+				}
+				continue
+			}
+			switch kvs.EvictionPolicy {
+			case EvictionLRU:
+				if atomic.LoadInt64(&item.accessed) < atomic.LoadInt64(&victim.accessed) {
+					victim = item
+				}
+			case EvictionLFU:
+				if atomic.LoadUint32(&item.hits) < atomic.LoadUint32(&victim.hits) {
+					victim = item
+				}
+			case EvictionTTL:
+				if item.ExpiresAt != nil && item.ExpiresAt.Before(*victim.ExpiresAt) {
+					victim = item
+				}
+			}
+		}
+		if victim != nil {
+			return victim
+		}
+	}
+	return nil
+}
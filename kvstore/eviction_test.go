@@ -0,0 +1,147 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+// newLimitedKVStore returns a memory KVStore with room for exactly count items of a 1 byte key and value.
+func newLimitedKVStore(policy string, count int) *KVStore {
+	inst := NewKVStore(util.NewLogger("error"))
+	inst.MaxMemory = int64(count * (2 + itemOverhead))
+	inst.EvictionPolicy = policy
+	return inst
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+
+	inst.Set("a", []byte("1234"), 0, nil)
+	inst.Set("b", []byte("12"), 0, nil)
+	assert.Equal(t, uint64(5+3+2*itemOverhead), inst.Stats().Memory)
+
+	inst.Set("a", []byte("1"), 0, nil)
+	assert.Equal(t, uint64(2+3+2*itemOverhead), inst.Stats().Memory)
+
+	inst.Delete("b")
+	inst.Delete("missing")
+	assert.Equal(t, uint64(2+itemOverhead), inst.Stats().Memory)
+}
+
+func TestEvictionNoEviction(t *testing.T) {
+	inst := newLimitedKVStore(EvictionNoEviction, 2)
+
+	assert.Nil(t, inst.Set("a", []byte{1}, 0, nil))
+	assert.Nil(t, inst.Set("b", []byte{2}, 0, nil))
+	assert.Equal(t, ErrOutOfMemory, inst.Set("c", []byte{3}, 0, nil))
+	// Replacing with an item of the same size fits
+	assert.Nil(t, inst.Set("a", []byte{4}, 0, nil))
+
+	assert.False(t, inst.IsSet("c"))
+	assert.Equal(t, uint64(2), inst.Stats().Items)
+	assert.Equal(t, uint64(0), inst.Stats().Evictions)
+}
+
+func TestEvictionTooLarge(t *testing.T) {
+	inst := newLimitedKVStore(EvictionLRU, 2)
+	inst.Set("a", []byte{1}, 0, nil)
+
+	assert.Equal(t, ErrOutOfMemory, inst.Set("b", make([]byte, 1024), 0, nil))
+	assert.False(t, inst.IsSet("b"))
+}
+
+func TestEvictionLRU(t *testing.T) {
+	inst := newLimitedKVStore(EvictionLRU, 3)
+	inst.Set("a", []byte{1}, 0, nil)
+	time.Sleep(time.Millisecond)
+	inst.Set("b", []byte{2}, 0, nil)
+	time.Sleep(time.Millisecond)
+	inst.Set("c", []byte{3}, 0, nil)
+	time.Sleep(time.Millisecond)
+	inst.Get("a")
+
+	assert.Nil(t, inst.Set("d", []byte{4}, 0, nil))
+	assert.True(t, inst.IsSet("a"))
+	assert.False(t, inst.IsSet("b"))
+	assert.True(t, inst.IsSet("c"))
+	assert.True(t, inst.IsSet("d"))
+	assert.Equal(t, uint64(1), inst.Stats().Evictions)
+}
+
+func TestEvictionLFU(t *testing.T) {
+	inst := newLimitedKVStore(EvictionLFU, 3)
+	for i, key := range []string{"a", "b", "c"} {
+		inst.Set(key, []byte{1}, 0, nil)
+		for n := 0; n < 3-i; n++ {
+			inst.Get(key)
+		}
+	}
+
+	assert.Nil(t, inst.Set("d", []byte{4}, 0, nil))
+	assert.False(t, inst.IsSet("c"))
+	assert.Equal(t, uint64(1), inst.Stats().Evictions)
+}
+
+func TestEvictionTTL(t *testing.T) {
+	inst := newLimitedKVStore(EvictionTTL, 3)
+	soon := time.Now().Add(time.Minute)
+	later := time.Now().Add(time.Hour)
+	inst.Set("l", []byte{1}, 0, &later)
+	inst.Set("s", []byte{2}, 0, &soon)
+	inst.Set("n", []byte{3}, 0, nil)
+
+	assert.Nil(t, inst.Set("d", []byte{4}, 0, nil))
+	assert.False(t, inst.IsSet("s"))
+	assert.Nil(t, inst.Set("e", []byte{5}, 0, nil))
+	assert.False(t, inst.IsSet("l"))
+
+	// Only items with an expiry are evicted
+	assert.Equal(t, ErrOutOfMemory, inst.Set("f", []byte{6}, 0, nil))
+	assert.True(t, inst.IsSet("n"))
+}
+
+func TestEvictionTombstones(t *testing.T) {
+	inst := newLimitedKVStore(EvictionTTL, 2)
+	later := time.Now().Add(2 * TombstoneTTL)
+	inst.Set("a", []byte{1}, 0, &later)
+	inst.Set("b", []byte{2}, 0, nil)
+	inst.DeleteVersion("t", 0)
+
+	// The tombstone expires first, but the item is evicted
+	assert.Nil(t, inst.Set("c", []byte{3}, 0, nil))
+	assert.False(t, inst.IsSet("a"))
+	tombstone, found := inst.Lookup("t")
+	assert.True(t, found && tombstone.Tombstone)
+	assert.Equal(t, uint64(1), inst.Stats().Evictions)
+}
+
+func TestEvictionRandom(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	inst.MaxMemory = int64(10 * (3 + itemOverhead))
+	inst.EvictionPolicy = EvictionRandom
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, inst.Set(fmt.Sprintf("%02d", i), []byte{1}, 0, nil))
+	}
+
+	stats := inst.Stats()
+	assert.Equal(t, uint64(10), stats.Items)
+	assert.Equal(t, uint64(90), stats.Evictions)
+	assert.True(t, stats.Memory <= stats.MaxMemory)
+	assert.True(t, inst.IsSet("99"))
+}
+
+func TestEvictionBPlusTree(t *testing.T) {
+	inst := NewBPlusTreeKVStore(util.NewLogger("error"))
+	inst.MaxMemory = int64(100 * (4 + itemOverhead))
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, inst.Set(fmt.Sprintf("%03d", i), []byte{1}, 0, nil))
+	}
+
+	stats := inst.Stats()
+	assert.Equal(t, uint64(100), stats.Items)
+	assert.Equal(t, uint64(900), stats.Evictions)
+}
@@ -0,0 +1,88 @@
+package kvstore
+
+import (
+	"container/heap"
+	"time"
+)
+
+// ExpiryBatchSize is the maximum number of items expired per tick of the expiry goroutine, so that a mass
+// expiry is spread over several ticks rather than holding the store locked. Reads never return an expired
+// item whether or not it has been removed yet.
+const ExpiryBatchSize = 1000
+
+// ExpiryTick is how often the expiry goroutine runs.
+const ExpiryTick = 100 * time.Millisecond
+
+// expiryEntry records that key was set with the given deadline (unix nanoseconds).
+type expiryEntry struct {
+	deadline int64
+	key      string
+}
+
+// expiryHeap is a min-heap of expiry entries by deadline.
+//
+// Entries are never removed when a key is overwritten or deleted; instead, when an entry reaches the top
+// it is only acted on if the key's current item still has that deadline. Stale entries are discarded.
+type expiryHeap []expiryEntry
+
+func (eh expiryHeap) Len() int            { return len(eh) }
+func (eh expiryHeap) Less(i, j int) bool  { return eh[i].deadline < eh[j].deadline }
+func (eh expiryHeap) Swap(i, j int)       { eh[i], eh[j] = eh[j], eh[i] }
+func (eh *expiryHeap) Push(x interface{}) { *eh = append(*eh, x.(expiryEntry)) }
+func (eh *expiryHeap) Pop() interface{} {
+	old := *eh
+	entry := old[len(old)-1]
+	*eh = old[:len(old)-1]
+	return entry
+}
+
+// expired returns true if the item has an expiry at or before now.
+func (item *Item) expired(now time.Time) bool {
+	return item.ExpiresAt != nil && !item.ExpiresAt.After(now)
+}
+
+// Private - must be called with kvs.mutex held exclusively
+
+// scheduleExpiry adds the item's deadline to the expiry heap, if it has one.
+func (kvs *KVStore) scheduleExpiry(item *Item) {
+	if item.ExpiresAt == nil {
+		return
+	}
+	heap.Push(&kvs.expiry, expiryEntry{deadline: item.ExpiresAt.UnixNano(), key: item.Key})
+
+	// Stale entries accumulate when expiring keys are overwritten. If they outnumber live items, rebuild.
+	if len(kvs.expiry) > 2*kvs.store.len()+ExpiryBatchSize {
+		kvs.rebuildExpiry()
+	}
+}
+
+// rebuildExpiry rebuilds the expiry heap from the items in the store.
+func (kvs *KVStore) rebuildExpiry() {
+	kvs.expiry = expiryHeap{}
+	kvs.store.each(func(item *Item) bool {
+		if item.ExpiresAt != nil {
+			kvs.expiry = append(kvs.expiry, expiryEntry{deadline: item.ExpiresAt.UnixNano(), key: item.Key})
+		}
+		return true
+	})
+	heap.Init(&kvs.expiry)
+}
+
+// expire processes up to limit entries whose deadline is at or before now, returning the number of items removed.
+func (kvs *KVStore) expire(now time.Time, limit int) int {
+	deadline := now.UnixNano()
+	count := 0
+	for n := 0; n < limit && len(kvs.expiry) > 0 && kvs.expiry[0].deadline <= deadline; n++ {
+		entry := heap.Pop(&kvs.expiry).(expiryEntry)
+		item, found := kvs.store.get(entry.key)
+		if !found || item.ExpiresAt == nil || item.ExpiresAt.UnixNano() != entry.deadline {
+			// Deleted, or overwritten with a different or no expiry
+			continue
+		}
+		kvs.Logger.Debug("KVStore", "EXPIRE [%s]", entry.key)
+		if kvs.remove(entry.key) {
+			count++
+		}
+	}
+	return count
+}
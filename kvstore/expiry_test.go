@@ -0,0 +1,94 @@
+package kvstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestExpiryRemovesDueItems(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	now := time.Now()
+	soon := now.Add(time.Second)
+	later := now.Add(time.Hour)
+
+	inst.Set("soon", []byte{1}, 0, &soon)
+	inst.Set("later", []byte{2}, 0, &later)
+	inst.Set("never", []byte{3}, 0, nil)
+
+	assert.Equal(t, 0, inst.expire(now, ExpiryBatchSize))
+	assert.Equal(t, 1, inst.expire(now.Add(2*time.Second), ExpiryBatchSize))
+	assert.False(t, inst.IsSet("soon"))
+	assert.True(t, inst.IsSet("later"))
+	assert.True(t, inst.IsSet("never"))
+}
+
+func TestExpiryOverwrittenKey(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	now := time.Now()
+	soon := now.Add(time.Second)
+	later := now.Add(time.Hour)
+
+	// TTL extended
+	inst.Set("extended", []byte{1}, 0, &soon)
+	inst.Set("extended", []byte{2}, 0, &later)
+	// TTL removed
+	inst.Set("persisted", []byte{1}, 0, &soon)
+	inst.Set("persisted", []byte{2}, 0, nil)
+	// TTL shortened
+	inst.Set("shortened", []byte{1}, 0, &later)
+	inst.Set("shortened", []byte{2}, 0, &soon)
+
+	assert.Equal(t, 1, inst.expire(now.Add(2*time.Second), ExpiryBatchSize))
+	assert.True(t, inst.IsSet("extended"))
+	assert.True(t, inst.IsSet("persisted"))
+	assert.False(t, inst.IsSet("shortened"))
+
+	assert.Equal(t, 1, inst.expire(now.Add(2*time.Hour), ExpiryBatchSize))
+	assert.False(t, inst.IsSet("extended"))
+	assert.True(t, inst.IsSet("persisted"))
+}
+
+func TestExpiryLazyOnRead(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	past := time.Now().Add(-time.Second)
+
+	inst.set(&Item{Key: "gone", Data: []byte{1}, ExpiresAt: &past})
+
+	_, _, found := inst.Get("gone")
+	assert.False(t, found)
+	inst.Iterate(func(item *Item) bool {
+		t.Errorf("Iterate returned expired item %s", item.Key)
+		return true
+	})
+}
+
+func TestExpiryBoundedBatch(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	soon := time.Now().Add(time.Second)
+	for i := 0; i < 25; i++ {
+		inst.Set(fmt.Sprintf("key%d", i), []byte{1}, 0, &soon)
+	}
+
+	after := soon.Add(time.Second)
+	assert.Equal(t, 10, inst.expire(after, 10))
+	assert.Equal(t, 10, inst.expire(after, 10))
+	assert.Equal(t, 5, inst.expire(after, 10))
+	assert.Equal(t, uint64(0), inst.Stats().Items)
+}
+
+func TestExpiryGoroutine(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	soon := time.Now().Add(200 * time.Millisecond)
+	inst.Set("soon", []byte{1}, 0, &soon)
+
+	inst.Start()
+	defer inst.Stop()
+	time.Sleep(200*time.Millisecond + 3*ExpiryTick)
+
+	assert.Equal(t, uint64(0), inst.Stats().Items)
+	assert.Equal(t, uint64(1), inst.Stats().Expired)
+}
@@ -0,0 +1,208 @@
+package kvstore
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultKeyspace is the keyspace of keys that are not in a named keyspace.
+const DefaultKeyspace = "default"
+
+// MaxKeyspaceLength is the maximum length of a keyspace name.
+const MaxKeyspaceLength = 64
+
+// keyspaceSeparator starts and ends the keyspace name in the stored key of an item in a named keyspace. Keys in
+// the default keyspace are stored as they are, which is safe as KeyspaceKey rejects keys containing it.
+const keyspaceSeparator = "\x00"
+
+// ErrQuotaExceeded is returned by Set when the item would take its keyspace over its quota.
+var ErrQuotaExceeded = errors.New("keyspace quota exceeded")
+
+// ErrInvalidKey is returned by KeyspaceKey for a key with control characters, which include the separator of
+// keyspace names, or for an invalid keyspace.
+var ErrInvalidKey = errors.New("invalid key")
+
+// KeyspaceStats holds the statistics of a keyspace.
+type KeyspaceStats struct {
+	Items  uint64
+	Memory uint64
+	// Quota is the approximate limit in bytes on the size of the keyspace's items, or 0 for no limit.
+	Quota uint64
+	Gets  uint64
+	Hits  uint64
+	Sets  uint64
+}
+
+// keyspace tracks the size, quota and counters of a keyspace. items, memory and quota are guarded by the store
+// mutex, the counters are atomic.
+type keyspace struct {
+	gets uint64
+	hits uint64
+	sets uint64
+
+	items  int64
+	memory int64
+	quota  int64
+}
+
+// ValidKeyspace returns true if the name can be used as a keyspace: 1 to MaxKeyspaceLength letters, digits,
+// '_', '-' or '.'.
+func ValidKeyspace(name string) bool {
+	if len(name) == 0 || len(name) > MaxKeyspaceLength {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidKey returns true if the key has no control characters, so cannot contain the separator of keyspace names
+// and reach the items of another keyspace.
+func ValidKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] == 0x7F {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyspaceKey returns the key under which the key in the given keyspace is stored. Every Engine method takes
+// keys in this form. ErrInvalidKey is returned if the key or keyspace is not valid.
+func KeyspaceKey(keyspace string, key string) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+	if keyspace == DefaultKeyspace || keyspace == "" {
+		return key, nil
+	}
+	if !ValidKeyspace(keyspace) {
+		return "", ErrInvalidKey
+	}
+	return keyspaceSeparator + keyspace + keyspaceSeparator + key, nil
+}
+
+// SplitKeyspaceKey returns the keyspace and key of a stored key.
+func SplitKeyspaceKey(stored string) (string, string) {
+	if !strings.HasPrefix(stored, keyspaceSeparator) {
+		return DefaultKeyspace, stored
+	}
+	end := strings.Index(stored[1:], keyspaceSeparator)
+	if end < 0 {
+		return DefaultKeyspace, stored
+	}
+	return stored[1 : end+1], stored[end+2:]
+}
+
+// Keyspace returns the name of the keyspace the item belongs to.
+func (item *Item) Keyspace() string {
+	keyspace, _ := SplitKeyspaceKey(item.Key)
+	return keyspace
+}
+
+// InKeyspace returns the options with Start, End and Prefix, which are keys in the given keyspace, converted to
+// stored keys, so that the scan returns only the keyspace's items.
+func (options ScanOptions) InKeyspace(name string) ScanOptions {
+	base, _ := KeyspaceKey(name, "")
+	if base == "" {
+		// Default keys sort after every key in a named keyspace
+		if options.Start < "\x01" {
+			options.Start = "\x01"
+		}
+		return options
+	}
+	options.Start = base + options.Start
+	if options.End != "" {
+		options.End = base + options.End
+	} else {
+		options.End, _ = prefixEnd(base)
+	}
+	options.Prefix = base + options.Prefix
+	return options
+}
+
+// SetKeyspaceQuota limits the approximate size in bytes of the items in a keyspace, or removes the limit if
+// quota is 0. Sets that would exceed the quota fail with ErrQuotaExceeded.
+func (kvs *KVStore) SetKeyspaceQuota(name string, quota int64) {
+	kvs.mutex.Lock()
+	defer kvs.mutex.Unlock()
+	kvs.keyspace(name).quota = quota
+}
+
+// Keyspaces returns the statistics of every keyspace that has held items or has a quota.
+func (kvs *KVStore) Keyspaces() map[string]KeyspaceStats {
+	kvs.mutex.RLock()
+	defer kvs.mutex.RUnlock()
+	result := make(map[string]KeyspaceStats, len(kvs.keyspaces))
+	for name, ks := range kvs.keyspaces {
+		result[name] = KeyspaceStats{
+			Items:  uint64(ks.items),
+			Memory: uint64(ks.memory),
+			Quota:  uint64(ks.quota),
+			Gets:   atomic.LoadUint64(&ks.gets),
+			Hits:   atomic.LoadUint64(&ks.hits),
+			Sets:   atomic.LoadUint64(&ks.sets),
+		}
+	}
+	return result
+}
+
+// DropKeyspace deletes every item in the keyspace, leaving other keyspaces untouched, and returns the number of
+// items deleted. Each item is replaced with a tombstone with a new version, like Delete, so that replicas that
+// missed the drop do not copy the items back. The keyspace's quota is kept.
+func (kvs *KVStore) DropKeyspace(name string) int {
+	kvs.mutex.Lock()
+	defer kvs.mutex.Unlock()
+
+	now := time.Now()
+	items := []*Item{}
+	kvs.store.each(func(item *Item) bool {
+		if item.Keyspace() == name && !item.Tombstone {
+			items = append(items, item)
+		}
+		return true
+	})
+	count := 0
+	for _, item := range items {
+		live := item.live(now)
+		if kvs.setTombstone(item.Key, kvs.nextVersion(), now) != nil {
+			continue
+		}
+		if live {
+			count++
+		}
+	}
+	kvs.Logger.Info("KVStore", "Dropped Keyspace %s (%d items)", name, count)
+	return count
+}
+
+// Private - must be called with kvs.mutex held
+
+// keyspace returns the keyspace with the given name, creating it if necessary. kvs.mutex must be held exclusively.
+func (kvs *KVStore) keyspace(name string) *keyspace {
+	ks, found := kvs.keyspaces[name]
+	if !found {
+		ks = &keyspace{}
+		kvs.keyspaces[name] = ks
+	}
+	return ks
+}
+
+// checkQuota returns ErrQuotaExceeded if storing size bytes in place of replacing bytes would take the key's
+// keyspace over its quota.
+func (kvs *KVStore) checkQuota(key string, size int64, replacing int64) error {
+	name, _ := SplitKeyspaceKey(key)
+	ks, found := kvs.keyspaces[name]
+	if !found || ks.quota <= 0 {
+		return nil
+	}
+	if ks.memory-replacing+size > ks.quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package kvstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestKeyspaceKey(t *testing.T) {
+	stored, err := KeyspaceKey(DefaultKeyspace, "key")
+	assert.Nil(t, err)
+	assert.Equal(t, "key", stored)
+	stored, err = KeyspaceKey("sessions", "key")
+	assert.Nil(t, err)
+	assert.Equal(t, "\x00sessions\x00key", stored)
+
+	for _, keyspace := range []string{DefaultKeyspace, "sessions"} {
+		name, key := SplitKeyspaceKey(keyspaceKey(keyspace, "a:key"))
+		assert.Equal(t, keyspace, name)
+		assert.Equal(t, "a:key", key)
+	}
+	assert.Equal(t, "sessions", (&Item{Key: keyspaceKey("sessions", "")}).Keyspace())
+
+	// Keys cannot reach into another keyspace
+	for _, keyspace := range []string{DefaultKeyspace, "sessions"} {
+		_, err = KeyspaceKey(keyspace, "\x00tenant\x00key")
+		assert.Equal(t, ErrInvalidKey, err)
+		_, err = KeyspaceKey(keyspace, "a\tkey")
+		assert.Equal(t, ErrInvalidKey, err)
+	}
+	_, err = KeyspaceKey("a\x00b", "key")
+	assert.Equal(t, ErrInvalidKey, err)
+
+	assert.True(t, ValidKeyspace("tenant-1.cache_v2"))
+	assert.False(t, ValidKeyspace(""))
+	assert.False(t, ValidKeyspace("a\x00b"))
+}
+
+// keyspaceKey returns the stored key of a valid key in a keyspace.
+func keyspaceKey(keyspace string, key string) string {
+	stored, _ := KeyspaceKey(keyspace, key)
+	return stored
+}
+
+func TestKeyspaceStats(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	inst.Set(keyspaceKey("a", "1"), []byte{1}, 0, nil)
+	inst.Set(keyspaceKey("a", "2"), []byte{2}, 0, nil)
+	inst.Set(keyspaceKey("b", "1"), []byte{3}, 0, nil)
+	inst.Set("1", []byte{4}, 0, nil)
+	inst.Get(keyspaceKey("a", "1"))
+	inst.Get(keyspaceKey("a", "3"))
+	inst.Delete(keyspaceKey("a", "2"))
+
+	keyspaces := inst.Keyspaces()
+	assert.Equal(t, KeyspaceStats{Items: 1, Memory: uint64(len(keyspaceKey("a", "1")) + 1 + itemOverhead), Gets: 2, Hits: 1, Sets: 2}, keyspaces["a"])
+	assert.Equal(t, uint64(1), keyspaces["b"].Items)
+	assert.Equal(t, uint64(1), keyspaces[DefaultKeyspace].Items)
+}
+
+func TestKeyspaceQuota(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	size := int64(len(keyspaceKey("a", "1")) + 1 + itemOverhead)
+	inst.SetKeyspaceQuota("a", 2*size)
+
+	assert.Nil(t, inst.Set(keyspaceKey("a", "1"), []byte{1}, 0, nil))
+	assert.Nil(t, inst.Set(keyspaceKey("a", "2"), []byte{2}, 0, nil))
+	assert.Equal(t, ErrQuotaExceeded, inst.Set(keyspaceKey("a", "3"), []byte{3}, 0, nil))
+	// Replacing an item of the same size fits, and other keyspaces are not limited
+	assert.Nil(t, inst.Set(keyspaceKey("a", "1"), []byte{4}, 0, nil))
+	assert.Nil(t, inst.Set(keyspaceKey("b", "3"), []byte{3}, 0, nil))
+	assert.Equal(t, uint64(2*size), inst.Keyspaces()["a"].Quota)
+
+	inst.SetKeyspaceQuota("a", 0)
+	assert.Nil(t, inst.Set(keyspaceKey("a", "3"), []byte{3}, 0, nil))
+}
+
+func TestDropKeyspace(t *testing.T) {
+	inst := NewBPlusTreeKVStore(util.NewLogger("error"))
+	for _, keyspace := range []string{"a", "b", DefaultKeyspace} {
+		for _, key := range []string{"1", "2", "3"} {
+			inst.Set(keyspaceKey(keyspace, key), []byte(keyspace), 0, nil)
+		}
+	}
+
+	before, _ := inst.GetItem(keyspaceKey("a", "1"))
+	assert.Equal(t, 3, inst.DropKeyspace("a"))
+	assert.False(t, inst.IsSet(keyspaceKey("a", "1")))
+	// Dropped items leave newer tombstones, so replicas that missed the drop do not bring them back
+	tombstone, found := inst.Lookup(keyspaceKey("a", "1"))
+	assert.True(t, found)
+	assert.True(t, tombstone.Tombstone)
+	assert.True(t, tombstone.Version > before.Version)
+	_, err := inst.SetVersion(keyspaceKey("a", "1"), []byte("a"), 0, nil, before.Version)
+	assert.Nil(t, err)
+	assert.False(t, inst.IsSet(keyspaceKey("a", "1")))
+	assert.True(t, inst.IsSet(keyspaceKey("b", "1")))
+	assert.True(t, inst.IsSet("1"))
+	assert.Equal(t, uint64(0), inst.Keyspaces()["a"].Memory)
+
+	assert.Equal(t, 3, inst.DropKeyspace(DefaultKeyspace))
+	assert.True(t, inst.IsSet(keyspaceKey("b", "1")))
+	assert.Equal(t, uint64(3), inst.Stats().Items)
+}
+
+func TestScanInKeyspace(t *testing.T) {
+	inst := NewBPlusTreeKVStore(util.NewLogger("error"))
+	for _, keyspace := range []string{"a", "ab", "b", DefaultKeyspace} {
+		for _, key := range []string{"1", "2", "3"} {
+			inst.Set(keyspaceKey(keyspace, key), []byte(keyspace), 0, nil)
+		}
+	}
+
+	keys := func(options ScanOptions) []string {
+		result := []string{}
+		cursor := inst.Scan(options)
+		for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+			result = append(result, item.Key)
+		}
+		return result
+	}
+	assert.Equal(t, []string{keyspaceKey("a", "1"), keyspaceKey("a", "2"), keyspaceKey("a", "3")}, keys(ScanOptions{}.InKeyspace("a")))
+	assert.Equal(t, []string{keyspaceKey("a", "2")}, keys(ScanOptions{Start: "2", End: "3"}.InKeyspace("a")))
+	assert.Equal(t, []string{"1", "2", "3"}, keys(ScanOptions{}.InKeyspace(DefaultKeyspace)))
+	assert.Equal(t, []string{keyspaceKey("b", "3")}, keys(ScanOptions{Prefix: "3"}.InKeyspace("b")))
+}
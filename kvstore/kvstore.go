@@ -1,47 +1,145 @@
 package kvstore
 
 import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	bt "github.com/tomdionysus/binarytree"
-	ch "github.com/tomdionysus/consistenthash"
 	"github.com/tomdionysus/trinity/util"
 )
 
-// KVStore In Memory Key Value Store for testing.
+// KVStore Key Value Store, held in memory or on a BlockStore.
 type KVStore struct {
-	Logger  *util.Logger
-	store   *bt.Tree
-	expiry  map[int64][]ch.Key
-	running bool
+	Logger    *util.Logger
+	WAL       *WAL
+	Snapshots *Snapshotter
+	// MaxMemory is the approximate limit in bytes on the size of all items, or 0 for no limit.
+	MaxMemory int64
+	// EvictionPolicy chooses which items are removed to stay under MaxMemory.
+	EvictionPolicy string
+	// CompressThreshold is the size in bytes from which values are compressed, or 0 to disable compression.
+	CompressThreshold int
+	// OnCorruption, if set, is called in its own goroutine with the key of an item found not to match its
+	// checksum, after the item is removed, so that it can be repaired from another replica.
+	OnCorruption func(key string)
+
+	store     backend
+	storage   string
+	expiry    expiryHeap
+	memory    int64
+	version   uint64
+	tombstone int64
+	running   bool
+	keyspaces map[string]*keyspace
+
+	gets      uint64
+	hits      uint64
+	sets      uint64
+	deletes   uint64
+	expired   uint64
+	evictions uint64
+
+	uncompressedBytes uint64
+	compressedBytes   uint64
+	corruptions       uint64
+
+	// mutex guards store, expiry, memory, version, tombstone, running and keyspaces. Readers share it, writers and the expiry
+	// goroutine hold it exclusively, and a snapshot shares it to rotate the WAL and capture the items between
+	// writes.
+	mutex sync.RWMutex
+	// snapshotting serialises snapshots.
+	snapshotting sync.Mutex
 }
 
+// ErrNotFound is returned by CompareAndSet and the update operations when the key is not set.
+var ErrNotFound = errors.New("not found")
+
+// ErrVersionMismatch is returned by CompareAndSet when the key has been set since the expected version.
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// ErrNotNumeric is returned by Incr and Decr when the value is not an unsigned 64 bit decimal integer.
+var ErrNotNumeric = errors.New("cannot increment or decrement non-numeric value")
+
 // Item struct represent an entry in the store
 type Item struct {
-	Key   string
-	Data  []byte
-	Flags int16
+	// accessed (unix nanoseconds) and hits track reads for eviction. They are first for 64 bit atomic alignment.
+	accessed int64
+	hits     uint32
+
+	Key       string
+	Data      []byte
+	Flags     int16
+	ExpiresAt *time.Time
+	// Version increases every time the key is set, for compare-and-set.
+	Version uint64
+	// Compressed is true if Data is held compressed. Items returned by KVStore are never compressed.
+	Compressed bool
+	// Checksum is the CRC32C of the uncompressed Data, verified on every read.
+	Checksum uint32
+	// Tombstone marks a deleted key. Tombstones are never returned by KVStore except to scans that ask for them.
+	Tombstone bool
 }
 
-// NewKVStore create and initialize a new KVStore
+// NewKVStore create and initialize a new in memory KVStore
 func NewKVStore(logger *util.Logger) *KVStore {
+	return newKVStore(logger, StorageMemory, newMemoryBackend())
+}
+
+// NewBPlusTreeKVStore create and initialize a new in memory KVStore ordered by key
+func NewBPlusTreeKVStore(logger *util.Logger) *KVStore {
+	return newKVStore(logger, StorageBPlusTree, newBPlusTreeBackend())
+}
+
+// NewBlockKVStore create and initialize a new KVStore storing items in the given open BlockStore
+func NewBlockKVStore(logger *util.Logger, blocks *BlockStore) *KVStore {
+	return newKVStore(logger, StorageBlock, blocks)
+}
+
+func newKVStore(logger *util.Logger, storage string, store backend) *KVStore {
 	inst := &KVStore{
-		Logger:  logger,
-		store:   bt.NewTree(),
-		expiry:  map[int64][]ch.Key{},
-		running: false,
+		Logger:         logger,
+		EvictionPolicy: EvictionLRU,
+		store:          store,
+		storage:        storage,
+		expiry:         expiryHeap{},
+		version:        uint64(time.Now().UnixNano()),
+		running:        false,
+		keyspaces:      map[string]*keyspace{},
 	}
 	return inst
 }
 
-// Init the KVStore
-func (kvs *KVStore) Init() {
+// Init the KVStore, loading the newest snapshot and replaying the WAL if configured
+func (kvs *KVStore) Init() error {
 	kvs.Logger.Debug("KVStore", "Init")
+	var sequence uint64
+	if kvs.Snapshots != nil {
+		var err error
+		sequence, err = kvs.Snapshots.Load(kvs.replay)
+		if err != nil {
+			return err
+		}
+	}
+	if kvs.WAL != nil {
+		err := kvs.WAL.Open(sequence, kvs.replay)
+		if err != nil {
+			return err
+		}
+	}
+	kvs.rebuildExpiry()
+	if kvs.MaxMemory > 0 && kvs.memory > kvs.MaxMemory {
+		kvs.Logger.Warn("KVStore", "Restored %d bytes exceeds max memory %d bytes", kvs.memory, kvs.MaxMemory)
+	}
+	return nil
 }
 
 // Start the KVStore goroutine
-// This goroutine looks for expiry of value and remove them from the KVStore
+// This goroutine removes expired items from the KVStore, at most ExpiryBatchSize every ExpiryTick
 func (kvs *KVStore) Start() {
+	kvs.mutex.Lock()
+	defer kvs.mutex.Unlock()
 	if kvs.running {
 		return
 	}
@@ -49,39 +147,347 @@ func (kvs *KVStore) Start() {
 	kvs.running = true
 	go func() {
 		kvs.Logger.Debug("KVStore", "Started")
-		for kvs.running {
-			expiretime := time.Now().UTC().Unix()
-			toexpire, found := kvs.expiry[expiretime]
-			if found {
-				kvs.Logger.Debug("KVStore", "Expiring Time %d", expiretime)
-				for _, k := range toexpire {
-					kvs.deleteKey(k)
-				}
-				delete(kvs.expiry, expiretime)
+		for kvs.isRunning() {
+			kvs.mutex.Lock()
+			count := kvs.expire(time.Now(), ExpiryBatchSize)
+			kvs.mutex.Unlock()
+			if count > 0 {
+				atomic.AddUint64(&kvs.expired, uint64(count))
 			}
-			time.Sleep(500 * time.Millisecond)
+			time.Sleep(ExpiryTick)
 		}
 	}()
+
+	if kvs.Snapshots != nil && kvs.Snapshots.Interval > 0 {
+		go func() {
+			for kvs.isRunning() {
+				time.Sleep(kvs.Snapshots.Interval)
+				if !kvs.isRunning() {
+					break
+				}
+				err := kvs.Snapshot()
+				if err != nil {
+					kvs.Logger.Error("KVStore", "Snapshot Failed: %s", err.Error())
+				}
+			}
+		}()
+	}
 }
 
-// Stop the value expiry
+// Stop the value expiry and snapshots
 func (kvs *KVStore) Stop() {
+	kvs.mutex.Lock()
 	kvs.running = false
+	kvs.mutex.Unlock()
+}
+
+func (kvs *KVStore) isRunning() bool {
+	kvs.mutex.RLock()
+	defer kvs.mutex.RUnlock()
+	return kvs.running
+}
+
+// Close the WAL and the underlying storage
+func (kvs *KVStore) Close() error {
+	if kvs.WAL != nil {
+		err := kvs.WAL.Close()
+		if err != nil {
+			kvs.Logger.Error("KVStore", "Cannot Close WAL: %s", err.Error())
+			return err
+		}
+	}
+	return kvs.store.close()
+}
+
+// Iterate calls fn for every live item in the store until fn returns false. Writes are held up until
+// the iteration completes, so fn must not modify the store.
+func (kvs *KVStore) Iterate(fn func(*Item) bool) {
+	kvs.mutex.RLock()
+	defer kvs.mutex.RUnlock()
+	now := time.Now()
+	kvs.store.each(func(item *Item) bool {
+		if !item.live(now) {
+			return true
+		}
+		item, err := kvs.verify(item)
+		if err != nil {
+			return true
+		}
+		return fn(item)
+	})
+}
+
+// Sync flushes the WAL to stable storage, so that every write made so far survives a restart. It does nothing if
+// there is no WAL.
+func (kvs *KVStore) Sync() error {
+	if kvs.WAL == nil {
+		return nil
+	}
+	return kvs.WAL.Sync()
 }
 
-// Set a value in the KVStore
-func (kvs *KVStore) Set(key string, value []byte, flags int16, expiry *time.Time) {
-	keymd5 := ch.NewMD5Key(key)
-	item := &Item{Key: key, Data: value, Flags: flags}
-	kvs.store.Set(keymd5, item)
+// Stats returns the current statistics of the store
+func (kvs *KVStore) Stats() Stats {
+	kvs.mutex.RLock()
+	items := int64(kvs.store.len()) - kvs.tombstone
+	memory := kvs.memory
+	kvs.mutex.RUnlock()
+
+	return Stats{
+		Storage:   kvs.storage,
+		Items:     uint64(items),
+		Memory:    uint64(memory),
+		MaxMemory: uint64(kvs.MaxMemory),
+		Gets:      atomic.LoadUint64(&kvs.gets),
+		Hits:      atomic.LoadUint64(&kvs.hits),
+		Sets:      atomic.LoadUint64(&kvs.sets),
+		Deletes:   atomic.LoadUint64(&kvs.deletes),
+		Expired:   atomic.LoadUint64(&kvs.expired),
+		Evictions: atomic.LoadUint64(&kvs.evictions),
+
+		UncompressedBytes: atomic.LoadUint64(&kvs.uncompressedBytes),
+		CompressedBytes:   atomic.LoadUint64(&kvs.compressedBytes),
+		Corruptions:       atomic.LoadUint64(&kvs.corruptions),
+	}
+}
 
-	if expiry != nil {
-		exptime := expiry.UTC().Unix()
-		kvs.Logger.Debug("KVStore", "SET [%s] %s - Expiry %d", key, value, exptime)
-		kvs.expiry[exptime] = append(kvs.expiry[exptime], keymd5)
+// Snapshot writes a point-in-time snapshot of the store and compacts the WAL. Get and Set are
+// only held up while the WAL is rotated and the items are captured, not while the snapshot is written.
+func (kvs *KVStore) Snapshot() error {
+	if kvs.Snapshots == nil {
+		return errors.New("Snapshots not configured")
+	}
+	kvs.snapshotting.Lock()
+	defer kvs.snapshotting.Unlock()
+
+	// Capture. Items are replaced rather than modified by Set, so holding the pointers is enough.
+	kvs.mutex.RLock()
+	var sequence uint64
+	if kvs.WAL != nil {
+		var err error
+		sequence, err = kvs.WAL.Rotate()
+		if err != nil {
+			kvs.mutex.RUnlock()
+			return err
+		}
 	} else {
-		kvs.Logger.Debug("KVStore", "SET [%s] %s", key, value)
+		sequence = kvs.Snapshots.Latest() + 1
+	}
+	items := []*Item{}
+	kvs.store.each(func(item *Item) bool {
+		items = append(items, item)
+		return true
+	})
+	kvs.mutex.RUnlock()
+
+	kvs.Logger.Debug("KVStore", "Writing Snapshot %d (%d items)", sequence, len(items))
+	records := make([]*WALRecord, len(items))
+	for i, item := range items {
+		records[i] = &WALRecord{Op: WALOpSet, Key: item.Key, Data: item.Data, Flags: item.Flags, ExpiresAt: item.ExpiresAt, Version: item.Version, Compressed: item.Compressed, Checksum: item.Checksum, Tombstone: item.Tombstone}
+	}
+	err := kvs.Snapshots.Write(sequence, records)
+	if err != nil {
+		return err
+	}
+
+	// Compact. WAL segments older than the oldest retained snapshot are no longer needed.
+	oldest, err := kvs.Snapshots.Prune()
+	if err != nil {
+		return err
 	}
+	if kvs.WAL != nil {
+		err = kvs.WAL.RemoveBefore(oldest)
+		if err != nil {
+			return err
+		}
+	}
+	kvs.Logger.Info("KVStore", "Snapshot %d Written (%d items)", sequence, len(items))
+	return nil
+}
+
+// Set a value in the KVStore with a new version. If MaxMemory is set, items are evicted according to
+// EvictionPolicy to make room, and ErrOutOfMemory is returned if that is not possible.
+func (kvs *KVStore) Set(key string, value []byte, flags int16, expiry *time.Time) error {
+	_, err := kvs.SetVersion(key, value, flags, expiry, 0)
+	return err
+}
+
+// SetVersion sets a value in the KVStore with the given version, as assigned by the node that owns the key,
+// or with a new version if version is 0. It returns the version of the stored item. A write with a version
+// that is not newer than the current item's is ignored, so replicas converge on the newest value.
+func (kvs *KVStore) SetVersion(key string, value []byte, flags int16, expiry *time.Time, version uint64) (uint64, error) {
+	atomic.AddUint64(&kvs.sets, 1)
+	kvs.mutex.Lock()
+	defer kvs.mutex.Unlock()
+
+	old, found := kvs.store.get(key)
+	if version != 0 && found && old.Version >= version {
+		kvs.Logger.Debug("KVStore", "SET [%s] Ignored: version %d is not newer than %d", key, version, old.Version)
+		return old.Version, nil
+	}
+	if version == 0 {
+		version = kvs.nextVersion()
+	}
+	return kvs.write(newItem(key, value, flags, expiry, version), old)
+}
+
+// CompareAndSet sets a value in the KVStore with a new version only if the current item has the expected
+// version, returning the new version. ErrNotFound is returned if the key is not set, and ErrVersionMismatch
+// if it has been set since the expected version was read.
+func (kvs *KVStore) CompareAndSet(key string, value []byte, flags int16, expiry *time.Time, expected uint64) (uint64, error) {
+	atomic.AddUint64(&kvs.sets, 1)
+	kvs.mutex.Lock()
+	defer kvs.mutex.Unlock()
+
+	old, found := kvs.store.get(key)
+	if !found || !old.live(time.Now()) {
+		kvs.Logger.Debug("KVStore", "CAS [%s] NOT FOUND", key)
+		return 0, ErrNotFound
+	}
+	if old.Version != expected {
+		kvs.Logger.Debug("KVStore", "CAS [%s] Version %d does not match %d", key, old.Version, expected)
+		return old.Version, ErrVersionMismatch
+	}
+	return kvs.write(newItem(key, value, flags, expiry, kvs.nextVersion()), old)
+}
+
+// Incr adds delta to the decimal value of the key, wrapping at 2^64, and returns the updated item.
+// ErrNotNumeric is returned if the value is not an unsigned 64 bit decimal integer.
+func (kvs *KVStore) Incr(key string, delta uint64) (*Item, error) {
+	return kvs.update(key, func(old *Item) ([]byte, error) {
+		value, err := strconv.ParseUint(string(old.Data), 10, 64)
+		if err != nil {
+			return nil, ErrNotNumeric
+		}
+		return []byte(strconv.FormatUint(value+delta, 10)), nil
+	})
+}
+
+// Decr subtracts delta from the decimal value of the key, stopping at 0, and returns the updated item.
+// ErrNotNumeric is returned if the value is not an unsigned 64 bit decimal integer.
+func (kvs *KVStore) Decr(key string, delta uint64) (*Item, error) {
+	return kvs.update(key, func(old *Item) ([]byte, error) {
+		value, err := strconv.ParseUint(string(old.Data), 10, 64)
+		if err != nil {
+			return nil, ErrNotNumeric
+		}
+		if delta > value {
+			value = 0
+		} else {
+			value -= delta
+		}
+		return []byte(strconv.FormatUint(value, 10)), nil
+	})
+}
+
+// Append adds data to the end of the value of the key and returns the updated item.
+func (kvs *KVStore) Append(key string, data []byte) (*Item, error) {
+	return kvs.update(key, func(old *Item) ([]byte, error) {
+		value := make([]byte, 0, len(old.Data)+len(data))
+		value = append(value, old.Data...)
+		return append(value, data...), nil
+	})
+}
+
+// Prepend adds data to the start of the value of the key and returns the updated item.
+func (kvs *KVStore) Prepend(key string, data []byte) (*Item, error) {
+	return kvs.update(key, func(old *Item) ([]byte, error) {
+		value := make([]byte, 0, len(old.Data)+len(data))
+		value = append(value, data...)
+		return append(value, old.Data...), nil
+	})
+}
+
+// update replaces the value of an existing key with the result of fn with a new version, keeping its flags and
+// expiry. The read, modify and write happen under one lock, so are atomic. ErrNotFound is returned if the key
+// is not set.
+func (kvs *KVStore) update(key string, fn func(old *Item) ([]byte, error)) (*Item, error) {
+	atomic.AddUint64(&kvs.sets, 1)
+	kvs.mutex.Lock()
+	defer kvs.mutex.Unlock()
+
+	old, found := kvs.store.get(key)
+	if !found || !old.live(time.Now()) {
+		kvs.Logger.Debug("KVStore", "UPDATE [%s] NOT FOUND", key)
+		return nil, ErrNotFound
+	}
+	current, err := kvs.verify(old)
+	if err != nil {
+		// A corrupt item is treated as missing until it is repaired
+		return nil, ErrNotFound
+	}
+	data, err := fn(current)
+	if err != nil {
+		kvs.Logger.Debug("KVStore", "UPDATE [%s] Failed: %s", key, err.Error())
+		return nil, err
+	}
+	item := newItem(key, data, old.Flags, old.ExpiresAt, kvs.nextVersion())
+	// The stored item may be compressed, so return a copy of it as written
+	result := *item
+	_, err = kvs.write(item, old)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// write compresses, makes room for, logs and stores the item in place of old, which may be nil.
+func (kvs *KVStore) write(item *Item, old *Item) (uint64, error) {
+	kvs.compress(item)
+	var replacing int64
+	if old != nil {
+		replacing = old.size()
+	}
+	err := kvs.checkQuota(item.Key, item.size(), replacing)
+	if err == nil {
+		err = kvs.makeRoom(item.Key, item.size(), replacing)
+	}
+	if err != nil {
+		kvs.Logger.Debug("KVStore", "SET [%s] Failed: %s", item.Key, err.Error())
+		return 0, err
+	}
+
+	err = kvs.logWAL(&WALRecord{Op: WALOpSet, Key: item.Key, Data: item.Data, Flags: item.Flags, ExpiresAt: item.ExpiresAt, Version: item.Version, Compressed: item.Compressed, Checksum: item.Checksum, Tombstone: item.Tombstone})
+	if err != nil {
+		return 0, err
+	}
+	err = kvs.set(item)
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&kvs.keyspace(item.Keyspace()).sets, 1)
+	return item.Version, nil
+}
+
+// nextVersion returns a new item version, greater than any version seen by the store.
+func (kvs *KVStore) nextVersion() uint64 {
+	kvs.version++
+	return kvs.version
+}
+
+func (kvs *KVStore) set(item *Item) error {
+	item.accessed = time.Now().UnixNano()
+	old, replaced := kvs.store.get(item.Key)
+	err := kvs.store.set(item)
+	if err != nil {
+		kvs.Logger.Error("KVStore", "SET [%s] Failed: %s", item.Key, err.Error())
+		return err
+	}
+	if replaced {
+		kvs.account(old, -1)
+	}
+	kvs.account(item, 1)
+	if item.Version > kvs.version {
+		kvs.version = item.Version
+	}
+
+	if item.ExpiresAt != nil {
+		kvs.Logger.Debug("KVStore", "SET [%s] %s (v%d) - Expiry %s", item.Key, item.Data, item.Version, item.ExpiresAt.UTC().Format(time.RFC3339))
+		kvs.scheduleExpiry(item)
+	} else {
+		kvs.Logger.Debug("KVStore", "SET [%s] %s (v%d)", item.Key, item.Data, item.Version)
+	}
+	return nil
 }
 
 // IsSet return if a key is set in the store
@@ -92,25 +498,133 @@ func (kvs *KVStore) IsSet(key string) bool {
 
 // Get a value by key from the store
 func (kvs *KVStore) Get(key string) ([]byte, int16, bool) {
-	keymd5 := ch.NewMD5Key(key)
-	ok, valueInt := kvs.store.Get(keymd5)
+	item, ok := kvs.GetItem(key)
+	if !ok {
+		return nil, 0, false
+	}
+	return item.Data, item.Flags, true
+}
+
+// GetItem returns the item for the key, including its version. The item must not be modified.
+func (kvs *KVStore) GetItem(key string) (*Item, bool) {
+	item, ok := kvs.Lookup(key)
+	if ok && item.Tombstone {
+		return nil, false
+	}
+	return item, ok
+}
+
+// Lookup returns the item for the key like GetItem, or its tombstone if it has been deleted, so that replicas
+// can compare the versions of deleted keys. The item must not be modified.
+func (kvs *KVStore) Lookup(key string) (*Item, bool) {
+	atomic.AddUint64(&kvs.gets, 1)
+	name, _ := SplitKeyspaceKey(key)
+	kvs.mutex.RLock()
+	value, ok := kvs.store.get(key)
+	ks := kvs.keyspaces[name]
+	kvs.mutex.RUnlock()
+	if ks != nil {
+		atomic.AddUint64(&ks.gets, 1)
+	}
+	if ok && value.expired(time.Now()) {
+		// Expired but not yet removed by the expiry goroutine
+		ok = false
+	}
+	if ok && value.Tombstone {
+		kvs.Logger.Debug("KVStore", "GET [%s] DELETED (v%d)", key, value.Version)
+		return value, true
+	}
 	if ok {
-		value := valueInt.(*Item)
-		kvs.Logger.Debug("KVStore", "GET [%s] %s", value.Key, value.Data)
-		return value.Data, value.Flags, true
+		value.touch(time.Now())
+		value, err := kvs.verify(value)
+		if err != nil {
+			return nil, false
+		}
+		atomic.AddUint64(&kvs.hits, 1)
+		if ks != nil {
+			atomic.AddUint64(&ks.hits, 1)
+		}
+		kvs.Logger.Debug("KVStore", "GET [%s] %s (v%d)", value.Key, value.Data, value.Version)
+		return value, true
 	} else {
 		kvs.Logger.Debug("KVStore", "GET [%s] NOT FOUND", key)
-		return nil, 0, false
+		return nil, false
 	}
 }
 
-// Delete a value by key from the store
+// Delete a value by key from the store with a new version, leaving a tombstone, and return whether it was set
 func (kvs *KVStore) Delete(key string) bool {
-	kvs.Logger.Debug("KVStore", "DELETE [%s]", key)
-	return kvs.deleteKey(ch.NewMD5Key(key))
+	_, found, _ := kvs.DeleteVersion(key, 0)
+	return found
+}
+
+// Forget removes the key or its tombstone from this store without leaving a tombstone, unless it has been written
+// with a version newer than the given version. It is used once the key has been handed over to the nodes that
+// now hold it, so must not be used to delete a key. It returns whether a live item was removed, and the key is
+// kept if the removal cannot be logged.
+func (kvs *KVStore) Forget(key string, version uint64) bool {
+	kvs.mutex.Lock()
+	defer kvs.mutex.Unlock()
+
+	item, found := kvs.store.get(key)
+	if !found || item.Version > version {
+		return false
+	}
+	kvs.Logger.Debug("KVStore", "FORGET [%s]", key)
+	if kvs.logWAL(&WALRecord{Op: WALOpDelete, Key: key}) != nil {
+		return false
+	}
+	return kvs.remove(key)
+}
+
+// remove deletes the key or its tombstone from the store and releases its memory, returning whether a live
+// item was removed.
+func (kvs *KVStore) remove(key string) bool {
+	item, found := kvs.store.get(key)
+	if !found {
+		return false
+	}
+	kvs.store.delete(key)
+	kvs.account(item, -1)
+	return !item.Tombstone
+}
+
+// account adds (sign 1) or removes (sign -1) the item's memory and counts it, or counts it as a tombstone.
+// Tombstones are short lived and hold no data, so do not count towards memory.
+func (kvs *KVStore) account(item *Item, sign int64) {
+	if item.Tombstone {
+		kvs.tombstone += sign
+		return
+	}
+	ks := kvs.keyspace(item.Keyspace())
+	kvs.memory += sign * item.size()
+	ks.memory += sign * item.size()
+	ks.items += sign
+}
+
+// logWAL appends the record to the WAL, if configured. It must be called before the store is changed, and the
+// change must not be made if it returns an error, as it would be lost on restart.
+func (kvs *KVStore) logWAL(record *WALRecord) error {
+	if kvs.WAL == nil {
+		return nil
+	}
+	err := kvs.WAL.Append(record)
+	if err != nil {
+		kvs.Logger.Error("KVStore", "WAL Append Failed for [%s]: %s", record.Key, err.Error())
+	}
+	return err
 }
 
-func (kvs *KVStore) deleteKey(key ch.Key) bool {
-	kvs.store.Clear(key)
-	return true
+// replay applies a WAL or snapshot record to the store without logging it again.
+func (kvs *KVStore) replay(record *WALRecord) {
+	switch record.Op {
+	case WALOpSet:
+		if record.ExpiresAt != nil && !record.ExpiresAt.After(time.Now()) {
+			kvs.remove(record.Key)
+			return
+		}
+		kvs.set(&Item{Key: record.Key, Data: record.Data, Flags: record.Flags, ExpiresAt: record.ExpiresAt, Version: record.Version, Compressed: record.Compressed, Checksum: record.Checksum, Tombstone: record.Tombstone})
+	case WALOpDelete:
+		kvs.remove(record.Key)
+	}
 }
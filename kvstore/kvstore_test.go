@@ -1,6 +1,8 @@
 package kvstore
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -48,3 +50,213 @@ func TestGetSet(t *testing.T) {
 	assert.False(t, ok)
 
 }
+
+func TestEngineStats(t *testing.T) {
+	logger := util.NewLogger("error")
+	var inst Engine = NewKVStore(logger)
+
+	inst.Set("one", []byte{1}, 0, nil)
+	inst.Set("two", []byte{2}, 0, nil)
+	inst.Get("one")
+	inst.Get("three")
+	inst.Delete("two")
+
+	stats := inst.Stats()
+	assert.Equal(t, StorageMemory, stats.Storage)
+	assert.Equal(t, uint64(1), stats.Items)
+	assert.Equal(t, uint64(2), stats.Sets)
+	assert.Equal(t, uint64(2), stats.Gets)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Deletes)
+
+	count := 0
+	inst.Iterate(func(item *Item) bool {
+		assert.Equal(t, "one", item.Key)
+		count++
+		return true
+	})
+	assert.Equal(t, 1, count)
+	assert.Nil(t, inst.Close())
+}
+
+// TestConcurrentAccess hammers the store from many goroutines while the expiry goroutine runs.
+// Run with go test -race.
+func TestConcurrentAccess(t *testing.T) {
+	logger := util.NewLogger("error")
+	for _, inst := range []*KVStore{NewKVStore(logger), NewBPlusTreeKVStore(logger)} {
+		inst.Start()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					key := fmt.Sprintf("key%d", (g*7+i)%64)
+					switch i % 6 {
+					case 0:
+						inst.Set(key, []byte{byte(i)}, int16(g), nil)
+					case 1:
+						expiry := time.Now().Add(time.Duration(i%3) * time.Second)
+						inst.Set(key, []byte{byte(i)}, int16(g), &expiry)
+					case 2:
+						inst.Get(key)
+					case 3:
+						inst.IsSet(key)
+					case 4:
+						inst.Delete(key)
+					case 5:
+						inst.Iterate(func(item *Item) bool { return len(item.Key) > 0 })
+						inst.Stats()
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		inst.Stop()
+		assert.Nil(t, inst.Close())
+	}
+}
+
+func TestVersions(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+
+	inst.Set("one", []byte{1}, 0, nil)
+	first, _ := inst.GetItem("one")
+	inst.Set("one", []byte{2}, 0, nil)
+	second, _ := inst.GetItem("one")
+	inst.Set("two", []byte{3}, 0, nil)
+	third, _ := inst.GetItem("two")
+	assert.True(t, second.Version > first.Version)
+	assert.True(t, third.Version > second.Version)
+
+	// Replicated versions are kept, and older ones ignored
+	version, err := inst.SetVersion("one", []byte{4}, 0, nil, third.Version+10)
+	assert.Nil(t, err)
+	assert.Equal(t, third.Version+10, version)
+	version, err = inst.SetVersion("one", []byte{5}, 0, nil, third.Version)
+	assert.Nil(t, err)
+	assert.Equal(t, third.Version+10, version)
+	val, _, _ := inst.Get("one")
+	assert.Equal(t, []byte{4}, val)
+
+	// New versions follow the highest seen
+	inst.Set("two", []byte{6}, 0, nil)
+	item, _ := inst.GetItem("two")
+	assert.True(t, item.Version > third.Version+10)
+}
+
+func TestCompareAndSet(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+
+	_, err := inst.CompareAndSet("one", []byte{1}, 0, nil, 1)
+	assert.Equal(t, ErrNotFound, err)
+
+	inst.Set("one", []byte{1}, 0, nil)
+	item, _ := inst.GetItem("one")
+
+	version, err := inst.CompareAndSet("one", []byte{2}, 3, nil, item.Version)
+	assert.Nil(t, err)
+	assert.True(t, version > item.Version)
+
+	_, err = inst.CompareAndSet("one", []byte{3}, 0, nil, item.Version)
+	assert.Equal(t, ErrVersionMismatch, err)
+
+	val, flags, _ := inst.Get("one")
+	assert.Equal(t, []byte{2}, val)
+	assert.Equal(t, int16(3), flags)
+}
+
+func TestIncrDecr(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	expiry := time.Now().Add(time.Hour)
+
+	_, err := inst.Incr("count", 1)
+	assert.Equal(t, ErrNotFound, err)
+
+	inst.Set("count", []byte("10"), 5, &expiry)
+	before, _ := inst.GetItem("count")
+	item, err := inst.Incr("count", 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("15"), item.Data)
+	assert.Equal(t, int16(5), item.Flags)
+	assert.Equal(t, &expiry, item.ExpiresAt)
+	assert.True(t, item.Version > before.Version)
+
+	item, err = inst.Decr("count", 20)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("0"), item.Data)
+
+	inst.Set("count", []byte("18446744073709551615"), 0, nil)
+	item, err = inst.Incr("count", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), item.Data)
+
+	inst.Set("text", []byte("abc"), 0, nil)
+	_, err = inst.Incr("text", 1)
+	assert.Equal(t, ErrNotNumeric, err)
+	val, _, _ := inst.Get("text")
+	assert.Equal(t, []byte("abc"), val)
+}
+
+func TestAppendPrepend(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+
+	_, err := inst.Append("one", []byte("x"))
+	assert.Equal(t, ErrNotFound, err)
+
+	inst.Set("one", []byte("middle"), 0, nil)
+	_, err = inst.Append("one", []byte("-end"))
+	assert.Nil(t, err)
+	item, err := inst.Prepend("one", []byte("start-"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("start-middle-end"), item.Data)
+
+	val, _, _ := inst.Get("one")
+	assert.Equal(t, []byte("start-middle-end"), val)
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+	inst.Set("count", []byte("0"), 0, nil)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				inst.Incr("count", 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, _, _ := inst.Get("count")
+	assert.Equal(t, []byte("800"), val)
+}
+
+func TestForget(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+
+	inst.SetVersion("key", []byte("value"), 0, nil, 10)
+	inst.SetVersion("deleted", []byte("value"), 0, nil, 10)
+	inst.DeleteVersion("deleted", 11)
+
+	// A newer write is kept
+	assert.False(t, inst.Forget("key", 9))
+	assert.True(t, inst.IsSet("key"))
+
+	assert.True(t, inst.Forget("key", 10))
+	assert.False(t, inst.IsSet("key"))
+	assert.False(t, inst.Forget("deleted", 11))
+	assert.False(t, inst.Forget("missing", 10))
+
+	// No tombstones are left
+	_, found := inst.Lookup("key")
+	assert.False(t, found)
+	_, found = inst.Lookup("deleted")
+	assert.False(t, found)
+	assert.Equal(t, uint64(0), inst.Stats().Items)
+}
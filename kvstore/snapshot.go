@@ -0,0 +1,232 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tomdionysus/trinity/util"
+)
+
+// snapshotMagic identifies a snapshot file and its format version. Snapshots written with snapshotMagic1, before
+// WAL records had a format byte, are still read.
+var snapshotMagic = []byte("TRSNAP02")
+var snapshotMagic1 = []byte("TRSNAP01")
+
+// Snapshotter writes and loads point-in-time snapshots of the KVStore.
+//
+// A snapshot file is [magic][uint64 sequence][uint64 count] followed by count [uint32 length][record] entries
+// encoded as WAL Set records, and a trailing CRC32C over everything before it. A snapshot with sequence N
+// contains every mutation in WAL segments numbered lower than N.
+type Snapshotter struct {
+	Logger   *util.Logger
+	Dir      string
+	Interval time.Duration
+	Retain   int
+}
+
+// NewSnapshotter returns a new Snapshotter writing to the given directory every interval, keeping the newest
+// retain snapshots.
+func NewSnapshotter(logger *util.Logger, dir string, interval time.Duration, retain int) *Snapshotter {
+	inst := &Snapshotter{
+		Logger:   logger,
+		Dir:      dir,
+		Interval: interval,
+		Retain:   retain,
+	}
+	return inst
+}
+
+// Load restores the newest valid snapshot through the given function and returns its sequence number, or
+// 0 if there is no valid snapshot. Invalid snapshots are skipped with a warning.
+func (snap *Snapshotter) Load(restore func(*WALRecord)) (uint64, error) {
+	err := os.MkdirAll(snap.Dir, 0755)
+	if err != nil {
+		return 0, err
+	}
+	sequences, err := snap.sequences()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(sequences) - 1; i >= 0; i-- {
+		records, err := snap.read(sequences[i])
+		if err != nil {
+			snap.Logger.Warn("Snapshot", "Snapshot %d is invalid, skipping: %s", sequences[i], err.Error())
+			continue
+		}
+		for _, record := range records {
+			restore(record)
+		}
+		snap.Logger.Info("Snapshot", "Loaded snapshot %d (%d items)", sequences[i], len(records))
+		return sequences[i], nil
+	}
+	return 0, nil
+}
+
+// Latest returns the sequence number of the newest snapshot on disk, or 0 if there are none.
+func (snap *Snapshotter) Latest() uint64 {
+	sequences, err := snap.sequences()
+	if err != nil || len(sequences) == 0 {
+		return 0
+	}
+	return sequences[len(sequences)-1]
+}
+
+// Write atomically writes a snapshot with the given sequence number containing the given records.
+func (snap *Snapshotter) Write(sequence uint64, records []*WALRecord) error {
+	path := snap.path(sequence)
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	hash := crc32.New(walCRCTable)
+	writer := bufio.NewWriter(io.MultiWriter(file, hash))
+
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header[0:8], sequence)
+	binary.BigEndian.PutUint64(header[8:16], uint64(len(records)))
+	writer.Write(snapshotMagic)
+	writer.Write(header)
+
+	length := make([]byte, 4)
+	for _, record := range records {
+		payload := encodeWALRecord(record)
+		binary.BigEndian.PutUint32(length, uint32(len(payload)))
+		writer.Write(length)
+		writer.Write(payload)
+	}
+	err = writer.Flush()
+	if err == nil {
+		binary.BigEndian.PutUint32(length, hash.Sum32())
+		_, err = file.Write(length)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(snap.Dir)
+}
+
+// Prune removes all but the newest Retain snapshots, and returns the sequence number of the oldest snapshot kept.
+func (snap *Snapshotter) Prune() (uint64, error) {
+	sequences, err := snap.sequences()
+	if err != nil || len(sequences) == 0 {
+		return 0, err
+	}
+	retain := snap.Retain
+	if retain < 1 {
+		retain = 1
+	}
+	for len(sequences) > retain {
+		snap.Logger.Debug("Snapshot", "Removing snapshot %d", sequences[0])
+		if err := os.Remove(snap.path(sequences[0])); err != nil {
+			return 0, err
+		}
+		sequences = sequences[1:]
+	}
+	return sequences[0], nil
+}
+
+// Private
+
+func (snap *Snapshotter) path(sequence uint64) string {
+	return filepath.Join(snap.Dir, fmt.Sprintf("snapshot-%016d.snap", sequence))
+}
+
+// sequences returns the sequence numbers of the snapshots present in the data directory, in ascending order.
+func (snap *Snapshotter) sequences() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(snap.Dir, "snapshot-*.snap"))
+	if err != nil {
+		return nil, err
+	}
+	sequences := []uint64{}
+	for _, name := range names {
+		var seq uint64
+		base := strings.TrimSuffix(filepath.Base(name), ".snap")
+		if _, err := fmt.Sscanf(base, "snapshot-%d", &seq); err != nil {
+			snap.Logger.Warn("Snapshot", "Ignoring unrecognised file %s", name)
+			continue
+		}
+		sequences = append(sequences, seq)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	return sequences, nil
+}
+
+// read reads and verifies the snapshot with the given sequence number.
+func (snap *Snapshotter) read(sequence uint64) ([]*WALRecord, error) {
+	data, err := ioutil.ReadFile(snap.path(sequence))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(snapshotMagic)+16+4 || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) && !bytes.Equal(data[:len(snapshotMagic1)], snapshotMagic1) {
+		return nil, errors.New("bad header")
+	}
+	body, trailer := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, walCRCTable) != binary.BigEndian.Uint32(trailer) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	pos := len(snapshotMagic)
+	if binary.BigEndian.Uint64(body[pos:]) != sequence {
+		return nil, errors.New("sequence mismatch")
+	}
+	count := binary.BigEndian.Uint64(body[pos+8:])
+	pos += 16
+
+	records := []*WALRecord{}
+	for i := uint64(0); i < count; i++ {
+		if pos+4 > len(body) {
+			return nil, errors.New("truncated record")
+		}
+		length := int(binary.BigEndian.Uint32(body[pos:]))
+		pos += 4
+		if pos+length > len(body) {
+			return nil, errors.New("truncated record")
+		}
+		record, err := decodeWALRecord(body[pos : pos+length])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		pos += length
+	}
+	if pos != len(body) {
+		return nil, errors.New("trailing data")
+	}
+	return records, nil
+}
+
+// syncDir fsyncs a directory so that renames within it are durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
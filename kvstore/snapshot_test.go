@@ -0,0 +1,121 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func newPersistentKVStore(t *testing.T, logger *util.Logger, dir string) *KVStore {
+	inst := NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncNever, 0)
+	inst.Snapshots = NewSnapshotter(logger, dir, 0, 2)
+	assert.Nil(t, inst.Init())
+	return inst
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("error")
+	inst := newPersistentKVStore(t, logger, dir)
+
+	future := time.Now().Add(time.Hour).UTC()
+	inst.Set("one", []byte{1}, 1, nil)
+	inst.Set("two", []byte{2}, 2, &future)
+	assert.Nil(t, inst.Snapshot())
+
+	// Written after the snapshot, so must come from the WAL.
+	inst.Set("three", []byte{3}, 3, nil)
+	inst.Delete("one")
+	assert.Nil(t, inst.Close())
+
+	inst = newPersistentKVStore(t, logger, dir)
+	defer inst.Close()
+
+	assert.False(t, inst.IsSet("one"))
+	val, flags, ok := inst.Get("two")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{2}, val)
+	assert.Equal(t, int16(2), flags)
+	val, _, ok = inst.Get("three")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{3}, val)
+}
+
+func TestSnapshotCompactsWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("error")
+	inst := newPersistentKVStore(t, logger, dir)
+	defer inst.Close()
+
+	for i := 0; i < 4; i++ {
+		inst.Set("key", []byte{byte(i)}, 0, nil)
+		assert.Nil(t, inst.Snapshot())
+	}
+
+	snapshots, _ := filepath.Glob(filepath.Join(dir, "snapshot-*.snap"))
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	assert.Equal(t, 2, len(snapshots))
+	assert.Equal(t, 2, len(segments))
+}
+
+func TestSnapshotSkipsCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("fatal")
+	snap := NewSnapshotter(logger, dir, 0, 2)
+	assert.Nil(t, snap.Write(1, []*WALRecord{{Op: WALOpSet, Key: "one", Data: []byte{1}}}))
+	assert.Nil(t, snap.Write(2, []*WALRecord{{Op: WALOpSet, Key: "two", Data: []byte{2}}}))
+
+	data, err := ioutil.ReadFile(snap.path(2))
+	assert.Nil(t, err)
+	data[len(data)/2] ^= 0xFF
+	assert.Nil(t, ioutil.WriteFile(snap.path(2), data, 0644))
+
+	records := []*WALRecord{}
+	sequence, err := snap.Load(func(r *WALRecord) { records = append(records, r) })
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), sequence)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "one", records[0].Key)
+}
+
+func TestSnapshotLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// A snapshot written before WAL records had a format byte
+	record := legacyWALRecord(&WALRecord{Op: WALOpSet, Key: "one", Data: []byte{1}, Version: 5, Checksum: util.Checksum([]byte{1})})
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint64(header[0:8], 1)
+	binary.BigEndian.PutUint64(header[8:16], 1)
+	binary.BigEndian.PutUint32(header[16:20], uint32(len(record)))
+	data := append(append(append([]byte{}, snapshotMagic1...), header...), record...)
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, crc32.Checksum(data, walCRCTable))
+	data = append(data, trailer...)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "snapshot-0000000000000001.snap"), data, 0644))
+
+	inst := newPersistentKVStore(t, util.NewLogger("error"), dir)
+	defer inst.Close()
+	item, found := inst.GetItem("one")
+	assert.True(t, found)
+	assert.Equal(t, []byte{1}, item.Data)
+	assert.Equal(t, uint64(5), item.Version)
+}
@@ -0,0 +1,58 @@
+package kvstore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tomdionysus/trinity/util"
+)
+
+// TombstoneTTL is how long the tombstone of a deleted key is kept, so that a replica that missed the delete
+// cannot resurrect the key with an older version.
+const TombstoneTTL = time.Hour
+
+// encodingTombstone marks a tombstone in the WAL and on block storage.
+const encodingTombstone = 2
+
+// DeleteVersion deletes the key by storing a tombstone with the given version, as assigned by the node that owns
+// the key, or with a new version if version is 0. A delete with a version that is not newer than the current
+// item's is ignored. It returns the version of the tombstone and whether a live item was deleted.
+func (kvs *KVStore) DeleteVersion(key string, version uint64) (uint64, bool, error) {
+	kvs.Logger.Debug("KVStore", "DELETE [%s]", key)
+	atomic.AddUint64(&kvs.deletes, 1)
+	kvs.mutex.Lock()
+	defer kvs.mutex.Unlock()
+
+	old, found := kvs.store.get(key)
+	if version != 0 && found && old.Version >= version {
+		kvs.Logger.Debug("KVStore", "DELETE [%s] Ignored: version %d is not newer than %d", key, version, old.Version)
+		return old.Version, false, nil
+	}
+	if version == 0 {
+		version = kvs.nextVersion()
+	}
+	now := time.Now()
+	live := found && old.live(now)
+	err := kvs.setTombstone(key, version, now)
+	if err != nil {
+		return 0, false, err
+	}
+	return version, live, nil
+}
+
+// setTombstone logs and stores the tombstone of the key with the given version. kvs.mutex must be held exclusively.
+func (kvs *KVStore) setTombstone(key string, version uint64, now time.Time) error {
+	// Tombstones are not compressed and do not count towards quotas or MaxMemory
+	expiry := now.Add(TombstoneTTL)
+	item := &Item{Key: key, ExpiresAt: &expiry, Version: version, Checksum: util.Checksum(nil), Tombstone: true}
+	err := kvs.logWAL(&WALRecord{Op: WALOpSet, Key: item.Key, ExpiresAt: item.ExpiresAt, Version: item.Version, Checksum: item.Checksum, Tombstone: true})
+	if err != nil {
+		return err
+	}
+	return kvs.set(item)
+}
+
+// live returns true if the item is neither deleted nor expired.
+func (item *Item) live(now time.Time) bool {
+	return !item.Tombstone && !item.expired(now)
+}
@@ -0,0 +1,91 @@
+package kvstore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestDeleteVersion(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+
+	inst.SetVersion("key", []byte("value"), 0, nil, 10)
+	version, found, err := inst.DeleteVersion("key", 20)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, uint64(20), version)
+	assert.False(t, inst.IsSet("key"))
+
+	// A replica that missed the delete cannot restore the key with an older version
+	version, err = inst.SetVersion("key", []byte("value"), 0, nil, 15)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(20), version)
+	assert.False(t, inst.IsSet("key"))
+
+	// An older delete is ignored
+	version, found, err = inst.DeleteVersion("key", 5)
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Equal(t, uint64(20), version)
+
+	// Newer writes replace the tombstone
+	inst.SetVersion("key", []byte("again"), 0, nil, 30)
+	value, _, ok := inst.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("again"), value)
+}
+
+func TestTombstoneStats(t *testing.T) {
+	inst := NewKVStore(util.NewLogger("error"))
+
+	inst.Set("a", []byte("value"), 0, nil)
+	inst.Set("b", []byte("value"), 0, nil)
+	assert.True(t, inst.Delete("a"))
+	assert.False(t, inst.Delete("missing"))
+
+	stats := inst.Stats()
+	assert.Equal(t, uint64(1), stats.Items)
+	assert.Equal(t, uint64(1), inst.Keyspaces()[DefaultKeyspace].Items)
+
+	keys := []string{}
+	inst.Iterate(func(item *Item) bool {
+		keys = append(keys, item.Key)
+		return true
+	})
+	assert.Equal(t, []string{"b"}, keys)
+
+	cursor := inst.Scan(ScanOptions{Tombstones: true})
+	tombstones := 0
+	for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+		if item.Tombstone {
+			tombstones++
+		}
+	}
+	assert.Equal(t, 2, tombstones)
+}
+
+func TestTombstoneReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("error")
+	inst := NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	inst.SetVersion("key", []byte("value"), 0, nil, 10)
+	inst.DeleteVersion("key", 20)
+	assert.Nil(t, inst.Close())
+
+	inst = NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	defer inst.Close()
+
+	assert.False(t, inst.IsSet("key"))
+	version, _ := inst.SetVersion("key", []byte("value"), 0, nil, 15)
+	assert.Equal(t, uint64(20), version)
+}
@@ -0,0 +1,456 @@
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomdionysus/trinity/util"
+)
+
+// WAL Record Operations
+const (
+	WALOpSet    = 1
+	WALOpDelete = 2
+)
+
+// WAL Sync Policies
+const (
+	WALSyncAlways   = "always"
+	WALSyncInterval = "interval"
+	WALSyncNever    = "never"
+)
+
+// walRecordHeaderSize is the size of the length + CRC32C header preceding every record.
+const walRecordHeaderSize = 8
+
+// walMaxRecordSize bounds a single record so a corrupt length field can't cause a huge allocation.
+const walMaxRecordSize = 64 * 1024 * 1024
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WALRecord is a single Set or Delete operation in the write-ahead log.
+type WALRecord struct {
+	Op        byte
+	Key       string
+	Data      []byte
+	Flags     int16
+	ExpiresAt *time.Time
+	Version   uint64
+	// Compressed is true if Data is compressed.
+	Compressed bool
+	// Checksum is the CRC32C of the uncompressed Data.
+	Checksum uint32
+	// Tombstone is true if the Set stores the tombstone of a deleted key.
+	Tombstone bool
+}
+
+// WAL is an append-only, checksummed write-ahead log of KVStore mutations, stored as a sequence of
+// segment files in a data directory.
+//
+// Each record on disk is [uint32 length][uint32 CRC32C][payload], big endian, where the CRC covers the payload.
+type WAL struct {
+	Logger       *util.Logger
+	Dir          string
+	SyncPolicy   string
+	SyncInterval time.Duration
+
+	segment uint64
+	file    *os.File
+	writer  *bufio.Writer
+	dirty   bool
+	mutex   sync.Mutex
+	stop    chan bool
+}
+
+// NewWAL returns a new WAL in the given directory with the given sync policy. The interval is only used
+// with WALSyncInterval.
+func NewWAL(logger *util.Logger, dir string, syncPolicy string, syncInterval time.Duration) *WAL {
+	inst := &WAL{
+		Logger:       logger,
+		Dir:          dir,
+		SyncPolicy:   syncPolicy,
+		SyncInterval: syncInterval,
+	}
+	return inst
+}
+
+// ValidWALSyncPolicy returns true if the given string is a known sync policy.
+func ValidWALSyncPolicy(policy string) bool {
+	switch policy {
+	case WALSyncAlways, WALSyncInterval, WALSyncNever:
+		return true
+	}
+	return false
+}
+
+// Open replays every segment numbered from or higher in the data directory through the given function, in order,
+// then opens the newest segment for appending. Torn or corrupt records at the end of the newest segment are
+// truncated with a warning, as they are writes that were not completed. A torn or corrupt record in an earlier
+// segment would lose the writes after it, so returns an error.
+func (wal *WAL) Open(from uint64, replay func(*WALRecord)) error {
+	if !ValidWALSyncPolicy(wal.SyncPolicy) {
+		return fmt.Errorf("Unknown WAL sync policy '%s'", wal.SyncPolicy)
+	}
+	err := os.MkdirAll(wal.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	segments, err := wal.segments()
+	if err != nil {
+		return err
+	}
+
+	count, replayed := 0, 0
+	for i, seg := range segments {
+		if seg < from {
+			continue
+		}
+		n, err := wal.replaySegment(seg, i == len(segments)-1, replay)
+		if err != nil {
+			return err
+		}
+		count += n
+		replayed++
+	}
+	wal.Logger.Info("WAL", "Replayed %d record(s) from %d segment(s)", count, replayed)
+
+	wal.segment = 1
+	if len(segments) > 0 {
+		wal.segment = segments[len(segments)-1]
+	}
+	if wal.segment < from {
+		wal.segment = from
+	}
+	err = wal.openSegment(wal.segment)
+	if err != nil {
+		return err
+	}
+
+	if wal.SyncPolicy == WALSyncInterval {
+		wal.stop = make(chan bool)
+		go wal.syncLoop(wal.stop)
+	}
+	return nil
+}
+
+// Append writes the record to the log, syncing it to disk if the policy is WALSyncAlways.
+func (wal *WAL) Append(record *WALRecord) error {
+	payload := encodeWALRecord(record)
+
+	header := make([]byte, walRecordHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, walCRCTable))
+
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+
+	if wal.writer == nil {
+		return errors.New("WAL is not open")
+	}
+	if _, err := wal.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := wal.writer.Write(payload); err != nil {
+		return err
+	}
+	if err := wal.writer.Flush(); err != nil {
+		return err
+	}
+	wal.dirty = true
+	if wal.SyncPolicy == WALSyncAlways {
+		return wal.sync()
+	}
+	return nil
+}
+
+// Sync flushes the current segment to stable storage.
+func (wal *WAL) Sync() error {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+	return wal.sync()
+}
+
+// Rotate syncs and closes the current segment and starts a new one, returning the new segment number.
+// Every record appended before Rotate is in a segment numbered lower than the returned value.
+func (wal *WAL) Rotate() (uint64, error) {
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+
+	if wal.file == nil {
+		return 0, errors.New("WAL is not open")
+	}
+	if err := wal.sync(); err != nil {
+		return 0, err
+	}
+	if err := wal.file.Close(); err != nil {
+		return 0, err
+	}
+	wal.segment++
+	if err := wal.openSegment(wal.segment); err != nil {
+		wal.file = nil
+		wal.writer = nil
+		return 0, err
+	}
+	return wal.segment, nil
+}
+
+// RemoveBefore deletes all segments numbered lower than the given segment.
+func (wal *WAL) RemoveBefore(segment uint64) error {
+	segments, err := wal.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if seg >= segment {
+			break
+		}
+		wal.Logger.Debug("WAL", "Removing compacted segment %d", seg)
+		if err := os.Remove(wal.segmentPath(seg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes the current segment.
+func (wal *WAL) Close() error {
+	if wal.stop != nil {
+		close(wal.stop)
+		wal.stop = nil
+	}
+
+	wal.mutex.Lock()
+	defer wal.mutex.Unlock()
+
+	if wal.file == nil {
+		return nil
+	}
+	err := wal.sync()
+	cerr := wal.file.Close()
+	wal.file = nil
+	wal.writer = nil
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Private
+
+func (wal *WAL) sync() error {
+	if wal.file == nil || !wal.dirty {
+		return nil
+	}
+	wal.dirty = false
+	return wal.file.Sync()
+}
+
+func (wal *WAL) syncLoop(stop chan bool) {
+	ticker := time.NewTicker(wal.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := wal.Sync()
+			if err != nil {
+				wal.Logger.Error("WAL", "Sync Failed: %s", err.Error())
+			}
+		}
+	}
+}
+
+func (wal *WAL) segmentPath(segment uint64) string {
+	return filepath.Join(wal.Dir, fmt.Sprintf("wal-%016d.log", segment))
+}
+
+// segments returns the segment numbers present in the data directory, in ascending order.
+func (wal *WAL) segments() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(wal.Dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	segments := []uint64{}
+	for _, name := range names {
+		var seg uint64
+		base := strings.TrimSuffix(filepath.Base(name), ".log")
+		if _, err := fmt.Sscanf(base, "wal-%d", &seg); err != nil {
+			wal.Logger.Warn("WAL", "Ignoring unrecognised file %s", name)
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (wal *WAL) openSegment(segment uint64) error {
+	file, err := os.OpenFile(wal.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	wal.file = file
+	wal.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// replaySegment reads every valid record in the segment. At the first torn or corrupt record the newest segment
+// is truncated, and an error is returned for any other.
+func (wal *WAL) replaySegment(segment uint64, newest bool, replay func(*WALRecord)) (int, error) {
+	path := wal.segmentPath(segment)
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, walRecordHeaderSize)
+	var offset int64
+	count := 0
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, wal.corrupt(file, path, offset, newest, "torn record header")
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > walMaxRecordSize {
+			return count, wal.corrupt(file, path, offset, newest, "invalid record length")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return count, wal.corrupt(file, path, offset, newest, "torn record")
+		}
+		if crc32.Checksum(payload, walCRCTable) != checksum {
+			return count, wal.corrupt(file, path, offset, newest, "checksum mismatch")
+		}
+		record, err := decodeWALRecord(payload)
+		if err != nil {
+			return count, wal.corrupt(file, path, offset, newest, err.Error())
+		}
+		replay(record)
+		offset += int64(walRecordHeaderSize) + int64(length)
+		count++
+	}
+}
+
+// corrupt truncates the newest segment at the offset of a torn or corrupt record, or returns an error for an
+// earlier segment.
+func (wal *WAL) corrupt(file *os.File, path string, offset int64, newest bool, reason string) error {
+	if !newest {
+		wal.Logger.Error("WAL", "%s: %s at offset %d", path, reason, offset)
+		return fmt.Errorf("WAL segment %s is corrupt at offset %d: %s", path, offset, reason)
+	}
+	wal.Logger.Warn("WAL", "%s: %s at offset %d, truncating", path, reason, offset)
+	err := file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Record encoding: [format][op][flags int16][expiry unix nanos int64, 0 = none][version uint64]
+// [encoding, 1 = compressed | 2 = tombstone][data checksum uint32][key len uint32][key][data len uint32][data]
+//
+// The format byte has walFormatFlag set. Records written before it was added start with their op, which never has
+// walFormatFlag set, and are otherwise the same as walFormat1, including the tombstone encoding. New fields must
+// be added in a new format, so that the records of every earlier format can still be replayed.
+
+// walFormatFlag marks the format byte of a record.
+const walFormatFlag = 0x80
+
+// WAL Record Formats
+const (
+	walFormat1 = 1
+)
+
+func encodeWALRecord(record *WALRecord) []byte {
+	buf := make([]byte, 1+1+2+8+8+1+4+4+len(record.Key)+4+len(record.Data))
+	buf[0] = walFormatFlag | walFormat1
+	buf[1] = record.Op
+	binary.BigEndian.PutUint16(buf[2:4], uint16(record.Flags))
+	if record.ExpiresAt != nil {
+		binary.BigEndian.PutUint64(buf[4:12], uint64(record.ExpiresAt.UnixNano()))
+	}
+	binary.BigEndian.PutUint64(buf[12:20], record.Version)
+	if record.Compressed {
+		buf[20] |= encodingCompressed
+	}
+	if record.Tombstone {
+		buf[20] |= encodingTombstone
+	}
+	binary.BigEndian.PutUint32(buf[21:25], record.Checksum)
+	pos := 25
+	binary.BigEndian.PutUint32(buf[pos:], uint32(len(record.Key)))
+	pos += 4
+	pos += copy(buf[pos:], record.Key)
+	binary.BigEndian.PutUint32(buf[pos:], uint32(len(record.Data)))
+	pos += 4
+	copy(buf[pos:], record.Data)
+	return buf
+}
+
+func decodeWALRecord(buf []byte) (*WALRecord, error) {
+	if len(buf) == 0 || buf[0]&walFormatFlag == 0 {
+		return decodeWALRecord1(buf)
+	}
+	switch buf[0] &^ walFormatFlag {
+	case walFormat1:
+		return decodeWALRecord1(buf[1:])
+	}
+	return nil, fmt.Errorf("unknown record format %d", buf[0]&^walFormatFlag)
+}
+
+// decodeWALRecord1 decodes a walFormat1 record after its format byte.
+func decodeWALRecord1(buf []byte) (*WALRecord, error) {
+	if len(buf) < 32 {
+		return nil, errors.New("short record")
+	}
+	record := &WALRecord{
+		Op:    buf[0],
+		Flags: int16(binary.BigEndian.Uint16(buf[1:3])),
+	}
+	if record.Op != WALOpSet && record.Op != WALOpDelete {
+		return nil, fmt.Errorf("unknown record op %d", record.Op)
+	}
+	if exp := int64(binary.BigEndian.Uint64(buf[3:11])); exp != 0 {
+		t := time.Unix(0, exp).UTC()
+		record.ExpiresAt = &t
+	}
+	record.Version = binary.BigEndian.Uint64(buf[11:19])
+	record.Compressed = buf[19]&encodingCompressed != 0
+	record.Tombstone = buf[19]&encodingTombstone != 0
+	record.Checksum = binary.BigEndian.Uint32(buf[20:24])
+	pos := 24
+	keylen := int(binary.BigEndian.Uint32(buf[pos:]))
+	pos += 4
+	if pos+keylen+4 > len(buf) {
+		return nil, errors.New("bad key length")
+	}
+	record.Key = string(buf[pos : pos+keylen])
+	pos += keylen
+	datalen := int(binary.BigEndian.Uint32(buf[pos:]))
+	pos += 4
+	if pos+datalen != len(buf) {
+		return nil, errors.New("bad data length")
+	}
+	record.Data = make([]byte, datalen)
+	copy(record.Data, buf[pos:])
+	return record, nil
+}
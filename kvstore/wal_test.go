@@ -0,0 +1,215 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("error")
+	inst := NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+
+	future := time.Now().Add(time.Hour)
+	inst.Set("one", []byte{1}, 1, nil)
+	inst.Set("two", []byte{2}, 2, &future)
+	inst.Set("three", []byte{3}, 3, nil)
+	inst.Delete("three")
+	before, _ := inst.GetItem("one")
+	assert.Nil(t, inst.Close())
+
+	inst = NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	defer inst.Close()
+
+	val, flags, ok := inst.Get("one")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1}, val)
+	assert.Equal(t, int16(1), flags)
+	val, flags, ok = inst.Get("two")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{2}, val)
+	assert.Equal(t, int16(2), flags)
+	assert.False(t, inst.IsSet("three"))
+
+	after, _ := inst.GetItem("one")
+	assert.Equal(t, before.Version, after.Version)
+}
+
+// legacyWALRecord encodes the record as it was before records had a format byte.
+func legacyWALRecord(record *WALRecord) []byte {
+	return encodeWALRecord(record)[1:]
+}
+
+func TestWALLegacyRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	segment := []byte{}
+	for _, record := range []*WALRecord{
+		{Op: WALOpSet, Key: "one", Data: []byte{1}, Flags: 1, Version: 5, Checksum: util.Checksum([]byte{1})},
+		{Op: WALOpSet, Key: "two", Version: 6, Checksum: util.Checksum(nil), Tombstone: true},
+	} {
+		payload := legacyWALRecord(record)
+		header := make([]byte, walRecordHeaderSize)
+		binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, walCRCTable))
+		segment = append(segment, append(header, payload...)...)
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "wal-0000000000000001.log"), segment, 0644))
+
+	logger := util.NewLogger("error")
+	inst := NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	item, found := inst.GetItem("one")
+	assert.True(t, found)
+	assert.Equal(t, []byte{1}, item.Data)
+	assert.Equal(t, int16(1), item.Flags)
+	assert.Equal(t, uint64(5), item.Version)
+	tombstone, found := inst.Lookup("two")
+	assert.True(t, found && tombstone.Tombstone)
+
+	// New records follow the old ones in the same segment
+	inst.Set("three", []byte{3}, 0, nil)
+	assert.Nil(t, inst.Close())
+	inst = NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	defer inst.Close()
+	assert.True(t, inst.IsSet("one"))
+	assert.True(t, inst.IsSet("three"))
+
+	// Tombstones are kept in the current format too
+	record, err := decodeWALRecord(encodeWALRecord(&WALRecord{Op: WALOpSet, Key: "four", Version: 7, Tombstone: true}))
+	assert.Nil(t, err)
+	assert.True(t, record.Tombstone)
+	assert.Equal(t, uint64(7), record.Version)
+
+	_, err = decodeWALRecord(append([]byte{walFormatFlag | 9}, legacyWALRecord(&WALRecord{Op: WALOpSet, Key: "four"})...))
+	assert.NotNil(t, err)
+}
+
+func TestWALAppendFailureFailsWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("fatal")
+	inst := NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	assert.Nil(t, inst.Set("one", []byte{1}, 0, nil))
+
+	// With the WAL closed, writes cannot be logged so must not change the store
+	assert.Nil(t, inst.WAL.Close())
+	assert.NotNil(t, inst.Set("one", []byte{2}, 0, nil))
+	assert.NotNil(t, inst.Set("two", []byte{2}, 0, nil))
+	_, _, err = inst.DeleteVersion("one", 0)
+	assert.NotNil(t, err)
+	assert.False(t, inst.Forget("one", ^uint64(0)))
+
+	val, _, ok := inst.Get("one")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1}, val)
+	assert.False(t, inst.IsSet("two"))
+}
+
+func TestWALTruncatesCorruptTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("fatal")
+	wal := NewWAL(logger, dir, WALSyncNever, 0)
+	assert.Nil(t, wal.Open(0, func(*WALRecord) {}))
+	assert.Nil(t, wal.Append(&WALRecord{Op: WALOpSet, Key: "one", Data: []byte{1}}))
+	assert.Nil(t, wal.Append(&WALRecord{Op: WALOpSet, Key: "two", Data: []byte{2}}))
+	assert.Nil(t, wal.Close())
+
+	// Flip a byte in the last record's payload and append a torn header.
+	path := wal.segmentPath(1)
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	good := len(data) / 2
+	data[len(data)-1] ^= 0xFF
+	data = append(data, 0, 0, 0)
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+
+	records := []*WALRecord{}
+	wal = NewWAL(logger, dir, WALSyncNever, 0)
+	assert.Nil(t, wal.Open(0, func(r *WALRecord) { records = append(records, r) }))
+	assert.Nil(t, wal.Close())
+
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "one", records[0].Key)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(good), info.Size())
+}
+
+func TestWALCorruptSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-wal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := util.NewLogger("fatal")
+	inst := NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	assert.Nil(t, inst.Set("one", []byte{1}, 0, nil))
+	_, err = inst.WAL.Rotate()
+	assert.Nil(t, err)
+	assert.Nil(t, inst.Set("two", []byte{2}, 0, nil))
+	assert.Nil(t, inst.Set("three", []byte{3}, 0, nil))
+	assert.Nil(t, inst.Close())
+
+	corrupt := func(segment uint64) {
+		path := inst.WAL.segmentPath(segment)
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		data[len(data)-1] ^= 0xFF
+		assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	}
+
+	// A corrupt tail of the newest segment is a write that was not completed, so is dropped
+	corrupt(2)
+	inst = NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.Nil(t, inst.Init())
+	assert.True(t, inst.IsSet("one"))
+	assert.True(t, inst.IsSet("two"))
+	assert.False(t, inst.IsSet("three"))
+	assert.Nil(t, inst.Close())
+
+	// Corruption in an earlier segment would lose the writes after it
+	corrupt(1)
+	inst = NewKVStore(logger)
+	inst.WAL = NewWAL(logger, dir, WALSyncAlways, 0)
+	assert.NotNil(t, inst.Init())
+	info, err := os.Stat(inst.WAL.segmentPath(2))
+	assert.Nil(t, err)
+	assert.NotEqual(t, int64(0), info.Size())
+}
+
+func TestWALInvalidSyncPolicy(t *testing.T) {
+	wal := NewWAL(util.NewLogger("fatal"), os.TempDir(), "sometimes", 0)
+
+	assert.NotNil(t, wal.Open(0, func(*WALRecord) {}))
+}
@@ -6,10 +6,11 @@ import (
 	"github.com/tomdionysus/trinity/config"
 	"github.com/tomdionysus/trinity/kvstore"
 	"github.com/tomdionysus/trinity/network"
+	"github.com/tomdionysus/trinity/packets"
 	"github.com/tomdionysus/trinity/util"
 
-	// "github.com/tomdionysus/trinity/packets"
 	"os"
+	"time"
 )
 
 func main() {
@@ -30,8 +31,60 @@ func main() {
 	}
 
 	// Key/Value Store
-	kv := kvstore.NewKVStore(logger)
-	kv.Init()
+	var kv *kvstore.KVStore
+	switch *config.Storage {
+	case kvstore.StorageBlock:
+		dio := kvstore.NewDiskIO(*config.StorageDevice, uint(*config.StorageBlockSize))
+		if *config.DataKey != "" {
+			keys, err := kvstore.LoadDataKeys(*config.DataKey)
+			if err != nil {
+				logger.Error("Main", "Cannot Load Data Key: %s", err.Error())
+				os.Exit(-1)
+			}
+			dio.Keys = keys
+			logger.Info("Main", "Storage Encrypted with Data Key %d", keys.Current())
+		}
+		err := dio.Open()
+		if err != nil {
+			logger.Error("Main", "Cannot Open Storage Device '%s': %s", *config.StorageDevice, err.Error())
+			os.Exit(-1)
+		}
+		blocks := kvstore.NewBlockStore(logger, dio)
+		err = blocks.Open(*config.StorageFormat)
+		if err != nil {
+			logger.Error("Main", "Cannot Open Block Store '%s': %s", *config.StorageDevice, err.Error())
+			os.Exit(-1)
+		}
+		kv = kvstore.NewBlockKVStore(logger, blocks)
+		if dio.Keys != nil {
+			// Rewrite blocks encrypted with older keys in the background
+			go func() {
+				_, err := blocks.Reencrypt()
+				if err != nil {
+					logger.Error("Main", "Re-encryption Failed: %s", err.Error())
+				}
+			}()
+		}
+	case kvstore.StorageBPlusTree:
+		kv = kvstore.NewBPlusTreeKVStore(logger)
+	default:
+		kv = kvstore.NewKVStore(logger)
+	}
+	kv.MaxMemory = int64(*config.MaxMemory) * 1024 * 1024
+	kv.EvictionPolicy = *config.EvictionPolicy
+	kv.CompressThreshold = *config.CompressThreshold
+	for name, quota := range config.KeyspaceQuotas {
+		kv.SetKeyspaceQuota(name, int64(quota)*1024*1024)
+	}
+	if *config.DataDir != "" {
+		kv.WAL = kvstore.NewWAL(logger, *config.DataDir, *config.WALSync, time.Duration(*config.WALSyncInterval)*time.Millisecond)
+		kv.Snapshots = kvstore.NewSnapshotter(logger, *config.DataDir, time.Duration(*config.SnapshotInterval)*time.Second, 2)
+	}
+	err := kv.Init()
+	if err != nil {
+		logger.Error("Main", "Cannot Initialise KV Store: %s", err.Error())
+		os.Exit(-1)
+	}
 	kv.Start()
 
 	// Banner
@@ -45,13 +98,15 @@ func main() {
 	logger.Debug("Config", "Port: %d", *config.Port)
 	logger.Debug("Config", "Advertise: %s", *config.HostAddr)
 	logger.Debug("Config", "LogLevel: %s (%d)", *config.LogLevel, logger.LogLevel)
+	logger.Debug("Config", "Storage: %s", *config.Storage)
+	logger.Debug("Config", "Data Directory: %s", *config.DataDir)
 	if *config.DisableHeartbeat {
 		logger.Debug("Config", "Heartbeat disabled on this instance, be carefull with system reliability")
 	}
 
 	// CA
 	capool := network.NewCAPool(logger)
-	err := capool.LoadPEM(*config.CA)
+	err = capool.LoadPEM(*config.CA)
 	if err != nil {
 		logger.Error("Main", "Cannot Load CA '%s': %s", *config.CA, err.Error())
 		os.Exit(-1)
@@ -60,6 +115,25 @@ func main() {
 
 	// Server
 	svr := network.NewTLSServer(logger, capool, kv, *config.HostAddr, *config.DisableHeartbeat)
+	svr.CompressThreshold = *config.CompressThreshold
+	svr.ReplicationFactor = *config.ReplicationFactor
+	svr.Consistency, _ = packets.ParseConsistency(*config.Consistency)
+	svr.ReadQuorum = *config.ReadQuorum
+	svr.WriteQuorum = *config.WriteQuorum
+	svr.ReadRepairChance = *config.ReadRepairChance
+	svr.Hints.Window = time.Duration(*config.HintWindow) * time.Second
+	svr.AntiEntropyInterval = time.Duration(*config.AntiEntropyInterval) * time.Second
+	svr.AntiEntropyRate = *config.AntiEntropyRate
+	svr.RereplicationDelay = time.Duration(*config.RereplicationDelay) * time.Second
+	if *config.DataDir != "" {
+		err = svr.Hints.Open(*config.DataDir)
+		if err != nil {
+			logger.Error("Main", "Cannot Open Hints: %s", err.Error())
+			os.Exit(-1)
+		}
+	}
+	svr.Hints.Start()
+	kv.OnCorruption = svr.RepairKey
 	logger.Info("Main", "Trinity Node ID %02X", svr.ServerNode.ID)
 
 	// Certificate
@@ -77,13 +151,21 @@ func main() {
 		os.Exit(-1)
 	}
 
-	var memcache *network.MemcacheServer
+	memcaches := []*network.MemcacheServer{}
 
-	// Memcache
+	// Memcache, on the default port and a port for each keyspace
 	if *config.MemcacheEnabled {
-		memcache = network.NewMemcacheServer(logger, *config.MemcachePort, svr)
+		memcache := network.NewMemcacheServer(logger, *config.MemcachePort, svr)
 		memcache.Init()
 		memcache.Start()
+		memcaches = append(memcaches, memcache)
+		for name, port := range config.MemcacheKeyspaces {
+			memcache := network.NewMemcacheServer(logger, port, svr)
+			memcache.Keyspace = name
+			memcache.Init()
+			memcache.Start()
+			memcaches = append(memcaches, memcache)
+		}
 	}
 
 	for _, remoteAddr := range config.Nodes {
@@ -91,10 +173,10 @@ func main() {
 		svr.ConnectTo(remoteAddr)
 	}
 
-	TrinityMainLoop(svr, logger)
+	TrinityMainLoop(svr, kv, logger)
 
 	// Shutdown Memcache
-	if memcache != nil {
+	for _, memcache := range memcaches {
 		memcache.Stop()
 	}
 
@@ -102,8 +184,19 @@ func main() {
 	svr.Stop()
 	_ = <-svr.StatusChannel
 
+	// Shutdown Hints
+	svr.Hints.Stop()
+	err = svr.Hints.Close()
+	if err != nil {
+		logger.Error("Main", "Cannot Close Hints: %s", err.Error())
+	}
+
 	// Shutdown KV Store
 	kv.Stop()
+	err = kv.Close()
+	if err != nil {
+		logger.Error("Main", "Cannot Close KV Store: %s", err.Error())
+	}
 
 	logger.Info("Main", "Shutdown Complete, exiting")
 	os.Exit(0)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/tomdionysus/trinity/kvstore"
 	"github.com/tomdionysus/trinity/network"
 	"github.com/tomdionysus/trinity/util"
 	"os"
@@ -9,23 +10,47 @@ import (
 )
 
 // TrinityMainLoop for Linux (No SIGINFO)
-func TrinityMainLoop(svr *network.TLSServer, logger *util.Logger) {
-	// Notify SIGINT, SIGTERM
+func TrinityMainLoop(svr *network.TLSServer, kv *kvstore.KVStore, logger *util.Logger) {
+	// Notify SIGINT, SIGTERM, SIGUSR1 (Snapshot), SIGUSR2 (Decommission)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGUSR1)
+	signal.Notify(c, syscall.SIGUSR2)
+	decommissioned := make(chan bool, 1)
 
 	// Wait for SIGINT
 	for {
 		select {
 		case sig := <-c:
 			switch sig {
+			case syscall.SIGUSR1:
+				logger.Info("Main", "Signal %d received, writing snapshot", sig)
+				go func() {
+					err := kv.Snapshot()
+					if err != nil {
+						logger.Error("Main", "Snapshot Failed: %s", err.Error())
+					}
+				}()
+			case syscall.SIGUSR2:
+				logger.Info("Main", "Signal %d received, decommissioning", sig)
+				go func() {
+					err := svr.Decommission()
+					if err != nil {
+						logger.Error("Main", "Decommission Failed: %s", err.Error())
+						return
+					}
+					decommissioned <- true
+				}()
 			case os.Interrupt:
 				fallthrough
 			case syscall.SIGTERM:
 				logger.Info("Main", "Signal %d received, shutting down", sig)
 				return
 			}
+		case <-decommissioned:
+			logger.Info("Main", "Decommissioned, shutting down")
+			return
 		}
 	}
 }
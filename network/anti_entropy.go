@@ -0,0 +1,245 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// DefaultAntiEntropyRate is the maximum number of keys per second anti-entropy repairs unless AntiEntropyRate
+// is set.
+const DefaultAntiEntropyRate = 100
+
+// merkleReplica is the other side of an anti-entropy exchange, or of a rebalance.
+type merkleReplica interface {
+	// hashes returns the hashes of the nodes at the level with the given indices of the replica's Merkle tree.
+	hashes(level int, indices []uint32) ([][16]byte, error)
+	// keys returns the keys in the given leaves of the replica's Merkle tree, with their versions and tombstones
+	// but not their values.
+	keys(leaves []uint32) ([]*kvstore.Item, error)
+	// get returns the replica's copy of a key, which may be a tombstone.
+	get(key string) (*kvstore.Item, error)
+	// put writes a copy of a key, which may be a tombstone, to the replica.
+	put(item *kvstore.Item) error
+}
+
+// AntiEntropyRepairs returns the number of keys that have been repaired by anti-entropy.
+func (svr *TLSServer) AntiEntropyRepairs() uint64 {
+	return atomic.LoadUint64(&svr.antiEntropyRepairs)
+}
+
+// antiEntropy runs anti-entropy with every connected peer each AntiEntropyInterval until stop is closed.
+func (svr *TLSServer) antiEntropy(stop chan bool) {
+	ticker := time.NewTicker(svr.AntiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for id, peer := range svr.Connections() {
+			if !peer.Available() {
+				continue
+			}
+			_, err := svr.AntiEntropy(id)
+			if err != nil {
+				svr.Logger.Warn("Server", "AntiEntropy: with %02X Failed: %s", id, err.Error())
+			}
+		}
+	}
+}
+
+// AntiEntropy compares the keys this node shares with a connected peer and repairs those that differ, returning
+// how many were repaired. The Merkle trees of the shared keys are compared from the root down, and only the keys
+// in the leaves that differ are exchanged. Each key is brought up to date on whichever side holds an older copy,
+// or none, at no more than AntiEntropyRate keys per second.
+func (svr *TLSServer) AntiEntropy(id ch.NodeId) (int, error) {
+	return svr.syncReplica(id, &remoteReplica{svr: svr, id: id})
+}
+
+// syncReplica runs anti-entropy with the replica with the given ID.
+func (svr *TLSServer) syncReplica(id ch.NodeId, replica merkleReplica) (int, error) {
+	tree := svr.buildMerkleTree(id)
+
+	// Descend the trees while they differ
+	indices := []uint32{0}
+	for level := 0; level <= MerkleDepth && len(indices) > 0; level++ {
+		remote, err := replica.hashes(level, indices)
+		if err != nil {
+			return 0, err
+		}
+		if len(remote) != len(indices) {
+			return 0, errors.New("Unexpected Merkle Reply")
+		}
+		differ := []uint32{}
+		for i, index := range indices {
+			if remote[i] != tree.levels[level][index] {
+				differ = append(differ, index)
+			}
+		}
+		if level == MerkleDepth {
+			indices = differ
+			break
+		}
+		indices = indices[:0]
+		for _, index := range differ {
+			indices = append(indices, 2*index, 2*index+1)
+		}
+	}
+	if len(indices) == 0 {
+		svr.Logger.Debug("Server", "AntiEntropy: In sync with %02X", id)
+		return 0, nil
+	}
+
+	// Compare the keys in the leaves that differ
+	remote, err := replica.keys(indices)
+	if err != nil {
+		return 0, err
+	}
+	local := svr.leafItems(id, indices)
+	repaired := 0
+	for _, theirs := range remote {
+		ours, found := local[theirs.Key]
+		delete(local, theirs.Key)
+		switch {
+		case !found || theirs.Version > ours.Version:
+			err = svr.pullFrom(replica, theirs.Key)
+		case ours.Version > theirs.Version:
+			err = svr.pushTo(replica, ours)
+		default:
+			continue
+		}
+		if err != nil {
+			svr.Logger.Warn("Server", "AntiEntropy: [%s] with %02X Failed: %s", theirs.Key, id, err.Error())
+			continue
+		}
+		repaired++
+	}
+	for _, ours := range local {
+		err = svr.pushTo(replica, ours)
+		if err != nil {
+			svr.Logger.Warn("Server", "AntiEntropy: [%s] with %02X Failed: %s", ours.Key, id, err.Error())
+			continue
+		}
+		repaired++
+	}
+	svr.Logger.Info("Server", "AntiEntropy: Repaired %d keys in %d leaves with %02X", repaired, len(indices), id)
+	return repaired, nil
+}
+
+// pullFrom replaces the local copy of the key with the replica's.
+func (svr *TLSServer) pullFrom(replica merkleReplica, key string) error {
+	svr.throttleAntiEntropy()
+	item, err := replica.get(key)
+	if err != nil {
+		return err
+	}
+	if item.Tombstone {
+		_, _, err = svr.KVStore.DeleteVersion(key, item.Version)
+	} else {
+		_, err = svr.KVStore.SetVersion(key, item.Data, item.Flags, item.ExpiresAt, item.Version)
+	}
+	if err == nil {
+		atomic.AddUint64(&svr.antiEntropyRepairs, 1)
+	}
+	return err
+}
+
+// pushTo writes the local copy of the key to the replica.
+func (svr *TLSServer) pushTo(replica merkleReplica, item *kvstore.Item) error {
+	svr.throttleAntiEntropy()
+	err := replica.put(item)
+	if err == nil {
+		atomic.AddUint64(&svr.antiEntropyRepairs, 1)
+	}
+	return err
+}
+
+// throttleAntiEntropy waits long enough between keys to keep to AntiEntropyRate.
+func (svr *TLSServer) throttleAntiEntropy() {
+	if svr.AntiEntropyRate > 0 {
+		time.Sleep(time.Second / time.Duration(svr.AntiEntropyRate))
+	}
+}
+
+// remoteReplica is a connected peer in an anti-entropy exchange or a rebalance.
+type remoteReplica struct {
+	svr *TLSServer
+	id  ch.NodeId
+}
+
+func (rr *remoteReplica) send(command uint16, payload interface{}) (interface{}, error) {
+	peer, found := rr.svr.ConnectionGet(rr.id)
+	if !found || !peer.Available() {
+		return nil, errPeerUnavailable
+	}
+	reply, err := peer.SendPacketWaitReply(packets.NewPacket(command, payload), 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return merkleReply(reply)
+}
+
+// merkleReply returns the payload of a reply to a Merkle request, or the error the peer replied with.
+func merkleReply(reply *packets.Packet) (interface{}, error) {
+	switch reply.Command {
+	case packets.CMD_KVSTORE_ACK:
+		return reply.Payload, nil
+	case packets.CMD_KVSTORE_ERROR:
+		message, _ := reply.Payload.(string)
+		return nil, remoteError(message)
+	}
+	return nil, fmt.Errorf("Unknown Reply Command %d", reply.Command)
+}
+
+func (rr *remoteReplica) hashes(level int, indices []uint32) ([][16]byte, error) {
+	reply, err := rr.send(packets.CMD_MERKLE_HASHES, packets.MerkleHashesPacket{Level: level, Indices: indices})
+	if err != nil {
+		return nil, err
+	}
+	hashes, ok := reply.(packets.MerkleHashesPacket)
+	if !ok {
+		return nil, errors.New("Unexpected Merkle Reply")
+	}
+	return hashes.Hashes, nil
+}
+
+func (rr *remoteReplica) keys(leaves []uint32) ([]*kvstore.Item, error) {
+	reply, err := rr.send(packets.CMD_MERKLE_KEYS, packets.MerkleKeysPacket{Leaves: leaves})
+	if err != nil {
+		return nil, err
+	}
+	keys, ok := reply.(packets.MerkleKeysPacket)
+	if !ok {
+		return nil, errors.New("Unexpected Merkle Reply")
+	}
+	items := make([]*kvstore.Item, len(keys.Items))
+	for i, kvpacket := range keys.Items {
+		if err := unpackKeyspace(&kvpacket); err != nil {
+			return nil, err
+		}
+		items[i] = &kvstore.Item{Key: kvpacket.Key, Version: kvpacket.Version, Tombstone: kvpacket.Command == packets.CMD_KVSTORE_DELETE}
+	}
+	return items, nil
+}
+
+func (rr *remoteReplica) get(key string) (*kvstore.Item, error) {
+	return rr.svr.remoteGet(rr.id, key)
+}
+
+func (rr *remoteReplica) put(item *kvstore.Item) error {
+	mode := rr.svr.consistency(0)
+	var err error
+	if item.Tombstone {
+		_, _, err = rr.svr.remoteDelete(mode, rr.id, item.Key, item.Version)
+	} else {
+		_, err = rr.svr.remoteSet(mode, rr.id, item.Key, item.Data, item.Flags, item.ExpiresAt, item.Version)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package network
+
+import (
+	"fmt"
+	"time"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// setLeaving records that the node is being decommissioned.
+func (svr *TLSServer) setLeaving(id ch.NodeId) {
+	svr.syncMutex.Lock()
+	svr.leaving[id] = true
+	svr.syncMutex.Unlock()
+}
+
+// clearLeaving records that the node is no longer being decommissioned.
+func (svr *TLSServer) clearLeaving(id ch.NodeId) {
+	svr.syncMutex.Lock()
+	delete(svr.leaving, id)
+	svr.syncMutex.Unlock()
+}
+
+// isLeaving returns true if the node is being decommissioned.
+func (svr *TLSServer) isLeaving(id ch.NodeId) bool {
+	svr.syncMutex.Lock()
+	defer svr.syncMutex.Unlock()
+	return svr.leaving[id]
+}
+
+// Decommission prepares this node to leave the cluster without losing its copies of keys. It marks the node as
+// leaving and waits for every peer to acknowledge it, so that writes also go to the nodes that will inherit its
+// keys. Then it sends every key and tombstone it holds to the nodes that will inherit them, waiting for each to
+// acknowledge it. Once it returns without error the node can be stopped, and its peers deregister it from their
+// circles as it disconnects. If a peer or an inheritor does not acknowledge, an error is returned and the node
+// stays in the cluster as before, telling the peers that acknowledged it so, and Decommission can be retried.
+func (svr *TLSServer) Decommission() error {
+	svr.Logger.Info("Server", "Decommission: Leaving the cluster")
+	svr.setLeaving(svr.ServerNode.ID)
+	acknowledged := []*Peer{}
+	for id, peer := range svr.Connections() {
+		if !peer.Available() {
+			continue
+		}
+		err := svr.sendNodePacket(peer, packets.CMD_NODE_LEAVING)
+		if err != nil {
+			svr.cancelDecommission(acknowledged)
+			return fmt.Errorf("Peer %02X did not acknowledge leaving: %s", id, err.Error())
+		}
+		acknowledged = append(acknowledged, peer)
+	}
+
+	sent, failed := svr.drain(func(id ch.NodeId) merkleReplica {
+		return &remoteReplica{svr: svr, id: id}
+	})
+	if failed > 0 {
+		svr.cancelDecommission(acknowledged)
+		return fmt.Errorf("%d keys could not be sent to their new replicas", failed)
+	}
+	svr.Logger.Info("Server", "Decommission: Sent %d keys to their new replicas", sent)
+	return nil
+}
+
+// cancelDecommission marks this node as no longer leaving, and tells the peers that acknowledged it was leaving
+// that it is staying.
+func (svr *TLSServer) cancelDecommission(peers []*Peer) {
+	svr.Logger.Warn("Server", "Decommission: Cancelled, Staying in the cluster")
+	svr.clearLeaving(svr.ServerNode.ID)
+	for _, peer := range peers {
+		err := svr.sendNodePacket(peer, packets.CMD_NODE_STAYING)
+		if err != nil {
+			svr.Logger.Warn("Server", "Decommission: Peer %02X did not acknowledge staying: %s", peer.ServerNetworkNode.ID, err.Error())
+		}
+	}
+}
+
+// sendNodePacket sends a packet with the command and no payload to the peer, and waits for it to be acknowledged.
+func (svr *TLSServer) sendNodePacket(peer *Peer, command uint16) error {
+	reply, err := peer.SendPacketWaitReply(packets.NewPacket(command, nil), 5*time.Second)
+	if err == nil && reply.Command != packets.CMD_KVSTORE_ACK {
+		err = fmt.Errorf("Unknown Reply Command %d", reply.Command)
+	}
+	return err
+}
+
+// drain sends every key and tombstone this node is a replica of to the nodes that will be replicas of it once
+// this node has left, returning the number of copies sent and the number that failed.
+func (svr *TLSServer) drain(replica func(id ch.NodeId) merkleReplica) (int, int) {
+	sent, failed := 0, 0
+	cursor := svr.KVStore.Scan(kvstore.ScanOptions{Tombstones: true})
+	for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+		keymd5 := ch.NewMD5Key(item.Key)
+		current := map[ch.NodeId]bool{}
+		for _, node := range svr.ServerNode.GetNodesFor(keymd5, svr.ReplicationFactor) {
+			current[node.ID] = true
+		}
+		if !current[svr.ServerNode.ID] {
+			continue
+		}
+		for _, id := range svr.replicasFor(keymd5) {
+			if current[id] {
+				continue
+			}
+			err := replica(id).put(item)
+			if err != nil {
+				svr.Logger.Warn("Server", "Decommission: [%s] to %02X Failed: %s", item.Key, id, err.Error())
+				failed++
+				continue
+			}
+			sent++
+		}
+	}
+	return sent, failed
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestReplicasForLeaving(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	a.ServerNode.RegisterNode(&b.ServerNode.ServerNetworkNode)
+	a.ReplicationFactor = 1
+	keymd5 := ch.NewMD5Key("key")
+	owner := a.replicasFor(keymd5)
+	assert.Equal(t, 1, len(owner))
+
+	// The node that will inherit the key follows the leaving node
+	a.setLeaving(owner[0])
+	replicas := a.replicasFor(keymd5)
+	assert.Equal(t, 2, len(replicas))
+	assert.Equal(t, owner[0], replicas[0])
+
+	// Until it has gone
+	a.ConnectionClear(owner[0])
+	assert.Equal(t, owner, a.replicasFor(keymd5))
+}
+
+func TestDrain(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	a.ServerNode.RegisterNode(&b.ServerNode.ServerNetworkNode)
+	b.ServerNode.RegisterNode(&a.ServerNode.ServerNetworkNode)
+	a.ReplicationFactor, b.ReplicationFactor = 1, 1
+
+	owned := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if a.isReplica(ch.NewMD5Key(key), a.ServerNode.ID) {
+			a.KVStore.SetVersion(key, []byte("value"), 0, nil, 10)
+			owned++
+		}
+	}
+	a.KVStore.DeleteVersion("deleted", 0)
+	if a.isReplica(ch.NewMD5Key("deleted"), a.ServerNode.ID) {
+		owned++
+	}
+
+	a.setLeaving(a.ServerNode.ID)
+	sent, failed := a.drain(func(id ch.NodeId) merkleReplica {
+		assert.Equal(t, b.ServerNode.ID, id)
+		return &localReplica{svr: b, requester: a.ServerNode.ID}
+	})
+	assert.Equal(t, owned, sent)
+	assert.Equal(t, 0, failed)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		assert.Equal(t, a.KVStore.IsSet(key), b.KVStore.IsSet(key))
+	}
+
+	// Sends to an unavailable node fail
+	sent, failed = a.drain(func(id ch.NodeId) merkleReplica {
+		return &remoteReplica{svr: a, id: id}
+	})
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, owned, failed)
+}
+
+func TestDecommissionFailure(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	c := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "c", false)
+	a.ReplicationFactor, b.ReplicationFactor = 1, 1
+	_, peer := connectServers(a, b)
+
+	// c inherits some of a's keys, but cannot be reached
+	a.ServerNode.RegisterNode(&c.ServerNode.ServerNetworkNode)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if a.isReplica(ch.NewMD5Key(key), a.ServerNode.ID) {
+			a.KVStore.SetVersion(key, []byte("value"), 0, nil, 10)
+		}
+	}
+	assert.NotNil(t, a.Decommission())
+
+	// a stays, and b, which acknowledged that it was leaving, is told so
+	assert.False(t, a.isLeaving(a.ServerNode.ID))
+	assert.False(t, b.isLeaving(a.ServerNode.ID))
+	assert.Equal(t, uint(PeerStateConnected), peer.State())
+	assert.Equal(t, 1, len(a.replicasFor(ch.NewMD5Key("key"))))
+}
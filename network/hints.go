@@ -0,0 +1,508 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/util"
+)
+
+// DefaultHintWindow is how long a hint is kept for an unavailable node unless the HintStore Window is set.
+const DefaultHintWindow = 3 * time.Hour
+
+// HintExpiryTick is the interval between checks for expired hints.
+const HintExpiryTick = time.Minute
+
+// hintsFile is the name of the hint log in the data directory.
+const hintsFile = "hints.log"
+
+// hintMaxRecordSize bounds a single hint so a corrupt length field can't cause a huge allocation.
+const hintMaxRecordSize = 64 * 1024 * 1024
+
+// Hint is a write that a replica missed while it was unavailable, kept to be replayed when it reconnects.
+type Hint struct {
+	Target    ch.NodeId
+	Key       string
+	Data      []byte
+	Flags     int16
+	ExpiresAt *time.Time
+	Version   uint64
+	Tombstone bool
+	CreatedAt time.Time
+}
+
+// HintStore holds the hints for unavailable nodes. Without a data directory hints are kept in memory only.
+// Otherwise they are appended to a hint log, which is rewritten when hints are replayed or expire.
+//
+// Each record in the log is [uint32 length][uint32 CRC32C][gob encoded Hint], big endian.
+type HintStore struct {
+	Logger *util.Logger
+	// Window is how long a hint is kept before it expires.
+	Window time.Duration
+
+	dir     string
+	file    *os.File
+	hints   map[ch.NodeId][]*Hint
+	running bool
+	mutex   sync.Mutex
+}
+
+// NewHintStore returns a new in-memory HintStore keeping hints for the given window.
+func NewHintStore(logger *util.Logger, window time.Duration) *HintStore {
+	inst := &HintStore{
+		Logger: logger,
+		Window: window,
+		hints:  map[ch.NodeId][]*Hint{},
+	}
+	return inst
+}
+
+// Open loads the unexpired hints in the hint log in the given directory, and appends new hints to it. A torn or
+// corrupt record at the end of the log is dropped with a warning.
+func (hs *HintStore) Open(dir string) error {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	hs.dir = dir
+	count, err := hs.load()
+	if err != nil {
+		return err
+	}
+	hs.expire(time.Now())
+	err = hs.rewrite()
+	if err != nil {
+		return err
+	}
+	hs.Logger.Info("Hints", "Loaded %d hints (%d pending)", count, hs.count())
+	return nil
+}
+
+// Close closes the hint log.
+func (hs *HintStore) Close() error {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if hs.file == nil {
+		return nil
+	}
+	err := hs.file.Close()
+	hs.file = nil
+	return err
+}
+
+// Start expires hints older than the window every HintExpiryTick.
+func (hs *HintStore) Start() {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if hs.running {
+		return
+	}
+	hs.running = true
+	go func() {
+		for hs.isRunning() {
+			time.Sleep(HintExpiryTick)
+			hs.Expire()
+		}
+	}()
+}
+
+// Stop stops the expiry of hints.
+func (hs *HintStore) Stop() {
+	hs.mutex.Lock()
+	hs.running = false
+	hs.mutex.Unlock()
+}
+
+func (hs *HintStore) isRunning() bool {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return hs.running
+}
+
+// Add stores a hint, syncing it to the hint log if there is one.
+func (hs *HintStore) Add(hint *Hint) error {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	hs.hints[hint.Target] = append(hs.hints[hint.Target], hint)
+	if hs.file == nil {
+		return nil
+	}
+	err := writeHint(hs.file, hint)
+	if err == nil {
+		err = hs.file.Sync()
+	}
+	return err
+}
+
+// Peek returns the unexpired hints for a node, oldest first, keeping them until they are removed with Remove.
+func (hs *HintStore) Peek(target ch.NodeId) []*Hint {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if hs.expire(time.Now()) > 0 {
+		hs.compact()
+	}
+	hints := hs.hints[target]
+	if len(hints) == 0 {
+		return nil
+	}
+	return append([]*Hint{}, hints...)
+}
+
+// Remove removes the given hints for a node, as returned by Peek, rewriting the hint log once. Hints added since
+// are kept. It returns how many were removed.
+func (hs *HintStore) Remove(target ch.NodeId, done []*Hint) int {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	remove := make(map[*Hint]bool, len(done))
+	for _, hint := range done {
+		remove[hint] = true
+	}
+	hints := hs.hints[target]
+	kept := []*Hint{}
+	for _, hint := range hints {
+		if !remove[hint] {
+			kept = append(kept, hint)
+		}
+	}
+	count := len(hints) - len(kept)
+	if count == 0 {
+		return 0
+	}
+	if len(kept) == 0 {
+		delete(hs.hints, target)
+	} else {
+		hs.hints[target] = kept
+	}
+	hs.compact()
+	return count
+}
+
+// Expire removes the hints older than the window, returning how many were removed.
+func (hs *HintStore) Expire() int {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	count := hs.expire(time.Now())
+	if count > 0 {
+		hs.Logger.Warn("Hints", "Expired %d hints", count)
+		hs.compact()
+	}
+	return count
+}
+
+// Pending returns the number of hints held for each node.
+func (hs *HintStore) Pending() map[ch.NodeId]int {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	result := make(map[ch.NodeId]int, len(hs.hints))
+	for target, hints := range hs.hints {
+		result[target] = len(hints)
+	}
+	return result
+}
+
+// expire removes the hints created before now less the window. The caller must hold the mutex.
+func (hs *HintStore) expire(now time.Time) int {
+	cutoff := now.Add(-hs.Window)
+	count := 0
+	for target, hints := range hs.hints {
+		kept := hints[:0]
+		for _, hint := range hints {
+			if hint.CreatedAt.After(cutoff) {
+				kept = append(kept, hint)
+			}
+		}
+		count += len(hints) - len(kept)
+		if len(kept) == 0 {
+			delete(hs.hints, target)
+		} else {
+			hs.hints[target] = kept
+		}
+	}
+	return count
+}
+
+// count returns the number of hints held. The caller must hold the mutex.
+func (hs *HintStore) count() int {
+	count := 0
+	for _, hints := range hs.hints {
+		count += len(hints)
+	}
+	return count
+}
+
+// compact rewrites the hint log, logging a failure, as the hints in memory are still correct. The caller must
+// hold the mutex.
+func (hs *HintStore) compact() {
+	if hs.dir == "" {
+		return
+	}
+	err := hs.rewrite()
+	if err != nil {
+		hs.Logger.Error("Hints", "Cannot Rewrite Hint Log: %s", err.Error())
+	}
+}
+
+// load reads the hint log into memory, returning the number of hints read. The caller must hold the mutex.
+func (hs *HintStore) load() (int, error) {
+	file, err := os.Open(filepath.Join(hs.dir, hintsFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	count := 0
+	for {
+		hint, err := readHint(reader)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			hs.Logger.Warn("Hints", "Hint Log is corrupt after %d hints, dropping the rest: %s", count, err.Error())
+			return count, nil
+		}
+		hs.hints[hint.Target] = append(hs.hints[hint.Target], hint)
+		count++
+	}
+}
+
+// rewrite replaces the hint log with the hints in memory and reopens it for appending. The caller must hold the
+// mutex.
+func (hs *HintStore) rewrite() error {
+	if hs.file != nil {
+		hs.file.Close()
+		hs.file = nil
+	}
+	path := filepath.Join(hs.dir, hintsFile)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, hints := range hs.hints {
+		for _, hint := range hints {
+			if err == nil {
+				err = writeHint(writer, hint)
+			}
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	hs.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// writeHint writes a hint record.
+func writeHint(writer io.Writer, hint *Hint) error {
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(hint)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[4:8], util.Checksum(payload.Bytes()))
+	_, err = writer.Write(append(header, payload.Bytes()...))
+	return err
+}
+
+// readHint reads a hint record, returning io.EOF at the end of the log.
+func readHint(reader io.Reader) (*Hint, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > hintMaxRecordSize {
+		return nil, errors.New("Hint record too large")
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, err
+	}
+	if util.Checksum(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("Hint record checksum mismatch")
+	}
+	hint := &Hint{}
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(hint)
+	return hint, err
+}
+
+// unavailable returns true if a write to a node failed because it could not be reached, rather than being
+// refused, so it should be hinted.
+func unavailable(err error) bool {
+	return err == errPeerUnavailable || err == errReplyTimeout
+}
+
+// downNode is a node that was lost, and since when.
+type downNode struct {
+	node  ch.ServerNetworkNode
+	since time.Time
+}
+
+// markDown records that the node was lost, so that the writes it would have been a replica of are hinted for it
+// until it reconnects or the hint window passes.
+func (svr *TLSServer) markDown(node *ch.ServerNetworkNode) {
+	svr.syncMutex.Lock()
+	svr.down[node.ID] = &downNode{node: *node, since: time.Now()}
+	svr.syncMutex.Unlock()
+}
+
+// downReplicas returns the lost nodes that would be replicas of the key if they were still on the circle. The lost
+// nodes are placed back on the circle, and the replicas of the key are the ReplicationFactor nodes that come first
+// after it.
+func (svr *TLSServer) downReplicas(keymd5 ch.Key) []ch.NodeId {
+	svr.syncMutex.Lock()
+	cutoff := time.Now().Add(-svr.Hints.Window)
+	nodes := []*ch.ServerNetworkNode{}
+	for id, down := range svr.down {
+		if down.since.Before(cutoff) {
+			delete(svr.down, id)
+			continue
+		}
+		node := down.node
+		nodes = append(nodes, &node)
+	}
+	svr.syncMutex.Unlock()
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	lost := len(nodes)
+	nodes = append(nodes, svr.ServerNode.GetNodesFor(keymd5, svr.ReplicationFactor)...)
+	distances := make(map[ch.NodeId]ch.Key, len(nodes))
+	for _, node := range nodes {
+		distances[node.ID] = ringDistance(keymd5, node)
+	}
+	ids := []ch.NodeId{}
+	for _, node := range nodes[:lost] {
+		// It is a replica if fewer than ReplicationFactor nodes come before it
+		own := distances[node.ID]
+		before := 0
+		for _, other := range nodes {
+			distance := distances[other.ID]
+			if other.ID != node.ID && bytes.Compare(distance[:], own[:]) < 0 {
+				before++
+			}
+		}
+		if before < svr.ReplicationFactor {
+			ids = append(ids, node.ID)
+		}
+	}
+	return ids
+}
+
+// ringDistance returns how far clockwise around the circle the first point of the node is from the key.
+func ringDistance(keymd5 ch.Key, node *ch.ServerNetworkNode) ch.Key {
+	nearest := ch.Key{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	for _, point := range node.Distribution {
+		// point - keymd5, modulo 2^128
+		var distance ch.Key
+		borrow := 0
+		for i := len(distance) - 1; i >= 0; i-- {
+			value := int(point[i]) - int(keymd5[i]) - borrow
+			borrow = 0
+			if value < 0 {
+				value += 256
+				borrow = 1
+			}
+			distance[i] = byte(value)
+		}
+		if bytes.Compare(distance[:], nearest[:]) < 0 {
+			nearest = distance
+		}
+	}
+	return nearest
+}
+
+// hint stores a hint of the write of the item, or its tombstone, for an unavailable node.
+func (svr *TLSServer) hint(id ch.NodeId, item *kvstore.Item) {
+	hint := &Hint{
+		Target:    id,
+		Key:       item.Key,
+		Data:      item.Data,
+		Flags:     item.Flags,
+		ExpiresAt: item.ExpiresAt,
+		Version:   item.Version,
+		Tombstone: item.Tombstone,
+		CreatedAt: time.Now(),
+	}
+	err := svr.Hints.Add(hint)
+	if err != nil {
+		svr.Logger.Error("Server", "Hint: [%s] for %02X Failed: %s", item.Key, id, err.Error())
+		return
+	}
+	svr.Logger.Debug("Server", "Hint: [%s] for %02X (v%d)", item.Key, id, item.Version)
+}
+
+// PendingHints returns the number of hints held for each unavailable node.
+func (svr *TLSServer) PendingHints() map[ch.NodeId]int {
+	return svr.Hints.Pending()
+}
+
+// ReplayHints sends the hints held for a node to it, returning how many were delivered. It is called when the
+// node connects. Hints stay in the hint log until the node has acknowledged or refused them, and refused hints are
+// dropped, so if the node becomes unavailable again or this node stops the undelivered hints are kept.
+func (svr *TLSServer) ReplayHints(id ch.NodeId) int {
+	hints := svr.Hints.Peek(id)
+	mode := svr.consistency(0)
+	delivered := 0
+	done := []*Hint{}
+	for i, hint := range hints {
+		var err error
+		if hint.Tombstone {
+			_, _, err = svr.remoteDelete(mode, id, hint.Key, hint.Version)
+		} else {
+			_, err = svr.remoteSet(mode, id, hint.Key, hint.Data, hint.Flags, hint.ExpiresAt, hint.Version)
+		}
+		if unavailable(err) {
+			svr.Logger.Warn("Server", "ReplayHints: %02X Unavailable, keeping %d hints", id, len(hints)-i)
+			break
+		}
+		done = append(done, hint)
+		if err != nil {
+			svr.Logger.Warn("Server", "ReplayHints: [%s] on %02X Failed: %s", hint.Key, id, err.Error())
+			continue
+		}
+		delivered++
+	}
+	svr.Hints.Remove(id, done)
+	if len(hints) > 0 {
+		svr.Logger.Info("Server", "ReplayHints: Delivered %d of %d hints to %02X", delivered, len(hints), id)
+	}
+	return delivered
+}
@@ -0,0 +1,197 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestHintStore(t *testing.T) {
+	hs := NewHintStore(util.NewLogger("error"), time.Hour)
+	a, b := ch.NodeId(ch.NewMD5Key("a")), ch.NodeId(ch.NewMD5Key("b"))
+
+	assert.Nil(t, hs.Add(&Hint{Target: a, Key: "one", Version: 1, CreatedAt: time.Now()}))
+	assert.Nil(t, hs.Add(&Hint{Target: a, Key: "two", Version: 2, CreatedAt: time.Now()}))
+	assert.Nil(t, hs.Add(&Hint{Target: b, Key: "old", Version: 3, CreatedAt: time.Now().Add(-2 * time.Hour)}))
+	assert.Equal(t, map[ch.NodeId]int{a: 2, b: 1}, hs.Pending())
+
+	assert.Equal(t, 1, hs.Expire())
+	assert.Equal(t, map[ch.NodeId]int{a: 2}, hs.Pending())
+
+	hints := hs.Peek(a)
+	assert.Equal(t, 2, len(hints))
+	assert.Equal(t, "one", hints[0].Key)
+	assert.Equal(t, "two", hints[1].Key)
+	assert.Equal(t, map[ch.NodeId]int{a: 2}, hs.Pending())
+
+	// Only the given hints are removed, not those added since
+	assert.Nil(t, hs.Add(&Hint{Target: a, Key: "three", Version: 4, CreatedAt: time.Now()}))
+	assert.Equal(t, 2, hs.Remove(a, hints))
+	assert.Equal(t, "three", hs.Peek(a)[0].Key)
+	assert.Equal(t, 1, hs.Remove(a, hs.Peek(a)))
+	assert.Equal(t, map[ch.NodeId]int{}, hs.Pending())
+	assert.Nil(t, hs.Peek(a))
+}
+
+func TestHintStoreOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trinity-hints")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logger := util.NewLogger("error")
+	a, b := ch.NodeId(ch.NewMD5Key("a")), ch.NodeId(ch.NewMD5Key("b"))
+	expiry := time.Now().Add(time.Hour).Round(0)
+
+	hs := NewHintStore(logger, time.Hour)
+	assert.Nil(t, hs.Open(dir))
+	assert.Nil(t, hs.Add(&Hint{Target: a, Key: "one", Data: []byte("value"), Flags: 3, ExpiresAt: &expiry, Version: 1, CreatedAt: time.Now()}))
+	assert.Nil(t, hs.Add(&Hint{Target: b, Key: "two", Version: 2, Tombstone: true, CreatedAt: time.Now()}))
+	assert.Nil(t, hs.Add(&Hint{Target: b, Key: "old", Version: 3, CreatedAt: time.Now().Add(-2 * time.Hour)}))
+	assert.Equal(t, 1, hs.Remove(b, hs.Peek(b)))
+	assert.Nil(t, hs.Add(&Hint{Target: b, Key: "three", Version: 4, CreatedAt: time.Now()}))
+	assert.Nil(t, hs.Close())
+
+	// Hints survive a restart, except those removed
+	hs = NewHintStore(logger, time.Hour)
+	assert.Nil(t, hs.Open(dir))
+	assert.Equal(t, map[ch.NodeId]int{a: 1, b: 1}, hs.Pending())
+	hint := hs.Peek(a)[0]
+	assert.Equal(t, []byte("value"), hint.Data)
+	assert.Equal(t, int16(3), hint.Flags)
+	assert.True(t, expiry.Equal(*hint.ExpiresAt))
+	assert.Equal(t, uint64(1), hint.Version)
+	assert.Nil(t, hs.Close())
+
+	// Hints being replayed survive a restart until they are removed
+	hs = NewHintStore(logger, time.Hour)
+	assert.Nil(t, hs.Open(dir))
+	assert.Equal(t, 1, len(hs.Peek(a)))
+	assert.Nil(t, hs.Close())
+	hs = NewHintStore(logger, time.Hour)
+	assert.Nil(t, hs.Open(dir))
+	assert.Equal(t, 1, hs.Remove(a, hs.Peek(a)))
+	assert.Nil(t, hs.Close())
+
+	// A torn record at the end of the log is dropped
+	file, err := os.OpenFile(filepath.Join(dir, hintsFile), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	file.Write([]byte{0, 0, 1})
+	file.Close()
+	hs = NewHintStore(logger, time.Hour)
+	assert.Nil(t, hs.Open(dir))
+	assert.Equal(t, map[ch.NodeId]int{b: 1}, hs.Pending())
+	assert.Nil(t, hs.Close())
+}
+
+func TestReplayHints(t *testing.T) {
+	logger := util.NewLogger("error")
+	inst := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "HOSTNAME", false)
+	remote := ch.NodeId(ch.NewMD5Key("a"))
+
+	inst.hint(remote, &kvstore.Item{Key: "one", Data: []byte("value"), Version: 1})
+	inst.hint(remote, &kvstore.Item{Key: "two", Version: 2, Tombstone: true})
+	assert.Equal(t, map[ch.NodeId]int{remote: 2}, inst.PendingHints())
+
+	// The node is still unavailable, so the hints are kept
+	assert.Equal(t, 0, inst.ReplayHints(remote))
+	assert.Equal(t, map[ch.NodeId]int{remote: 2}, inst.PendingHints())
+
+	// Writes to an unavailable replica are hinted
+	ids := []ch.NodeId{inst.ServerNode.ID, remote}
+	_, err := inst.setKeyOn(packets.WRITE_COMMITTED, ids, "three", []byte("value"), 0, nil, 0, 2)
+	assert.Equal(t, ErrQuorumNotMet, err)
+	_, err = inst.deleteKeyOn(packets.WRITE_COMMITTED, ids, "one", 0, 2)
+	assert.Equal(t, ErrQuorumNotMet, err)
+	assert.Equal(t, map[ch.NodeId]int{remote: 4}, inst.PendingHints())
+	hints := inst.Hints.Peek(remote)
+	assert.Equal(t, "three", hints[2].Key)
+	assert.False(t, hints[2].Tombstone)
+	assert.Equal(t, "one", hints[3].Key)
+	assert.True(t, hints[3].Tombstone)
+	assert.NotEqual(t, uint64(0), hints[3].Version)
+}
+
+func TestHintLostNode(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	a.ReplicationFactor, b.ReplicationFactor = 2, 2
+	a.RereplicationDelay, b.RereplicationDelay = time.Hour, time.Hour
+	left, right := net.Pipe()
+	peer := pipePeer(a, b, left)
+	pipePeer(b, a, right)
+
+	// b is lost and leaves a's circle, but the writes it misses are hinted
+	peer.Disconnect()
+	left.Close()
+	for b.ServerNode.NodeRegistered(a.ServerNode.ID) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, a.ServerNode.NodeRegistered(b.ServerNode.ID))
+	set, err := a.SetKey("key", []byte("value"), 0, nil, WriteOptions{})
+	assert.Nil(t, err)
+	deleted, err := a.DeleteKey("deleted", WriteOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[ch.NodeId]int{b.ServerNode.ID: 2}, a.PendingHints())
+
+	// b reconnects, and the hints are replayed
+	left, right = net.Pipe()
+	pipePeer(a, b, left)
+	pipePeer(b, a, right)
+	assert.Equal(t, 2, a.ReplayHints(b.ServerNode.ID))
+	assert.Equal(t, map[ch.NodeId]int{}, a.PendingHints())
+	item, found := b.KVStore.GetItem("key")
+	assert.True(t, found)
+	assert.Equal(t, set.Version, item.Version)
+	tombstone, found := b.KVStore.Lookup("deleted")
+	assert.True(t, found && tombstone.Tombstone)
+	assert.Equal(t, deleted.Version, tombstone.Version)
+
+	// Writes are no longer hinted once it is back
+	_, err = a.SetKey("other", []byte("value"), 0, nil, WriteOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[ch.NodeId]int{}, a.PendingHints())
+}
+
+func TestDownReplicas(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	servers := []*TLSServer{}
+	for _, name := range []string{"b", "c", "d"} {
+		svr := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), name, false)
+		a.ServerNode.RegisterNode(&svr.ServerNode.ServerNetworkNode)
+		servers = append(servers, svr)
+	}
+	a.ReplicationFactor = 2
+
+	// The lost node is hinted exactly the keys it was a replica of
+	lost := &servers[0].ServerNode.ServerNetworkNode
+	replicaOf := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		for _, id := range a.replicasFor(ch.NewMD5Key(key)) {
+			replicaOf[key] = replicaOf[key] || id == lost.ID
+		}
+	}
+	a.ServerNode.DeregisterNode(lost)
+	a.markDown(lost)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		assert.Equal(t, replicaOf[key], len(a.downReplicas(ch.NewMD5Key(key))) == 1, key)
+	}
+
+	// Until the hint window passes
+	a.Hints.Window = 0
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, a.downReplicas(ch.NewMD5Key(fmt.Sprintf("key%d", i))))
+	}
+}
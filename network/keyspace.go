@@ -0,0 +1,61 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// DropKeyspace deletes every item in the keyspace on this node and every connected node, leaving other keyspaces
+// untouched. It returns the number of items deleted on this node and the first error from any other node. Nodes
+// that are unavailable keep their items until read repair, hinted handoff or anti-entropy copy them the tombstones
+// the drop leaves.
+func (svr *TLSServer) DropKeyspace(name string) (int, error) {
+	count := svr.KVStore.DropKeyspace(name)
+
+	var result error
+	for id, peer := range svr.Connections() {
+		if !peer.Available() {
+			continue
+		}
+		payload := packets.KVStorePacket{
+			Command:  packets.CMD_KVSTORE_DROP_KEYSPACE,
+			Keyspace: name,
+			TargetID: id,
+		}
+		reply, err := svr.sendKVStorePacket(id, payload)
+		if err == nil && reply.Command != packets.CMD_KVSTORE_ACK {
+			err = fmt.Errorf("Unknown Reply Command %d", reply.Command)
+		}
+		if err != nil {
+			svr.Logger.Warn("Server", "DropKeyspace: %s on Peer %02X Failed: %s", name, id, err.Error())
+			if result == nil {
+				result = err
+			}
+		}
+	}
+	return count, result
+}
+
+// packKeyspace moves the keyspace of a stored key into the Keyspace field of a packet before it is sent.
+func packKeyspace(payload *packets.KVStorePacket) {
+	if payload.Command == packets.CMD_KVSTORE_DROP_KEYSPACE {
+		return
+	}
+	payload.Keyspace, payload.Key = kvstore.SplitKeyspaceKey(payload.Key)
+}
+
+// unpackKeyspace restores the stored key of a received packet, returning kvstore.ErrInvalidKey if the key or
+// keyspace is not valid.
+func unpackKeyspace(payload *packets.KVStorePacket) error {
+	if payload.Command == packets.CMD_KVSTORE_DROP_KEYSPACE {
+		return nil
+	}
+	key, err := kvstore.KeyspaceKey(payload.Keyspace, payload.Key)
+	if err != nil {
+		return err
+	}
+	payload.Key = key
+	return nil
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestPackKeyspace(t *testing.T) {
+	stored, _ := kvstore.KeyspaceKey("sessions", "key")
+	payload := packets.KVStorePacket{Command: packets.CMD_KVSTORE_GET, Key: stored}
+	packKeyspace(&payload)
+	assert.Equal(t, "sessions", payload.Keyspace)
+	assert.Equal(t, "key", payload.Key)
+	assert.Nil(t, unpackKeyspace(&payload))
+	assert.Equal(t, stored, payload.Key)
+
+	payload = packets.KVStorePacket{Command: packets.CMD_KVSTORE_GET, Key: "key"}
+	packKeyspace(&payload)
+	assert.Equal(t, kvstore.DefaultKeyspace, payload.Keyspace)
+	unpackKeyspace(&payload)
+	assert.Equal(t, "key", payload.Key)
+
+	payload = packets.KVStorePacket{Command: packets.CMD_KVSTORE_DROP_KEYSPACE, Keyspace: "sessions"}
+	packKeyspace(&payload)
+	unpackKeyspace(&payload)
+	assert.Equal(t, "sessions", payload.Keyspace)
+	assert.Equal(t, "", payload.Key)
+
+	// A peer cannot reach into another keyspace
+	payload = packets.KVStorePacket{Command: packets.CMD_KVSTORE_GET, Keyspace: kvstore.DefaultKeyspace, Key: stored}
+	assert.Equal(t, kvstore.ErrInvalidKey, unpackKeyspace(&payload))
+}
+
+func TestMemcacheKeyspaceEscape(t *testing.T) {
+	logger := util.NewLogger("error")
+	svr := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	stored, _ := kvstore.KeyspaceKey("tenant", "secret")
+	svr.KVStore.Set(stored, []byte("private"), 0, nil)
+	mcs := NewMemcacheServer(logger, 0, svr)
+
+	command := func(input string, args ...string) string {
+		var out bytes.Buffer
+		writer := bufio.NewWriter(&out)
+		mcs.handleCommand("test", bufio.NewReader(strings.NewReader(input)), writer, args)
+		return out.String()
+	}
+
+	// The default keyspace cannot get, set or delete the items of a named keyspace
+	assert.Equal(t, "CLIENT_ERROR bad command line format\r\n", command("", "get", stored))
+	assert.Equal(t, "CLIENT_ERROR bad command line format\r\n", command("", "delete", stored))
+	assert.Equal(t, "CLIENT_ERROR bad command line format\r\n", command("stolen\r\n", "set", stored, "0", "0", "6"))
+	assert.Equal(t, "CLIENT_ERROR bad command line format\r\n", command("", "incr", stored, "1"))
+	value, _, ok := svr.KVStore.Get(stored)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("private"), value)
+
+	// Valid keys still work
+	assert.Equal(t, "STORED\r\n", command("value\r\n", "set", "key", "0", "0", "5"))
+	assert.Equal(t, "VALUE key 0 5\r\nvalue\r\nEND\r\n", command("", "get", "key"))
+}
+
+func TestDropKeyspaceReplicaDown(t *testing.T) {
+	a, b := newReplicaPair()
+	for _, key := range []string{"1", "2", "3"} {
+		stored, _ := kvstore.KeyspaceKey("tenant", key)
+		a.KVStore.SetVersion(stored, []byte("value"), 0, nil, 10)
+		b.KVStore.SetVersion(stored, []byte("value"), 0, nil, 10)
+	}
+	a.KVStore.SetVersion("other", []byte("value"), 0, nil, 10)
+	b.KVStore.SetVersion("other", []byte("value"), 0, nil, 10)
+
+	// b is down, so only a drops the keyspace
+	count, err := a.DropKeyspace("tenant")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	// When b returns, anti-entropy drops its copies rather than copying them back
+	_, err = a.syncReplica(b.ServerNode.ID, &localReplica{svr: b, requester: a.ServerNode.ID})
+	assert.Nil(t, err)
+	for _, key := range []string{"1", "2", "3"} {
+		stored, _ := kvstore.KeyspaceKey("tenant", key)
+		assert.False(t, a.KVStore.IsSet(stored))
+		assert.False(t, b.KVStore.IsSet(stored))
+	}
+	assert.True(t, b.KVStore.IsSet("other"))
+	assert.Equal(t, uint64(0), b.KVStore.Keyspaces()["tenant"].Items)
+}
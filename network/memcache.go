@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
 	"github.com/tomdionysus/trinity/util"
 )
 
@@ -16,8 +20,20 @@ type MemcacheServer struct {
 	Port     int
 	Server   *TLSServer
 	Listener net.Listener
+	// Keyspace is the keyspace of the keys used by connections to this server.
+	Keyspace string
 
 	Connections map[string]net.Conn
+
+	// sessions holds the options chosen by each connection with the consistency and quorum commands.
+	sessions      map[string]memcacheSession
+	sessionsMutex sync.Mutex
+}
+
+// memcacheSession holds the options of a connection's reads and writes.
+type memcacheSession struct {
+	read  ReadOptions
+	write WriteOptions
 }
 
 // NewMemcacheServer create and return a MemcacheServer instance
@@ -26,7 +42,9 @@ func NewMemcacheServer(logger *util.Logger, port int, server *TLSServer) *Memcac
 		Logger:      logger,
 		Port:        port,
 		Server:      server,
+		Keyspace:    kvstore.DefaultKeyspace,
 		Connections: map[string]net.Conn{},
+		sessions:    map[string]memcacheSession{},
 	}
 	return inst
 }
@@ -45,7 +63,7 @@ func (mcs *MemcacheServer) Start() error {
 		return err
 	}
 	mcs.Listener = listener
-	mcs.Logger.Info("Memcache", "Listening on port [%d]", mcs.Port)
+	mcs.Logger.Info("Memcache", "Listening on port [%d] for keyspace %s", mcs.Port, mcs.Keyspace)
 	go func() {
 		for {
 			// Wait for a connection.
@@ -107,6 +125,9 @@ func (mcs *MemcacheServer) handleConnection(addr string, conn net.Conn) {
 
 	conn.Close()
 	delete(mcs.Connections, addr)
+	mcs.sessionsMutex.Lock()
+	delete(mcs.sessions, addr)
+	mcs.sessionsMutex.Unlock()
 }
 
 func (mcs *MemcacheServer) handleCommand(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string) bool {
@@ -132,11 +153,41 @@ func (mcs *MemcacheServer) handleCommand(addr string, reader *bufio.Reader, writ
 		mcs.handleReplace(addr, reader, writer, args)
 		return false
 	case "get":
-		mcs.handleGet(addr, reader, writer, args)
+		mcs.handleGet(addr, reader, writer, args, false)
+		return false
+	case "gets":
+		mcs.handleGet(addr, reader, writer, args, true)
+		return false
+	case "cas":
+		mcs.handleCompareAndSet(addr, reader, writer, args)
+		return false
+	case "append":
+		mcs.handleConcat(addr, reader, writer, args, false)
+		return false
+	case "prepend":
+		mcs.handleConcat(addr, reader, writer, args, true)
+		return false
+	case "incr":
+		mcs.handleIncrDecr(addr, reader, writer, args, false)
+		return false
+	case "decr":
+		mcs.handleIncrDecr(addr, reader, writer, args, true)
 		return false
 	case "delete":
 		mcs.handleDelete(addr, reader, writer, args)
 		return false
+	case "stats":
+		mcs.handleStats(addr, reader, writer, args)
+		return false
+	case "flush_all":
+		mcs.handleFlushAll(addr, reader, writer, args)
+		return false
+	case "consistency":
+		mcs.handleConsistency(addr, reader, writer, args)
+		return false
+	case "quorum":
+		mcs.handleQuorum(addr, reader, writer, args)
+		return false
 	default:
 		writer.WriteString("ERROR\r\n")
 		writer.Flush()
@@ -186,7 +237,15 @@ func (mcs *MemcacheServer) handleSet(addr string, reader *bufio.Reader, writer *
 		expiry := time.Now().UTC().Add(time.Duration(expirytime) * time.Second)
 		expparam = &expiry
 	}
-	mcs.Server.SetKey(args[1], buf[:], int16(flags), expparam)
+	key, ok := mcs.key(writer, args[1])
+	if !ok {
+		return
+	}
+	_, err = mcs.Server.SetKey(key, buf[:], int16(flags), expparam, mcs.session(addr).write)
+	if err != nil {
+		mcs.writeSetError(writer, err)
+		return
+	}
 	writer.WriteString("STORED\r\n")
 	writer.Flush()
 }
@@ -230,12 +289,26 @@ func (mcs *MemcacheServer) handleAdd(addr string, reader *bufio.Reader, writer *
 		expparam = &expiry
 	}
 
-	if mcs.Server.IsSet(args[1]) == true {
+	key, ok := mcs.key(writer, args[1])
+	if !ok {
+		return
+	}
+	found, err := mcs.Server.IsSet(key, mcs.session(addr).read)
+	if err != nil {
+		writer.WriteString(fmt.Sprintf("SERVER_ERROR %s\r\n", err.Error()))
+		writer.Flush()
+		return
+	}
+	if found {
 		writer.WriteString("NOT_STORED\r\n")
 		writer.Flush()
 		return
 	}
-	mcs.Server.SetKey(args[1], buf[:], int16(flags), expparam)
+	_, err = mcs.Server.SetKey(key, buf[:], int16(flags), expparam, mcs.session(addr).write)
+	if err != nil {
+		mcs.writeSetError(writer, err)
+		return
+	}
 	writer.WriteString("STORED\r\n")
 	writer.Flush()
 }
@@ -277,28 +350,224 @@ func (mcs *MemcacheServer) handleReplace(addr string, reader *bufio.Reader, writ
 		expparam = &expiry
 	}
 
-	if mcs.Server.IsSet(args[1]) == false {
+	key, ok := mcs.key(writer, args[1])
+	if !ok {
+		return
+	}
+	found, err := mcs.Server.IsSet(key, mcs.session(addr).read)
+	if err != nil {
+		writer.WriteString(fmt.Sprintf("SERVER_ERROR %s\r\n", err.Error()))
+		writer.Flush()
+		return
+	}
+	if !found {
 		writer.WriteString("NOT_STORED\r\n")
 		writer.Flush()
 		return
 	}
-	mcs.Server.SetKey(args[1], buf[:], int16(flags), expparam)
+	_, err = mcs.Server.SetKey(key, buf[:], int16(flags), expparam, mcs.session(addr).write)
+	if err != nil {
+		mcs.writeSetError(writer, err)
+		return
+	}
 	writer.WriteString("STORED\r\n")
 	writer.Flush()
 }
 
-func (mcs *MemcacheServer) handleGet(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string) {
+func (mcs *MemcacheServer) handleCompareAndSet(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string) {
+	if len(args) > 7 || len(args) < 6 {
+		writer.WriteString("ERROR\r\n")
+		writer.Flush()
+		return
+	}
+	// args[1] key
+	// args[2] flags
+	// args[3] exptime
+	// args[4] bytes
+	// args[5] cas unique
+	// args[6] noreply
+
+	mcs.Logger.Debug("Memcache", "[%s] -> Cas %s", addr, args)
+
+	expirytime, flags, bytes, err := util.MemcachedSetArgsHelper(args)
+	if err != nil {
+		writer.WriteString("SERVER_ERROR\r\n")
+		writer.Flush()
+		return
+	}
+	expected, err := strconv.ParseUint(args[5], 10, 64)
+	if err != nil {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		writer.Flush()
+		return
+	}
+
+	var buf []byte = make([]byte, bytes, bytes)
+	n, err := reader.Read(buf)
+	if err != nil || n != len(buf) {
+		writer.WriteString("SERVER_ERROR\r\n")
+		writer.Flush()
+		return
+	}
+
+	_, err = reader.ReadString('\n')
+	if err != nil {
+		writer.WriteString("SERVER_ERROR\r\n")
+		writer.Flush()
+		return
+	}
+
+	var expparam *time.Time = nil
+	if expirytime != 0 {
+		expiry := time.Now().UTC().Add(time.Duration(expirytime) * time.Second)
+		expparam = &expiry
+	}
+	key, ok := mcs.key(writer, args[1])
+	if !ok {
+		return
+	}
+	_, err = mcs.Server.CompareAndSetKey(key, buf[:], int16(flags), expparam, expected, mcs.session(addr).write)
+	switch err {
+	case nil:
+		writer.WriteString("STORED\r\n")
+	case kvstore.ErrVersionMismatch:
+		writer.WriteString("EXISTS\r\n")
+	case kvstore.ErrNotFound:
+		writer.WriteString("NOT_FOUND\r\n")
+	default:
+		mcs.writeSetError(writer, err)
+		return
+	}
+	writer.Flush()
+}
+
+func (mcs *MemcacheServer) handleConcat(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string, prepend bool) {
+	if len(args) > 6 || len(args) < 5 {
+		writer.WriteString("ERROR\r\n")
+		writer.Flush()
+		return
+	}
+	// args[1] key
+	// args[2] flags (ignored)
+	// args[3] exptime (ignored)
+	// args[4] bytes
+	// args[5] noreply
+
+	mcs.Logger.Debug("Memcache", "[%s] -> Append/Prepend %s", addr, args)
+
+	_, _, bytes, err := util.MemcachedSetArgsHelper(args)
+	if err != nil {
+		writer.WriteString("SERVER_ERROR\r\n")
+		writer.Flush()
+		return
+	}
+
+	var buf []byte = make([]byte, bytes, bytes)
+	n, err := reader.Read(buf)
+	if err != nil || n != len(buf) {
+		writer.WriteString("SERVER_ERROR\r\n")
+		writer.Flush()
+		return
+	}
+
+	_, err = reader.ReadString('\n')
+	if err != nil {
+		writer.WriteString("SERVER_ERROR\r\n")
+		writer.Flush()
+		return
+	}
+
+	key, ok := mcs.key(writer, args[1])
+	if !ok {
+		return
+	}
+	if prepend {
+		_, err = mcs.Server.PrependKey(key, buf[:], mcs.session(addr).write)
+	} else {
+		_, err = mcs.Server.AppendKey(key, buf[:], mcs.session(addr).write)
+	}
+	switch err {
+	case nil:
+		writer.WriteString("STORED\r\n")
+	case kvstore.ErrNotFound:
+		writer.WriteString("NOT_STORED\r\n")
+	default:
+		mcs.writeSetError(writer, err)
+		return
+	}
+	writer.Flush()
+}
+
+func (mcs *MemcacheServer) handleIncrDecr(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string, decr bool) {
+	if len(args) > 4 || len(args) < 3 {
+		writer.WriteString("ERROR\r\n")
+		writer.Flush()
+		return
+	}
+	// args[1] key
+	// args[2] value
+	// args[3] noreply
+
+	mcs.Logger.Debug("Memcache", "[%s] -> Incr/Decr %s", addr, args)
+
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		writer.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		writer.Flush()
+		return
+	}
+
+	key, ok := mcs.key(writer, args[1])
+	if !ok {
+		return
+	}
+	var item *kvstore.Item
+	if decr {
+		item, err = mcs.Server.DecrKey(key, delta, mcs.session(addr).write)
+	} else {
+		item, err = mcs.Server.IncrKey(key, delta, mcs.session(addr).write)
+	}
+	switch err {
+	case nil:
+		writer.Write(item.Data)
+		writer.WriteString("\r\n")
+	case kvstore.ErrNotFound:
+		writer.WriteString("NOT_FOUND\r\n")
+	case kvstore.ErrNotNumeric:
+		writer.WriteString(fmt.Sprintf("CLIENT_ERROR %s\r\n", err.Error()))
+	default:
+		mcs.writeSetError(writer, err)
+		return
+	}
+	writer.Flush()
+}
+
+func (mcs *MemcacheServer) handleGet(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string, withVersion bool) {
 	if len(args) > 2 {
 		writer.WriteString("ERROR\r\n")
 		writer.Flush()
 		return
 	}
 	mcs.Logger.Debug("Memcache", "[%s] -> Get Key %s", addr, args[1])
-	value, flags, found := mcs.Server.GetKey(args[1])
+	key, ok := mcs.key(writer, args[1])
+	if !ok {
+		return
+	}
+	item, found, err := mcs.Server.GetItem(key, mcs.session(addr).read)
+	if err != nil {
+		mcs.Logger.Debug("Memcache", "[%s] -> Failed: %s", addr, err.Error())
+		writer.WriteString(fmt.Sprintf("SERVER_ERROR %s\r\n", err.Error()))
+		writer.Flush()
+		return
+	}
 	if found {
 		mcs.Logger.Debug("Memcache", "[%s] -> Found", addr)
-		writer.WriteString(fmt.Sprintf("VALUE %s %d %d\r\n", args[1], flags, len(value)))
-		writer.Write(value)
+		if withVersion {
+			writer.WriteString(fmt.Sprintf("VALUE %s %d %d %d\r\n", args[1], item.Flags, len(item.Data), item.Version))
+		} else {
+			writer.WriteString(fmt.Sprintf("VALUE %s %d %d\r\n", args[1], item.Flags, len(item.Data)))
+		}
+		writer.Write(item.Data)
 		writer.Write([]byte{13, 10})
 	}
 	writer.WriteString("END\r\n")
@@ -312,8 +581,16 @@ func (mcs *MemcacheServer) handleDelete(addr string, reader *bufio.Reader, write
 		return
 	}
 	mcs.Logger.Debug("Memcache", "[%s] -> Delete Key %s", addr, args[1])
-	found := mcs.Server.DeleteKey(args[1])
-	if found {
+	key, ok := mcs.key(writer, args[1])
+	if !ok {
+		return
+	}
+	result, err := mcs.Server.DeleteKey(key, mcs.session(addr).write)
+	if err != nil {
+		mcs.Logger.Debug("Memcache", "[%s] -> Failed: %s", addr, err.Error())
+		writer.WriteString(fmt.Sprintf("SERVER_ERROR %s\r\n", err.Error()))
+		writer.Flush()
+	} else if result.Found {
 		mcs.Logger.Debug("Memcache", "[%s] -> Found", addr)
 		writer.WriteString("DELETED\r\n")
 		writer.Flush()
@@ -323,3 +600,173 @@ func (mcs *MemcacheServer) handleDelete(addr string, reader *bufio.Reader, write
 		writer.Flush()
 	}
 }
+
+func (mcs *MemcacheServer) handleStats(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string) {
+	if len(args) > 1 {
+		writer.WriteString("ERROR\r\n")
+		writer.Flush()
+		return
+	}
+	mcs.Logger.Debug("Memcache", "[%s] -> Stats", addr)
+	stats := mcs.Server.KVStore.Stats()
+	writer.WriteString(fmt.Sprintf("STAT curr_items %d\r\n", stats.Items))
+	writer.WriteString(fmt.Sprintf("STAT bytes %d\r\n", stats.Memory))
+	writer.WriteString(fmt.Sprintf("STAT limit_maxbytes %d\r\n", stats.MaxMemory))
+	writer.WriteString(fmt.Sprintf("STAT cmd_get %d\r\n", stats.Gets))
+	writer.WriteString(fmt.Sprintf("STAT cmd_set %d\r\n", stats.Sets))
+	writer.WriteString(fmt.Sprintf("STAT get_hits %d\r\n", stats.Hits))
+	writer.WriteString(fmt.Sprintf("STAT get_misses %d\r\n", stats.Gets-stats.Hits))
+	writer.WriteString(fmt.Sprintf("STAT evictions %d\r\n", stats.Evictions))
+	writer.WriteString(fmt.Sprintf("STAT compression_ratio %.2f\r\n", stats.CompressionRatio()))
+	writer.WriteString(fmt.Sprintf("STAT corruptions %d\r\n", stats.Corruptions))
+	writer.WriteString(fmt.Sprintf("STAT read_repairs %d\r\n", mcs.Server.ReadRepairs()))
+	writer.WriteString(fmt.Sprintf("STAT anti_entropy_repairs %d\r\n", mcs.Server.AntiEntropyRepairs()))
+	rereplication := mcs.Server.Rereplication()
+	running := 0
+	if rereplication.Running {
+		running = 1
+	}
+	writer.WriteString(fmt.Sprintf("STAT rereplication_running %d\r\n", running))
+	writer.WriteString(fmt.Sprintf("STAT rereplication_peers %d\r\n", rereplication.Peers))
+	writer.WriteString(fmt.Sprintf("STAT rereplication_peers_done %d\r\n", rereplication.Done))
+	writer.WriteString(fmt.Sprintf("STAT rereplicated_keys %d\r\n", rereplication.Keys))
+	pending := mcs.Server.PendingHints()
+	total := 0
+	for _, count := range pending {
+		total += count
+	}
+	writer.WriteString(fmt.Sprintf("STAT hints_pending %d\r\n", total))
+	for id, count := range pending {
+		writer.WriteString(fmt.Sprintf("STAT hints_pending_%X %d\r\n", id[:], count))
+	}
+	keyspace := mcs.Server.KVStore.Keyspaces()[mcs.Keyspace]
+	writer.WriteString(fmt.Sprintf("STAT keyspace %s\r\n", mcs.Keyspace))
+	writer.WriteString(fmt.Sprintf("STAT keyspace_items %d\r\n", keyspace.Items))
+	writer.WriteString(fmt.Sprintf("STAT keyspace_bytes %d\r\n", keyspace.Memory))
+	writer.WriteString(fmt.Sprintf("STAT keyspace_limit_maxbytes %d\r\n", keyspace.Quota))
+	writer.WriteString(fmt.Sprintf("STAT keyspace_cmd_get %d\r\n", keyspace.Gets))
+	writer.WriteString(fmt.Sprintf("STAT keyspace_cmd_set %d\r\n", keyspace.Sets))
+	writer.WriteString(fmt.Sprintf("STAT keyspace_get_hits %d\r\n", keyspace.Hits))
+	writer.WriteString("END\r\n")
+	writer.Flush()
+}
+
+func (mcs *MemcacheServer) handleFlushAll(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string) {
+	if len(args) > 3 {
+		writer.WriteString("ERROR\r\n")
+		writer.Flush()
+		return
+	}
+	// args[1] delay (ignored)
+	// args[2] noreply
+
+	mcs.Logger.Debug("Memcache", "[%s] -> Flush Keyspace %s", addr, mcs.Keyspace)
+	_, err := mcs.Server.DropKeyspace(mcs.Keyspace)
+	if err != nil {
+		writer.WriteString(fmt.Sprintf("SERVER_ERROR %s\r\n", err.Error()))
+		writer.Flush()
+		return
+	}
+	writer.WriteString("OK\r\n")
+	writer.Flush()
+}
+
+// handleConsistency sets the consistency mode of the connection's writes, or with no mode replies with the
+// current one. This is a Trinity extension to the memcache protocol.
+func (mcs *MemcacheServer) handleConsistency(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string) {
+	if len(args) > 2 {
+		writer.WriteString("ERROR\r\n")
+		writer.Flush()
+		return
+	}
+	// args[1] mode
+
+	if len(args) == 1 {
+		writer.WriteString(fmt.Sprintf("CONSISTENCY %s\r\n", mcs.Server.consistency(mcs.session(addr).write.Consistency)))
+		writer.Flush()
+		return
+	}
+	mode, err := packets.ParseConsistency(args[1])
+	if err != nil {
+		writer.WriteString(fmt.Sprintf("CLIENT_ERROR %s\r\n", err.Error()))
+		writer.Flush()
+		return
+	}
+	mcs.Logger.Debug("Memcache", "[%s] -> Consistency %s", addr, mode)
+	mcs.updateSession(addr, func(session *memcacheSession) {
+		session.write.Consistency = mode
+	})
+	writer.WriteString("OK\r\n")
+	writer.Flush()
+}
+
+// handleQuorum sets the read and write quorums of the connection, or with no quorums replies with the current
+// ones. A quorum of 0 selects the server's. This is a Trinity extension to the memcache protocol.
+func (mcs *MemcacheServer) handleQuorum(addr string, reader *bufio.Reader, writer *bufio.Writer, args []string) {
+	if len(args) != 1 && len(args) != 3 {
+		writer.WriteString("ERROR\r\n")
+		writer.Flush()
+		return
+	}
+	// args[1] R
+	// args[2] W
+
+	if len(args) == 1 {
+		session := mcs.session(addr)
+		writer.WriteString(fmt.Sprintf("QUORUM %d %d\r\n", session.read.R, session.write.W))
+		writer.Flush()
+		return
+	}
+	r, rerr := strconv.ParseUint(args[1], 10, 8)
+	w, werr := strconv.ParseUint(args[2], 10, 8)
+	if rerr != nil || werr != nil {
+		writer.WriteString("CLIENT_ERROR invalid quorum\r\n")
+		writer.Flush()
+		return
+	}
+	mcs.Logger.Debug("Memcache", "[%s] -> Quorum R=%d W=%d", addr, r, w)
+	mcs.updateSession(addr, func(session *memcacheSession) {
+		session.read.R = int(r)
+		session.write.W = int(w)
+	})
+	writer.WriteString("OK\r\n")
+	writer.Flush()
+}
+
+// session returns the options chosen by the connection.
+func (mcs *MemcacheServer) session(addr string) memcacheSession {
+	mcs.sessionsMutex.Lock()
+	defer mcs.sessionsMutex.Unlock()
+	return mcs.sessions[addr]
+}
+
+// updateSession changes the options chosen by the connection.
+func (mcs *MemcacheServer) updateSession(addr string, fn func(*memcacheSession)) {
+	mcs.sessionsMutex.Lock()
+	defer mcs.sessionsMutex.Unlock()
+	session := mcs.sessions[addr]
+	fn(&session)
+	mcs.sessions[addr] = session
+}
+
+// key returns the stored key for a key in the server's keyspace. If the key is not valid it writes the error
+// reply and returns false.
+func (mcs *MemcacheServer) key(writer *bufio.Writer, key string) (string, bool) {
+	stored, err := kvstore.KeyspaceKey(mcs.Keyspace, key)
+	if err != nil {
+		writer.WriteString("CLIENT_ERROR bad command line format\r\n")
+		writer.Flush()
+		return "", false
+	}
+	return stored, true
+}
+
+// writeSetError writes the reply for a failed store command.
+func (mcs *MemcacheServer) writeSetError(writer *bufio.Writer, err error) {
+	if err == kvstore.ErrOutOfMemory {
+		writer.WriteString("SERVER_ERROR out of memory\r\n")
+	} else {
+		writer.WriteString(fmt.Sprintf("SERVER_ERROR %s\r\n", err.Error()))
+	}
+	writer.Flush()
+}
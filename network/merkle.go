@@ -0,0 +1,139 @@
+package network
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+)
+
+// MerkleDepth is the depth of the Merkle trees compared by anti-entropy. The key space is split into
+// 2^MerkleDepth leaves by the leading bits of the MD5 of each key.
+const MerkleDepth = 10
+
+// merkleTree is a Merkle tree over the keys a node shares with a peer. levels[0] holds the root, and
+// levels[MerkleDepth] the leaves, where each leaf is the XOR of the digests of its keys so that it does not
+// depend on the order they are read in. Each other node is the MD5 of its two children.
+type merkleTree struct {
+	levels [][][16]byte
+}
+
+// merkleLeaf returns the leaf of the Merkle tree holding the key with the given MD5.
+func merkleLeaf(keymd5 ch.Key) uint32 {
+	return binary.BigEndian.Uint32(keymd5[0:4]) >> (32 - MerkleDepth)
+}
+
+// merkleDigest returns the digest of the key, version and whether the item is a tombstone.
+func merkleDigest(item *kvstore.Item) [16]byte {
+	buf := make([]byte, len(item.Key)+10)
+	copy(buf, item.Key)
+	binary.BigEndian.PutUint64(buf[len(item.Key)+1:], item.Version)
+	if item.Tombstone {
+		buf[len(buf)-1] = 1
+	}
+	return md5.Sum(buf)
+}
+
+// newMerkleTree returns the Merkle tree of the given leaves.
+func newMerkleTree(leaves [][16]byte) *merkleTree {
+	inst := &merkleTree{levels: make([][][16]byte, MerkleDepth+1)}
+	inst.levels[MerkleDepth] = leaves
+	for level := MerkleDepth - 1; level >= 0; level-- {
+		children := inst.levels[level+1]
+		nodes := make([][16]byte, len(children)/2)
+		buf := make([]byte, 32)
+		for i := range nodes {
+			copy(buf[0:16], children[2*i][:])
+			copy(buf[16:32], children[2*i+1][:])
+			nodes[i] = md5.Sum(buf)
+		}
+		inst.levels[level] = nodes
+	}
+	return inst
+}
+
+// hashes returns the hashes of the nodes at the level with the given indices, or false if any are out of range.
+func (tree *merkleTree) hashes(level int, indices []uint32) ([][16]byte, bool) {
+	if level < 0 || level > MerkleDepth {
+		return nil, false
+	}
+	nodes := tree.levels[level]
+	result := make([][16]byte, len(indices))
+	for i, index := range indices {
+		if int(index) >= len(nodes) {
+			return nil, false
+		}
+		result[i] = nodes[index]
+	}
+	return result, true
+}
+
+// shares returns true if this node and the peer are both replicas of the key with the given MD5.
+func (svr *TLSServer) shares(keymd5 ch.Key, peer ch.NodeId) bool {
+	local, remote := false, false
+	for _, id := range svr.replicasFor(keymd5) {
+		local = local || id == svr.ServerNode.ID
+		remote = remote || id == peer
+	}
+	return local && remote
+}
+
+// sharedItems calls fn with each item and tombstone held by this node that the peer is also a replica of, and
+// the leaf of the Merkle tree it is in.
+func (svr *TLSServer) sharedItems(peer ch.NodeId, fn func(item *kvstore.Item, leaf uint32)) {
+	cursor := svr.KVStore.Scan(kvstore.ScanOptions{Tombstones: true})
+	for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+		keymd5 := ch.NewMD5Key(item.Key)
+		if svr.shares(keymd5, peer) {
+			fn(item, merkleLeaf(keymd5))
+		}
+	}
+}
+
+// buildMerkleTree builds the Merkle tree of the keys this node shares with the peer.
+func (svr *TLSServer) buildMerkleTree(peer ch.NodeId) *merkleTree {
+	leaves := make([][16]byte, 1<<MerkleDepth)
+	count := 0
+	svr.sharedItems(peer, func(item *kvstore.Item, leaf uint32) {
+		digest := merkleDigest(item)
+		for i := range digest {
+			leaves[leaf][i] ^= digest[i]
+		}
+		count++
+	})
+	svr.Logger.Debug("Server", "Merkle: Built tree of %d keys shared with %02X", count, peer)
+	return newMerkleTree(leaves)
+}
+
+// leafItems returns the items and tombstones held by this node in the given leaves of the Merkle tree of the keys
+// it shares with the peer, by key.
+func (svr *TLSServer) leafItems(peer ch.NodeId, leaves []uint32) map[string]*kvstore.Item {
+	wanted := make(map[uint32]bool, len(leaves))
+	for _, leaf := range leaves {
+		wanted[leaf] = true
+	}
+	items := map[string]*kvstore.Item{}
+	svr.sharedItems(peer, func(item *kvstore.Item, leaf uint32) {
+		if wanted[leaf] {
+			items[item.Key] = item
+		}
+	})
+	return items
+}
+
+// merkleTreeFor returns the tree of the keys shared with the peer, as last built for its requests, building it if
+// rebuild is set or there is none.
+func (svr *TLSServer) merkleTreeFor(peer ch.NodeId, rebuild bool) *merkleTree {
+	svr.merkleMutex.Lock()
+	tree, found := svr.merkleTrees[peer]
+	svr.merkleMutex.Unlock()
+	if found && !rebuild {
+		return tree
+	}
+	tree = svr.buildMerkleTree(peer)
+	svr.merkleMutex.Lock()
+	svr.merkleTrees[peer] = tree
+	svr.merkleMutex.Unlock()
+	return tree
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+	"github.com/tomdionysus/trinity/util"
+)
+
+// localReplica is another server in the same process, for testing anti-entropy without connections.
+type localReplica struct {
+	svr       *TLSServer
+	requester ch.NodeId
+}
+
+func (lr *localReplica) hashes(level int, indices []uint32) ([][16]byte, error) {
+	hashes, _ := lr.svr.merkleTreeFor(lr.requester, level == 0).hashes(level, indices)
+	return hashes, nil
+}
+
+func (lr *localReplica) keys(leaves []uint32) ([]*kvstore.Item, error) {
+	items := []*kvstore.Item{}
+	for _, item := range lr.svr.leafItems(lr.requester, leaves) {
+		items = append(items, &kvstore.Item{Key: item.Key, Version: item.Version, Tombstone: item.Tombstone})
+	}
+	return items, nil
+}
+
+func (lr *localReplica) get(key string) (*kvstore.Item, error) {
+	item, found := lr.svr.KVStore.Lookup(key)
+	if !found {
+		return nil, kvstore.ErrNotFound
+	}
+	return item, nil
+}
+
+func (lr *localReplica) put(item *kvstore.Item) error {
+	var err error
+	if item.Tombstone {
+		_, _, err = lr.svr.KVStore.DeleteVersion(item.Key, item.Version)
+	} else {
+		_, err = lr.svr.KVStore.SetVersion(item.Key, item.Data, item.Flags, item.ExpiresAt, item.Version)
+	}
+	return err
+}
+
+// newReplicaPair returns two servers that are replicas of every key.
+func newReplicaPair() (*TLSServer, *TLSServer) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	a.ServerNode.RegisterNode(&b.ServerNode.ServerNetworkNode)
+	b.ServerNode.RegisterNode(&a.ServerNode.ServerNetworkNode)
+	a.AntiEntropyRate, b.AntiEntropyRate = 0, 0
+	return a, b
+}
+
+func TestMerkleTree(t *testing.T) {
+	a, b := newReplicaPair()
+	assert.Equal(t, MerkleDepth+1, len(a.buildMerkleTree(b.ServerNode.ID).levels))
+
+	// The same keys in any order give the same tree
+	a.KVStore.SetVersion("one", []byte("1"), 0, nil, 10)
+	a.KVStore.SetVersion("two", []byte("2"), 0, nil, 11)
+	b.KVStore.SetVersion("two", []byte("2"), 0, nil, 11)
+	b.KVStore.SetVersion("one", []byte("1"), 0, nil, 10)
+	treeA, treeB := a.buildMerkleTree(b.ServerNode.ID), b.buildMerkleTree(a.ServerNode.ID)
+	assert.Equal(t, treeA.levels[0], treeB.levels[0])
+
+	// A newer version changes the root and its leaf
+	b.KVStore.SetVersion("one", []byte("1"), 0, nil, 12)
+	treeB = b.buildMerkleTree(a.ServerNode.ID)
+	assert.NotEqual(t, treeA.levels[0], treeB.levels[0])
+	leaf := merkleLeaf(ch.NewMD5Key("one"))
+	assert.NotEqual(t, treeA.levels[MerkleDepth][leaf], treeB.levels[MerkleDepth][leaf])
+
+	_, ok := treeA.hashes(MerkleDepth+1, []uint32{0})
+	assert.False(t, ok)
+	_, ok = treeA.hashes(1, []uint32{2})
+	assert.False(t, ok)
+}
+
+func TestSyncReplica(t *testing.T) {
+	a, b := newReplicaPair()
+	replica := &localReplica{svr: b, requester: a.ServerNode.ID}
+
+	for _, key := range []string{"same", "old", "deleted"} {
+		a.KVStore.SetVersion(key, []byte("a"), 0, nil, 10)
+		b.KVStore.SetVersion(key, []byte("a"), 0, nil, 10)
+	}
+	a.KVStore.SetVersion("missing", []byte("a"), 0, nil, 10)
+	b.KVStore.SetVersion("old", []byte("b"), 0, nil, 11)
+	b.KVStore.SetVersion("new", []byte("b"), 0, nil, 11)
+	b.KVStore.DeleteVersion("deleted", 12)
+
+	repaired, err := a.syncReplica(b.ServerNode.ID, replica)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, repaired)
+	assert.Equal(t, uint64(4), a.AntiEntropyRepairs())
+
+	// Each key is the newest copy on both
+	for _, svr := range []*TLSServer{a, b} {
+		item, found := svr.KVStore.GetItem("old")
+		assert.True(t, found)
+		assert.Equal(t, []byte("b"), item.Data)
+		_, found = svr.KVStore.GetItem("new")
+		assert.True(t, found)
+		_, found = svr.KVStore.GetItem("missing")
+		assert.True(t, found)
+		_, found = svr.KVStore.GetItem("deleted")
+		assert.False(t, found)
+	}
+
+	// Now in sync
+	repaired, err = a.syncReplica(b.ServerNode.ID, replica)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, repaired)
+}
+
+func TestMerkleReply(t *testing.T) {
+	id := packets.NewRandomPacketId()
+	payload, err := merkleReply(packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, id, packets.MerkleHashesPacket{Level: 1}))
+	assert.Nil(t, err)
+	assert.Equal(t, packets.MerkleHashesPacket{Level: 1}, payload)
+
+	_, err = merkleReply(packets.NewResponsePacket(packets.CMD_KVSTORE_ERROR, id, "Invalid Merkle Node"))
+	assert.Equal(t, "Invalid Merkle Node", err.Error())
+
+	_, err = merkleReply(packets.NewResponsePacket(packets.CMD_KVSTORE_NOT_FOUND, id, nil))
+	assert.NotNil(t, err)
+}
@@ -5,12 +5,15 @@ import (
 	"errors"
 
 	"github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
 	"github.com/tomdionysus/trinity/packets"
 	"github.com/tomdionysus/trinity/util"
 
 	// "bytes"
 	"encoding/gob"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +26,7 @@ const (
 	PeerStateSyncing      = iota
 	PeerStateReady        = iota
 	PeerStateDefib        = iota
+	PeerStateLeaving      = iota
 )
 
 // PeerStateString exports helper for peer state
@@ -34,6 +38,7 @@ var PeerStateString map[uint]string = map[uint]string{
 	PeerStateSyncing:      "PeerStateSyncing",
 	PeerStateReady:        "PeerStateReady",
 	PeerStateDefib:        "PeerStateDefib",
+	PeerStateLeaving:      "PeerStateLeaving",
 }
 
 // Peer is a representation of a remote trinity instance.
@@ -49,8 +54,8 @@ type Peer struct {
 	// Address is the hostname:port to connect to, or the hostname:port being connected
 	Address string
 
-	// State is the State of the peer
-	State uint
+	// state is the State of the peer, which is read and changed from several goroutines so is atomic
+	state uint32
 
 	// Connection is the underlying TLS secured connection
 	Connection *tls.Conn
@@ -71,6 +76,11 @@ type Peer struct {
 
 	// Replies contains the current outstanding requests to the peer
 	Replies map[packets.PacketId]chan (*packets.Packet)
+
+	// repliesMutex guards Replies, as requests are sent from many goroutines
+	repliesMutex sync.Mutex
+	// writeMutex serialises packets written to the peer
+	writeMutex sync.Mutex
 }
 
 // NewPeer returns a new Peer with the specified logger, server and address
@@ -78,7 +88,7 @@ func NewPeer(logger *util.Logger, server *TLSServer, address string) *Peer {
 	inst := &Peer{
 		Logger:            logger,
 		Address:           address,
-		State:             PeerStateDisconnected,
+		state:             PeerStateDisconnected,
 		Server:            server,
 		LastHeartbeat:     time.Now(),
 		ServerNetworkNode: nil,
@@ -91,15 +101,35 @@ func NewPeer(logger *util.Logger, server *TLSServer, address string) *Peer {
 func NewConnectingPeer(logger *util.Logger, server *TLSServer, connection *tls.Conn) *Peer {
 	inst := NewPeer(logger, server, connection.RemoteAddr().String())
 	inst.Connection = connection
-	inst.State = PeerStateHandshake
+	inst.SetState(PeerStateHandshake)
 	inst.Incoming = true
 	return inst
 }
 
+// State returns the state of the peer.
+func (peer *Peer) State() uint {
+	return uint(atomic.LoadUint32(&peer.state))
+}
+
+// SetState sets the state of the peer.
+func (peer *Peer) SetState(state uint) {
+	atomic.StoreUint32(&peer.state, uint32(state))
+}
+
+// swapState sets the state of the peer, returning the previous state.
+func (peer *Peer) swapState(state uint) uint {
+	return uint(atomic.SwapUint32(&peer.state, uint32(state)))
+}
+
+// compareAndSwapState sets the state of the peer if it is old, returning whether it was.
+func (peer *Peer) compareAndSwapState(old uint, state uint) bool {
+	return atomic.CompareAndSwapUint32(&peer.state, uint32(old), uint32(state))
+}
+
 // Connect attempts to connect to the trinity instance at the configred Address
 func (peer *Peer) Connect() error {
 	peer.Incoming = false
-	peer.State = PeerStateConnecting
+	peer.SetState(PeerStateConnecting)
 	conn, err := tls.Dial("tcp", peer.Address, &tls.Config{
 		RootCAs:      peer.Server.CAPool.Pool,
 		Certificates: []tls.Certificate{*peer.Server.Certificate},
@@ -115,21 +145,25 @@ func (peer *Peer) Connect() error {
 		peer.Disconnect()
 		return errors.New("Peer has no certificates")
 	}
-	peer.State = PeerStateHandshake
+	peer.SetState(PeerStateHandshake)
 	return nil
 }
 
 // Disconnect disconnects the remote trinity instance and removes the peer from the TLSServer connections
 func (peer *Peer) Disconnect() {
-	if peer.ServerNetworkNode != nil && peer.State != PeerStateDisconnected {
-		peer.State = PeerStateDisconnected
+	if peer.ServerNetworkNode != nil && peer.swapState(PeerStateDisconnected) != PeerStateDisconnected {
 		if peer.HeartbeatTicker != nil {
 			peer.HeartbeatTicker.Stop()
 		}
 		if peer.ServerNetworkNode != nil {
+			id := peer.ServerNetworkNode.ID
+			lost := peer.Server.ServerNode.NodeRegistered(id) && !peer.Server.isLeaving(id)
 			peer.Server.ServerNode.DeregisterNode(peer.ServerNetworkNode)
-			peer.Server.ConnectionClear(peer.ServerNetworkNode.ID)
-			peer.Logger.Info("Peer", "%02X: Disconnected", peer.ServerNetworkNode.ID)
+			peer.Server.ConnectionClear(id)
+			peer.Logger.Info("Peer", "%02X: Disconnected", id)
+			if lost {
+				peer.Server.nodeLost(peer.ServerNetworkNode)
+			}
 		} else {
 			peer.Logger.Info("Peer", "Unregistered Peer Disconnected (%s)", peer.Address)
 		}
@@ -141,7 +175,7 @@ func (peer *Peer) Disconnect() {
 
 // Start processes the TLS handshake and registration protocol once connected
 func (peer *Peer) Start(disableHeartbeat bool) error {
-	if peer.State != PeerStateHandshake {
+	if peer.State() != PeerStateHandshake {
 		peer.Logger.Error("Peer", "Cannot Start Peer, Handshake not ready")
 		return errors.New("Handshake not ready")
 	}
@@ -189,11 +223,11 @@ func (peer *Peer) heartbeat() {
 		// Check For Defib
 		if time.Now().After(peer.LastHeartbeat.Add(5 * time.Second)) {
 			peer.Logger.Warn("Peer", "%02X: Peer Defib (no response for >5 seconds)", peer.ServerNetworkNode.ID)
-			peer.State = PeerStateDefib
+			peer.SetState(PeerStateDefib)
 		}
 
-		switch peer.State {
-		case PeerStateConnected:
+		switch peer.State() {
+		case PeerStateConnected, PeerStateSyncing, PeerStateReady, PeerStateLeaving:
 			err := peer.SendPacket(packets.NewPacket(packets.CMD_HEARTBEAT, nil))
 			if err != nil {
 				peer.Logger.Error("Peer", "%02X: Error Sending Heartbeat, disconnecting", peer.ServerNetworkNode.ID)
@@ -213,11 +247,10 @@ func (peer *Peer) heartbeat() {
 // process continually reads from the Pere input stream and processes packet commands.
 func (peer *Peer) process() {
 
-	var packet packets.Packet
-
 	for {
 
-		// Read Command
+		// Read Command, into a new packet each time as replies are handed to their waiters
+		var packet packets.Packet
 		err := peer.Reader.Decode(&packet)
 		if err != nil {
 			if err.Error() == "EOF" {
@@ -247,9 +280,12 @@ func (peer *Peer) process() {
 		case packets.CMD_PEERLIST:
 			peer.process_CMD_PEERLIST(packet)
 
+		// Store operations may wait on the disk, so are done without holding up heartbeats and replies.
+		// Replicated writes carry their version, so the order they are applied in does not matter.
+
 		case packets.CMD_KVSTORE:
 			peer.Logger.Debug("Peer", "%02X: CMD_KVSTORE", peer.ServerNetworkNode.ID)
-			peer.handleKVStorePacket(&packet)
+			go peer.handleKVStorePacket(&packet)
 
 		case packets.CMD_KVSTORE_ACK:
 			peer.Logger.Debug("Peer", "%02X: CMD_KVSTORE_ACK", peer.ServerNetworkNode.ID)
@@ -259,11 +295,46 @@ func (peer *Peer) process() {
 			peer.Logger.Debug("Peer", "%02X: CMD_KVSTORE_NOT_FOUND", peer.ServerNetworkNode.ID)
 			peer.handleReply(&packet)
 
+		case packets.CMD_KVSTORE_ERROR:
+			peer.Logger.Debug("Peer", "%02X: CMD_KVSTORE_ERROR", peer.ServerNetworkNode.ID)
+			peer.handleReply(&packet)
+
+		case packets.CMD_KVSTORE_SCAN:
+			peer.process_CMD_KVSTORE_SCAN(packet)
+
+		// Building Merkle trees scans the store, so is done without holding up the peer's other packets
+
+		case packets.CMD_MERKLE_HASHES:
+			go peer.process_CMD_MERKLE_HASHES(packet)
+
+		case packets.CMD_MERKLE_KEYS:
+			go peer.process_CMD_MERKLE_KEYS(packet)
+
+		case packets.CMD_SYNC_COMPLETE:
+			peer.Logger.Debug("Peer", "%02X: CMD_SYNC_COMPLETE", peer.ServerNetworkNode.ID)
+			peer.Server.syncComplete(peer.ServerNetworkNode.ID)
+
+		case packets.CMD_SYNC_READY:
+			peer.Logger.Debug("Peer", "%02X: CMD_SYNC_READY", peer.ServerNetworkNode.ID)
+			peer.compareAndSwapState(PeerStateSyncing, PeerStateReady)
+
+		case packets.CMD_NODE_LEAVING:
+			peer.Logger.Info("Peer", "%02X: CMD_NODE_LEAVING", peer.ServerNetworkNode.ID)
+			peer.Server.setLeaving(peer.ServerNetworkNode.ID)
+			peer.SetState(PeerStateLeaving)
+			peer.SendPacket(packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, packet.ID, nil))
+
+		case packets.CMD_NODE_STAYING:
+			peer.Logger.Info("Peer", "%02X: CMD_NODE_STAYING", peer.ServerNetworkNode.ID)
+			peer.Server.clearLeaving(peer.ServerNetworkNode.ID)
+			peer.compareAndSwapState(PeerStateLeaving, PeerStateConnected)
+			peer.SendPacket(packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, packet.ID, nil))
+
 		default:
 			peer.Logger.Warn("Peer", "%02X: Unknown Packet Command %d", peer.ServerNetworkNode.ID, packet.Command)
 		}
 
-		if peer.State == PeerStateDisconnected {
+		if peer.State() == PeerStateDisconnected {
 			// As a result of the packet, the peer is now disconnected and we should not try to read from it further.
 			goto end
 		}
@@ -274,9 +345,11 @@ end:
 }
 
 func (peer *Peer) handleReply(packet *packets.Packet) {
+	peer.repliesMutex.Lock()
 	chn, found := peer.Replies[packet.RequestID]
+	delete(peer.Replies, packet.RequestID)
+	peer.repliesMutex.Unlock()
 	if found {
-		delete(peer.Replies, packet.RequestID)
 		chn <- packet
 	} else {
 		peer.Logger.Warn("Peer", "%02X: Unsolicited Reply to unknown packet %02X", peer.ServerNetworkNode.ID, packet.RequestID)
@@ -292,7 +365,9 @@ func (peer *Peer) SendDistribution() error {
 
 // SendPacket send a packet without waiting for response from peer
 func (peer *Peer) SendPacket(packet *packets.Packet) error {
+	peer.writeMutex.Lock()
 	err := peer.Writer.Encode(packet)
+	peer.writeMutex.Unlock()
 	if err != nil {
 		peer.Logger.Error("Peer", "Error Writing: %s", err.Error())
 	}
@@ -301,28 +376,51 @@ func (peer *Peer) SendPacket(packet *packets.Packet) error {
 
 // SendPacketWaitReply Send a packet to a peer and wait for reply
 func (peer *Peer) SendPacketWaitReply(packet *packets.Packet, timeout time.Duration) (*packets.Packet, error) {
-	if peer.State != PeerStateConnected {
-		peer.Logger.Error("Peer", "%02X: Cannot send packet ID %02X, not PeerStateConnected", peer.ServerNetworkNode.ID, packet.ID)
-		return nil, errors.New("Cannot send, state not PeerStateConnected")
+	if !peer.Available() {
+		peer.Logger.Error("Peer", "%02X: Cannot send packet ID %02X, not connected", peer.ServerNetworkNode.ID, packet.ID)
+		return nil, errors.New("Cannot send, peer not connected")
 	}
 
-	peer.Replies[packet.ID] = make(chan (*packets.Packet))
+	// Buffered, so a reply arriving as the request times out does not block the read loop
+	replies := make(chan (*packets.Packet), 1)
+	peer.repliesMutex.Lock()
+	peer.Replies[packet.ID] = replies
+	peer.repliesMutex.Unlock()
 	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
 	peer.SendPacket(packet)
 	var reply *packets.Packet
 	select {
-	case reply = <-peer.Replies[packet.ID]:
+	case reply = <-replies:
 		peer.Logger.Debug("Peer", "%02X: Got Reply %02X for packet ID %02X", peer.ServerNetworkNode.ID, reply.ID, packet.ID)
-		ticker.Stop()
 		return reply, nil
 	case <-ticker.C:
+		peer.repliesMutex.Lock()
+		delete(peer.Replies, packet.ID)
+		peer.repliesMutex.Unlock()
 		peer.Logger.Warn("Peer", "%02X: Reply Timeout for packet ID %02X", peer.ServerNetworkNode.ID, packet.ID)
-		return nil, errors.New("Reply Timeout")
+		return nil, errReplyTimeout
 	}
 }
 
+// errPeerUnavailable is returned when a packet cannot be sent because the peer is not connected.
+var errPeerUnavailable = errors.New("Unavailable")
+
+// errReplyTimeout is returned by SendPacketWaitReply when no reply arrives in time.
+var errReplyTimeout = errors.New("Reply Timeout")
+
 func (peer *Peer) handleKVStorePacket(packet *packets.Packet) {
 	kvpacket := packet.Payload.(packets.KVStorePacket)
+	if err := kvpacket.Decompress(); err != nil {
+		peer.Logger.Error("Peer", "%02X: KVStorePacket: Corrupt Value [%s]: %s", peer.ServerNetworkNode.ID, kvpacket.Key, err.Error())
+		peer.SendPacket(packets.NewResponsePacket(packets.CMD_KVSTORE_ERROR, packet.ID, err.Error()))
+		return
+	}
+	if err := unpackKeyspace(&kvpacket); err != nil {
+		peer.Logger.Warn("Peer", "%02X: KVStorePacket: Invalid Key %q in Keyspace %q", peer.ServerNetworkNode.ID, kvpacket.Key, kvpacket.Keyspace)
+		peer.SendPacket(packets.NewResponsePacket(packets.CMD_KVSTORE_ERROR, packet.ID, err.Error()))
+		return
+	}
 	switch kvpacket.Command {
 	case packets.CMD_KVSTORE_SET:
 		peer.handleKVStoreSet(&kvpacket, packet)
@@ -332,6 +430,10 @@ func (peer *Peer) handleKVStorePacket(packet *packets.Packet) {
 		peer.handleKVStoreIsSet(&kvpacket, packet)
 	case packets.CMD_KVSTORE_DELETE:
 		peer.handleKVStoreDelete(&kvpacket, packet)
+	case packets.CMD_KVSTORE_CAS, packets.CMD_KVSTORE_INCR, packets.CMD_KVSTORE_DECR, packets.CMD_KVSTORE_APPEND, packets.CMD_KVSTORE_PREPEND:
+		peer.handleKVStoreUpdate(&kvpacket, packet)
+	case packets.CMD_KVSTORE_DROP_KEYSPACE:
+		peer.handleKVStoreDropKeyspace(&kvpacket, packet)
 	default:
 		peer.Logger.Error("Peer", "KVStorePacket: Unknown Command %d", packet.Command)
 	}
@@ -339,32 +441,109 @@ func (peer *Peer) handleKVStorePacket(packet *packets.Packet) {
 
 func (peer *Peer) handleKVStoreSet(packet *packets.KVStorePacket, request *packets.Packet) {
 	peer.Logger.Debug("Peer", "%02X: KVStoreSet: %s = %s", peer.ServerNetworkNode.ID, packet.Key, packet.Data)
-	peer.Server.KVStore.Set(
+	version, err := peer.Server.KVStore.SetVersion(
 		packet.Key,
 		packet.Data,
 		packet.Flags,
-		packet.ExpiresAt)
+		packet.ExpiresAt,
+		packet.Version)
+	if err == nil {
+		err = peer.Server.persist(packet.Consistency)
+	}
 
-	response := packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, request.ID, packet.Key)
+	if err != nil {
+		response := packets.NewResponsePacket(packets.CMD_KVSTORE_ERROR, request.ID, err.Error())
+		peer.Logger.Debug("Peer", "%02X: KVStoreSet: %s Failed (%s), replying", peer.ServerNetworkNode.ID, packet.Key, err.Error())
+		peer.SendPacket(response)
+		return
+	}
+
+	payload := packets.KVStorePacket{
+		Command: packets.CMD_KVSTORE_SET,
+		Key:     packet.Key,
+		Version: version,
+	}
+	response := packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, request.ID, payload)
 	peer.Logger.Debug("Peer", "%02X: KVStoreSet: %s Acknowledge, replying", peer.ServerNetworkNode.ID, packet.Key)
 	peer.SendPacket(response)
 }
 
+// handleKVStoreUpdate performs a compare and set or another read-modify-write for which this node owns the key,
+// replying with the updated item so that the sender can replicate it.
+func (peer *Peer) handleKVStoreUpdate(packet *packets.KVStorePacket, request *packets.Packet) {
+	peer.Logger.Debug("Peer", "%02X: KVStoreUpdate: %d %s", peer.ServerNetworkNode.ID, packet.Command, packet.Key)
+	var item *kvstore.Item
+	var err error
+	switch packet.Command {
+	case packets.CMD_KVSTORE_CAS:
+		var version uint64
+		version, err = peer.Server.KVStore.CompareAndSet(packet.Key, packet.Data, packet.Flags, packet.ExpiresAt, packet.Version)
+		item = &kvstore.Item{Key: packet.Key, Data: packet.Data, Flags: packet.Flags, ExpiresAt: packet.ExpiresAt, Version: version}
+	case packets.CMD_KVSTORE_INCR:
+		item, err = peer.Server.KVStore.Incr(packet.Key, packet.Delta)
+	case packets.CMD_KVSTORE_DECR:
+		item, err = peer.Server.KVStore.Decr(packet.Key, packet.Delta)
+	case packets.CMD_KVSTORE_APPEND:
+		item, err = peer.Server.KVStore.Append(packet.Key, packet.Data)
+	case packets.CMD_KVSTORE_PREPEND:
+		item, err = peer.Server.KVStore.Prepend(packet.Key, packet.Data)
+	}
+	if err == nil {
+		err = peer.Server.persist(packet.Consistency)
+	}
+
+	var response *packets.Packet
+
+	switch err {
+	case nil:
+		payload := packets.KVStorePacket{
+			Command:   packet.Command,
+			Key:       item.Key,
+			Data:      item.Data,
+			ExpiresAt: item.ExpiresAt,
+			Flags:     item.Flags,
+			Version:   item.Version,
+		}
+		packKeyspace(&payload)
+		payload.Compress(peer.Server.CompressThreshold)
+		response = packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, request.ID, payload)
+		peer.Logger.Debug("Peer", "%02X: KVStoreUpdate: %s Stored (v%d), replying", peer.ServerNetworkNode.ID, packet.Key, item.Version)
+	case kvstore.ErrNotFound:
+		response = packets.NewResponsePacket(packets.CMD_KVSTORE_NOT_FOUND, request.ID, packet.Key)
+		peer.Logger.Debug("Peer", "%02X: KVStoreUpdate: %s Not found, replying", peer.ServerNetworkNode.ID, packet.Key)
+	default:
+		response = packets.NewResponsePacket(packets.CMD_KVSTORE_ERROR, request.ID, err.Error())
+		peer.Logger.Debug("Peer", "%02X: KVStoreUpdate: %s Failed (%s), replying", peer.ServerNetworkNode.ID, packet.Key, err.Error())
+	}
+
+	peer.SendPacket(response)
+}
+
+// handleKVStoreGet replies with the item for the key or, if it has been deleted, its tombstone as a
+// CMD_KVSTORE_DELETE, so that the sender can compare the versions held by each replica.
 func (peer *Peer) handleKVStoreGet(packet *packets.KVStorePacket, request *packets.Packet) {
 	peer.Logger.Debug("Peer", "%02X: KVStoreGet: %s", peer.ServerNetworkNode.ID, packet.Key)
-	value, flags, found := peer.Server.KVStore.Get(packet.Key)
+	item, found := peer.Server.KVStore.Lookup(packet.Key)
 
 	var response *packets.Packet
 
 	if found {
+		command := int16(packets.CMD_KVSTORE_GET)
+		if item.Tombstone {
+			command = packets.CMD_KVSTORE_DELETE
+		}
 		payload := packets.KVStorePacket{
-			Command: packets.CMD_KVSTORE_GET,
-			Key:     packet.Key,
-			Data:    value,
-			Flags:   flags,
+			Command:   command,
+			Key:       packet.Key,
+			Data:      item.Data,
+			ExpiresAt: item.ExpiresAt,
+			Flags:     item.Flags,
+			Version:   item.Version,
 		}
+		packKeyspace(&payload)
+		payload.Compress(peer.Server.CompressThreshold)
 		response = packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, request.ID, payload)
-		peer.Logger.Debug("Peer", "%02X: KVStoreGet: %s = %s, replying", peer.ServerNetworkNode.ID, packet.Key, value)
+		peer.Logger.Debug("Peer", "%02X: KVStoreGet: %s = %s, replying", peer.ServerNetworkNode.ID, packet.Key, item.Data)
 	} else {
 		response = packets.NewResponsePacket(packets.CMD_KVSTORE_NOT_FOUND, request.ID, packet.Key)
 		peer.Logger.Debug("Peer", "%02X: KVStoreGet: %s Not found, replying", peer.ServerNetworkNode.ID, packet.Key)
@@ -399,17 +578,39 @@ func (peer *Peer) handleKVStoreIsSet(packet *packets.KVStorePacket, request *pac
 
 func (peer *Peer) handleKVStoreDelete(packet *packets.KVStorePacket, request *packets.Packet) {
 	peer.Logger.Debug("Peer", "%02X: KVStoreDelete: %s", peer.ServerNetworkNode.ID, packet.Key)
-	found := peer.Server.KVStore.Delete(packet.Key)
+	version, found, err := peer.Server.KVStore.DeleteVersion(packet.Key, packet.Version)
+	if err == nil {
+		err = peer.Server.persist(packet.Consistency)
+	}
 
 	var response *packets.Packet
 
-	if found {
-		response = packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, request.ID, packet.Key)
-		peer.Logger.Debug("Peer", "%02X: KVStoreDelete: %s Deleted, replying", peer.ServerNetworkNode.ID, packet.Key)
-	} else {
-		response = packets.NewResponsePacket(packets.CMD_KVSTORE_NOT_FOUND, request.ID, packet.Key)
-		peer.Logger.Debug("Peer", "%02X: KVStoreDelete: %s Not found, replying", peer.ServerNetworkNode.ID, packet.Key)
+	payload := packets.KVStorePacket{
+		Command: packets.CMD_KVSTORE_DELETE,
+		Key:     packet.Key,
+		Version: version,
 	}
+	packKeyspace(&payload)
+	switch {
+	case err != nil:
+		response = packets.NewResponsePacket(packets.CMD_KVSTORE_ERROR, request.ID, err.Error())
+		peer.Logger.Debug("Peer", "%02X: KVStoreDelete: %s Failed (%s), replying", peer.ServerNetworkNode.ID, packet.Key, err.Error())
+	case found:
+		response = packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, request.ID, payload)
+		peer.Logger.Debug("Peer", "%02X: KVStoreDelete: %s Deleted (v%d), replying", peer.ServerNetworkNode.ID, packet.Key, version)
+	default:
+		response = packets.NewResponsePacket(packets.CMD_KVSTORE_NOT_FOUND, request.ID, payload)
+		peer.Logger.Debug("Peer", "%02X: KVStoreDelete: %s Not found (v%d), replying", peer.ServerNetworkNode.ID, packet.Key, version)
+	}
+
+	peer.SendPacket(response)
+}
+
+func (peer *Peer) handleKVStoreDropKeyspace(packet *packets.KVStorePacket, request *packets.Packet) {
+	peer.Logger.Debug("Peer", "%02X: KVStoreDropKeyspace: %s", peer.ServerNetworkNode.ID, packet.Keyspace)
+	count := peer.Server.KVStore.DropKeyspace(packet.Keyspace)
 
+	response := packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, request.ID, packet.Keyspace)
+	peer.Logger.Debug("Peer", "%02X: KVStoreDropKeyspace: %s Dropped %d, replying", peer.ServerNetworkNode.ID, packet.Keyspace, count)
 	peer.SendPacket(response)
 }
@@ -35,6 +35,7 @@ func (peer *Peer) process_CMD_DISTRIBUTION(packet packets.Packet) {
 	}
 
 	// The connection may be from a node we're already connected to, If so, shut it down.
+	joined := false
 	if peer.Server.ServerNode.NodeRegistered(peer.ServerNetworkNode.ID) {
 		// Peer has previously registered
 		peer.Logger.Debug("Peer", "%02X: Node Already Registered", peer.ServerNetworkNode.ID)
@@ -45,11 +46,27 @@ func (peer *Peer) process_CMD_DISTRIBUTION(packet packets.Packet) {
 			peer.Logger.Error("Peer", "%02X: Register Node Distribution Failed: %s", peer.ServerNetworkNode.ID, err.Error())
 			return
 		}
+		joined = true
 	}
 
 	// Peer is now connected, update the heartbeat
-	peer.State = PeerStateConnected
 	peer.LastHeartbeat = time.Now()
+	if joined {
+		// The peer now holds replicas of some keys held here. It is written to, but not read from, until every
+		// node has sent it their keys and it is PeerStateReady. If this node is joining, the peer sends this node
+		// its keys likewise, and otherwise this node can be read from already.
+		peer.SetState(PeerStateSyncing)
+		if !peer.Server.awaitSync(peer.ServerNetworkNode.ID) {
+			peer.SendPacket(packets.NewPacket(packets.CMD_SYNC_READY, nil))
+		}
+		peer.Server.beginRebalance(peer.ServerNetworkNode.ID)
+		go peer.Server.Rebalance(peer)
+	} else {
+		peer.SetState(PeerStateConnected)
+	}
+
+	// Deliver the writes it missed while it was unavailable
+	go peer.Server.ReplayHints(peer.ServerNetworkNode.ID)
 
 	// And ask the server to notify all peers of all other peers
 	peer.Server.NotifyAllPeers()
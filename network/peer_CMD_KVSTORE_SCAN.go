@@ -0,0 +1,41 @@
+package network
+
+import (
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// process_CMD_KVSTORE_SCAN processes a CMD_KVSTORE_SCAN packet received from a peer.
+// The peer is sent a page of the items held by this node, in key order, as part of a cluster-wide scan. Tombstones
+// are included, as CMD_KVSTORE_DELETE items, so that deleted keys are not returned from other replicas.
+func (peer *Peer) process_CMD_KVSTORE_SCAN(packet packets.Packet) {
+	request := packet.Payload.(packets.ScanPacket)
+	peer.Logger.Debug("Peer", "%02X: CMD_KVSTORE_SCAN (%q - %q, prefix %q)", peer.ServerNetworkNode.ID, request.Start, request.End, request.Prefix)
+
+	items := scanLocal(peer.Server.KVStore, kvstore.ScanOptions{
+		Start:      request.Start,
+		End:        request.End,
+		Prefix:     request.Prefix,
+		Limit:      request.Limit,
+		Reverse:    request.Reverse,
+		Tombstones: true,
+	})
+	page := packets.ScanPagePacket{Items: make([]packets.KVStorePacket, len(items))}
+	for i, item := range items {
+		command := int16(packets.CMD_KVSTORE_GET)
+		if item.Tombstone {
+			command = packets.CMD_KVSTORE_DELETE
+		}
+		page.Items[i] = packets.KVStorePacket{
+			Command:   command,
+			Key:       item.Key,
+			Data:      item.Data,
+			ExpiresAt: item.ExpiresAt,
+			Flags:     item.Flags,
+			Version:   item.Version,
+		}
+		packKeyspace(&page.Items[i])
+		page.Items[i].Compress(peer.Server.CompressThreshold)
+	}
+	peer.SendPacket(packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, packet.ID, page))
+}
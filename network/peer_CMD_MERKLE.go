@@ -0,0 +1,53 @@
+package network
+
+import (
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// process_CMD_MERKLE_HASHES processes a CMD_MERKLE_HASHES packet received from a peer running anti-entropy.
+// The peer is sent the hashes of the requested nodes of the Merkle tree of the keys this node shares with it. The
+// tree is rebuilt when the root is requested, at the start of each exchange. It runs in its own goroutine, as
+// building the tree scans the store.
+func (peer *Peer) process_CMD_MERKLE_HASHES(packet packets.Packet) {
+	request := packet.Payload.(packets.MerkleHashesPacket)
+	peer.Logger.Debug("Peer", "%02X: CMD_MERKLE_HASHES (level %d, %d nodes)", peer.ServerNetworkNode.ID, request.Level, len(request.Indices))
+
+	tree := peer.Server.merkleTreeFor(peer.ServerNetworkNode.ID, request.Level == 0)
+	hashes, ok := tree.hashes(request.Level, request.Indices)
+	if !ok {
+		peer.SendPacket(packets.NewResponsePacket(packets.CMD_KVSTORE_ERROR, packet.ID, "Invalid Merkle Node"))
+		return
+	}
+	peer.SendPacket(packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, packet.ID, packets.MerkleHashesPacket{Level: request.Level, Indices: request.Indices, Hashes: hashes}))
+}
+
+// process_CMD_MERKLE_KEYS processes a CMD_MERKLE_KEYS packet received from a peer running anti-entropy.
+// The peer is sent the keys and versions, without values, of the keys this node shares with it in the requested
+// leaves of the Merkle tree. It runs in its own goroutine, as finding the keys scans the store.
+func (peer *Peer) process_CMD_MERKLE_KEYS(packet packets.Packet) {
+	request := packet.Payload.(packets.MerkleKeysPacket)
+	peer.Logger.Debug("Peer", "%02X: CMD_MERKLE_KEYS (%d leaves)", peer.ServerNetworkNode.ID, len(request.Leaves))
+
+	items := peer.Server.leafItems(peer.ServerNetworkNode.ID, request.Leaves)
+	reply := packets.MerkleKeysPacket{Leaves: request.Leaves, Items: make([]packets.KVStorePacket, 0, len(items))}
+	for _, item := range items {
+		reply.Items = append(reply.Items, merkleKeyPacket(item))
+	}
+	peer.SendPacket(packets.NewResponsePacket(packets.CMD_KVSTORE_ACK, packet.ID, reply))
+}
+
+// merkleKeyPacket returns the packet of the key, version and tombstone of an item, without its value.
+func merkleKeyPacket(item *kvstore.Item) packets.KVStorePacket {
+	command := int16(packets.CMD_KVSTORE_GET)
+	if item.Tombstone {
+		command = packets.CMD_KVSTORE_DELETE
+	}
+	kvpacket := packets.KVStorePacket{
+		Command: command,
+		Key:     item.Key,
+		Version: item.Version,
+	}
+	packKeyspace(&kvpacket)
+	return kvpacket
+}
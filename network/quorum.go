@@ -0,0 +1,139 @@
+package network
+
+import (
+	"errors"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// ErrQuorumNotMet is returned when fewer replicas than the read or write quorum answered a request.
+var ErrQuorumNotMet = errors.New("quorum not met")
+
+// ReadOptions are the options of a read from the cluster.
+type ReadOptions struct {
+	// R is the number of replicas that must answer a read, or 0 for the server's ReadQuorum.
+	R int
+}
+
+// WriteOptions are the options of a write to the cluster.
+type WriteOptions struct {
+	// Consistency is the consistency mode of the write, or 0 for the server's mode.
+	Consistency packets.Consistency
+	// W is the number of replicas that must acknowledge the write before it returns, or 0 for the server's
+	// WriteQuorum. If both are 0, the consistency mode decides.
+	W int
+}
+
+// readReply is the answer of a replica to a read. item is nil if the replica does not hold the key, and may be
+// a tombstone.
+type readReply struct {
+	id   ch.NodeId
+	item *kvstore.Item
+	err  error
+}
+
+// readQuorum returns how many of the given number of replicas must answer a read.
+func (svr *TLSServer) readQuorum(options ReadOptions, replicas int) int {
+	r := options.R
+	if r <= 0 {
+		r = svr.ReadQuorum
+	}
+	if r < 1 {
+		r = 1
+	}
+	if r > replicas {
+		r = replicas
+	}
+	return r
+}
+
+// writeQuorum returns how many of the given number of replicas must acknowledge a write in the consistency
+// mode before it returns.
+func (svr *TLSServer) writeQuorum(options WriteOptions, mode packets.Consistency, replicas int) int {
+	w := options.W
+	if w <= 0 {
+		w = svr.WriteQuorum
+	}
+	if w <= 0 {
+		return acksFor(mode, replicas)
+	}
+	if w > replicas {
+		w = replicas
+	}
+	return w
+}
+
+// readFrom reads the key from r of the given replicas in parallel, starting with this node if it is one, and
+// returns the answers once r have answered. A replica that fails is replaced by the next, so fewer than r
+// answers are returned only if too few replicas are available.
+func (svr *TLSServer) readFrom(ids []ch.NodeId, key string, r int) []readReply {
+	ordered := make([]ch.NodeId, 0, len(ids))
+	for _, id := range ids {
+		if id == svr.ServerNode.ID {
+			ordered = append([]ch.NodeId{id}, ordered...)
+		} else {
+			ordered = append(ordered, id)
+		}
+	}
+
+	results := make(chan readReply, len(ordered))
+	next, pending := 0, 0
+	send := func() {
+		id := ordered[next]
+		next++
+		pending++
+		go func() {
+			item, err := svr.readOne(id, key)
+			results <- readReply{id: id, item: item, err: err}
+		}()
+	}
+	for next < r && next < len(ordered) {
+		send()
+	}
+
+	replies := []readReply{}
+	for pending > 0 && len(replies) < r {
+		reply := <-results
+		pending--
+		switch reply.err {
+		case nil:
+		case kvstore.ErrNotFound:
+			reply.err = nil
+		default:
+			svr.Logger.Warn("Server", "GetKey: Peer for key [%s] -> %02X Failed: %s", key, reply.id, reply.err.Error())
+			if next < len(ordered) {
+				send()
+			}
+			continue
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// readOne reads the key or its tombstone from a replica, returning kvstore.ErrNotFound if it holds neither.
+func (svr *TLSServer) readOne(id ch.NodeId, key string) (*kvstore.Item, error) {
+	if id == svr.ServerNode.ID {
+		svr.Logger.Debug("Server", "GetKey: Peer for key [%s] -> %02X (Local)", key, id)
+		item, found := svr.KVStore.Lookup(key)
+		if !found {
+			return nil, kvstore.ErrNotFound
+		}
+		return item, nil
+	}
+	svr.Logger.Debug("Server", "GetKey: Peer for key [%s] -> %02X (Remote)", key, id)
+	return svr.remoteGet(id, key)
+}
+
+// newestReply returns the newest item in the replies, which may be a tombstone, or nil if none hold the key.
+func newestReply(replies []readReply) *kvstore.Item {
+	var newest *kvstore.Item
+	for _, reply := range replies {
+		if reply.item != nil && (newest == nil || reply.item.Version > newest.Version) {
+			newest = reply.item
+		}
+	}
+	return newest
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestQuorums(t *testing.T) {
+	inst := NewTLSServer(util.NewLogger("error"), nil, nil, "HOSTNAME", false)
+
+	assert.Equal(t, 1, inst.readQuorum(ReadOptions{}, 3))
+	assert.Equal(t, 2, inst.readQuorum(ReadOptions{R: 2}, 3))
+	assert.Equal(t, 3, inst.readQuorum(ReadOptions{R: 5}, 3))
+
+	// The consistency mode decides unless a quorum is set
+	assert.Equal(t, 1, inst.writeQuorum(WriteOptions{}, packets.WRITE_COMMITTED, 3))
+	assert.Equal(t, 3, inst.writeQuorum(WriteOptions{}, packets.WRITE_REPLICATED, 3))
+	assert.Equal(t, 2, inst.writeQuorum(WriteOptions{W: 2}, packets.WRITE_REPLICATED, 3))
+	inst.WriteQuorum = 2
+	assert.Equal(t, 2, inst.writeQuorum(WriteOptions{}, packets.WRITE_COMMITTED, 3))
+	assert.Equal(t, 3, inst.writeQuorum(WriteOptions{W: 3}, packets.WRITE_COMMITTED, 3))
+}
+
+func TestNewestReply(t *testing.T) {
+	assert.Nil(t, newestReply([]readReply{{}, {}}))
+
+	replies := []readReply{
+		{item: &kvstore.Item{Key: "key", Version: 2}},
+		{},
+		{item: &kvstore.Item{Key: "key", Version: 3, Tombstone: true}},
+	}
+	newest := newestReply(replies)
+	assert.Equal(t, uint64(3), newest.Version)
+	assert.True(t, newest.Tombstone)
+}
+
+func TestReadFrom(t *testing.T) {
+	logger := util.NewLogger("error")
+	kv := kvstore.NewKVStore(logger)
+	inst := NewTLSServer(logger, nil, kv, "HOSTNAME", false)
+	kv.Set("key", []byte("value"), 0, nil)
+	// Two replicas that are not connected
+	ids := []ch.NodeId{ch.NodeId(ch.NewMD5Key("a")), inst.ServerNode.ID, ch.NodeId(ch.NewMD5Key("b"))}
+
+	replies := inst.readFrom(ids, "key", 1)
+	assert.Equal(t, 1, len(replies))
+	assert.Equal(t, inst.ServerNode.ID, replies[0].id)
+	assert.Equal(t, []byte("value"), replies[0].item.Data)
+
+	// The unavailable replicas are replaced in turn, but too few answer
+	replies = inst.readFrom(ids, "key", 2)
+	assert.Equal(t, 1, len(replies))
+
+	replies = inst.readFrom(ids, "missing", 1)
+	assert.Equal(t, 1, len(replies))
+	assert.Nil(t, replies[0].item)
+}
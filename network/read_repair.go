@@ -0,0 +1,86 @@
+package network
+
+import (
+	"math/rand"
+	"sync/atomic"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+)
+
+// DefaultReadRepairChance is the probability that a read is followed by a read repair unless ReadRepairChance
+// is set.
+const DefaultReadRepairChance = 0.1
+
+// ReadRepairs returns the number of stale or missing replicas that have been repaired after reads.
+func (svr *TLSServer) ReadRepairs() uint64 {
+	return atomic.LoadUint64(&svr.readRepairs)
+}
+
+// maybeReadRepair starts a read repair of the key in the background with a probability of ReadRepairChance.
+func (svr *TLSServer) maybeReadRepair(key string, ids []ch.NodeId, replies []readReply) {
+	if svr.ReadRepairChance <= 0 || rand.Float64() >= svr.ReadRepairChance {
+		return
+	}
+	go svr.readRepair(key, ids, replies)
+}
+
+// readRepair reads the key from the replicas that did not answer a read, and brings every replica that holds an
+// older copy of the key, or none, up to date with the newest copy.
+func (svr *TLSServer) readRepair(key string, ids []ch.NodeId, replies []readReply) {
+	answered := map[ch.NodeId]bool{}
+	for _, reply := range replies {
+		answered[reply.id] = true
+	}
+	for _, id := range ids {
+		if answered[id] {
+			continue
+		}
+		item, err := svr.readOne(id, key)
+		switch err {
+		case nil:
+		case kvstore.ErrNotFound:
+			item = nil
+		default:
+			svr.Logger.Debug("Server", "ReadRepair: [%s] from %02X Failed: %s", key, id, err.Error())
+			continue
+		}
+		replies = append(replies, readReply{id: id, item: item})
+	}
+	svr.repairReplicas(key, replies)
+}
+
+// repairReplicas writes the newest copy of the key in the replies to each replica with an older copy or none,
+// returning how many were repaired. Tombstones are repaired with a delete, so a missed delete is not undone.
+func (svr *TLSServer) repairReplicas(key string, replies []readReply) int {
+	newest := newestReply(replies)
+	if newest == nil {
+		return 0
+	}
+	mode := svr.consistency(0)
+	repaired := 0
+	for _, reply := range replies {
+		if reply.item != nil && reply.item.Version >= newest.Version {
+			continue
+		}
+		var err error
+		switch {
+		case reply.id == svr.ServerNode.ID && newest.Tombstone:
+			_, _, err = svr.KVStore.DeleteVersion(key, newest.Version)
+		case reply.id == svr.ServerNode.ID:
+			_, err = svr.KVStore.SetVersion(key, newest.Data, newest.Flags, newest.ExpiresAt, newest.Version)
+		case newest.Tombstone:
+			_, _, err = svr.remoteDelete(mode, reply.id, key, newest.Version)
+		default:
+			_, err = svr.remoteSet(mode, reply.id, key, newest.Data, newest.Flags, newest.ExpiresAt, newest.Version)
+		}
+		if err != nil {
+			svr.Logger.Warn("Server", "ReadRepair: [%s] on %02X Failed: %s", key, reply.id, err.Error())
+			continue
+		}
+		svr.Logger.Info("Server", "ReadRepair: [%s] Repaired %02X (v%d)", key, reply.id, newest.Version)
+		atomic.AddUint64(&svr.readRepairs, 1)
+		repaired++
+	}
+	return repaired
+}
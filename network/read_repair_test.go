@@ -0,0 +1,66 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestRepairReplicas(t *testing.T) {
+	logger := util.NewLogger("error")
+	kv := kvstore.NewKVStore(logger)
+	inst := NewTLSServer(logger, nil, kv, "HOSTNAME", false)
+	remote := ch.NodeId(ch.NewMD5Key("a"))
+
+	version, err := kv.SetVersion("key", []byte("old"), 0, nil, 0)
+	assert.Nil(t, err)
+	local, _ := kv.Lookup("key")
+
+	// Nothing to repair if no replica holds the key, or every replica is up to date
+	assert.Equal(t, 0, inst.repairReplicas("key", []readReply{{id: inst.ServerNode.ID}, {id: remote}}))
+	assert.Equal(t, 0, inst.repairReplicas("key", []readReply{{id: inst.ServerNode.ID, item: local}}))
+
+	// The stale local copy is repaired, the unavailable remote replica is not
+	newer := &kvstore.Item{Key: "key", Data: []byte("new"), Flags: 3, Version: version + 1}
+	replies := []readReply{{id: inst.ServerNode.ID, item: local}, {id: remote, item: newer}, {id: ch.NodeId(ch.NewMD5Key("b"))}}
+	assert.Equal(t, 1, inst.repairReplicas("key", replies))
+	assert.Equal(t, uint64(1), inst.ReadRepairs())
+	item, found := kv.GetItem("key")
+	assert.True(t, found)
+	assert.Equal(t, []byte("new"), item.Data)
+	assert.Equal(t, int16(3), item.Flags)
+	assert.Equal(t, version+1, item.Version)
+
+	// A missing local copy is repaired with the tombstone of a delete
+	deleted := &kvstore.Item{Key: "key", Version: version + 2, Tombstone: true}
+	assert.Equal(t, 1, inst.repairReplicas("key", []readReply{{id: inst.ServerNode.ID, item: item}, {id: remote, item: deleted}}))
+	assert.Equal(t, uint64(2), inst.ReadRepairs())
+	_, found = kv.GetItem("key")
+	assert.False(t, found)
+	tombstone, found := kv.Lookup("key")
+	assert.True(t, found)
+	assert.True(t, tombstone.Tombstone)
+}
+
+func TestReadRepair(t *testing.T) {
+	logger := util.NewLogger("error")
+	kv := kvstore.NewKVStore(logger)
+	inst := NewTLSServer(logger, nil, kv, "HOSTNAME", false)
+	remote := ch.NodeId(ch.NewMD5Key("a"))
+
+	// The local replica did not answer the read, so is read and repaired
+	newer := &kvstore.Item{Key: "key", Data: []byte("value"), Version: 5}
+	inst.readRepair("key", []ch.NodeId{remote, inst.ServerNode.ID}, []readReply{{id: remote, item: newer}})
+	assert.Equal(t, uint64(1), inst.ReadRepairs())
+	item, found := kv.GetItem("key")
+	assert.True(t, found)
+	assert.Equal(t, uint64(5), item.Version)
+
+	// Read repair is disabled with a chance of 0
+	inst.ReadRepairChance = 0
+	inst.maybeReadRepair("key", []ch.NodeId{inst.ServerNode.ID}, []readReply{{id: remote, item: &kvstore.Item{Key: "key", Version: 6}}})
+	assert.Equal(t, uint64(1), inst.ReadRepairs())
+}
@@ -0,0 +1,202 @@
+package network
+
+import (
+	"time"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// DefaultRebalanceRetryDelay is how long to wait before sending a joining node its keys again after sending
+// failed, unless RebalanceRetryDelay is set.
+const DefaultRebalanceRetryDelay = 30 * time.Second
+
+// Available returns true if the peer is connected, whether or not it is syncing or leaving.
+func (peer *Peer) Available() bool {
+	switch peer.State() {
+	case PeerStateConnected, PeerStateSyncing, PeerStateReady, PeerStateLeaving:
+		return true
+	}
+	return false
+}
+
+// Syncing returns true while this node is waiting for nodes that it has joined to send it its keys.
+func (svr *TLSServer) Syncing() bool {
+	svr.syncMutex.Lock()
+	defer svr.syncMutex.Unlock()
+	return len(svr.syncingFrom) > 0
+}
+
+// awaitSync records that the peer, which this node has just joined, will send this node the keys it now holds a
+// replica of, returning true. Once this node has been sent its keys by the nodes it joined it does not wait for
+// the nodes that join after it, which are sent keys by this node instead, and false is returned.
+func (svr *TLSServer) awaitSync(id ch.NodeId) bool {
+	svr.syncMutex.Lock()
+	defer svr.syncMutex.Unlock()
+	if svr.synced {
+		return false
+	}
+	svr.syncingFrom[id] = true
+	return true
+}
+
+// syncComplete records that the peer has sent this node its keys, or has gone. Once every peer has, this node
+// tells every peer that it is ready to be read from.
+func (svr *TLSServer) syncComplete(id ch.NodeId) {
+	svr.syncMutex.Lock()
+	_, found := svr.syncingFrom[id]
+	delete(svr.syncingFrom, id)
+	ready := found && len(svr.syncingFrom) == 0
+	svr.synced = svr.synced || ready
+	svr.syncMutex.Unlock()
+	if !ready {
+		return
+	}
+	svr.Logger.Info("Server", "Sync Complete, Ready")
+	for _, peer := range svr.Connections() {
+		if peer.Available() {
+			peer.SendPacket(packets.NewPacket(packets.CMD_SYNC_READY, nil))
+		}
+	}
+}
+
+// readableReplicas returns the replicas that can be read from, leaving out peers that are syncing, and this node
+// while it is. If none can, every replica is returned.
+func (svr *TLSServer) readableReplicas(ids []ch.NodeId) []ch.NodeId {
+	readable := make([]ch.NodeId, 0, len(ids))
+	for _, id := range ids {
+		if id == svr.ServerNode.ID {
+			if !svr.Syncing() {
+				readable = append(readable, id)
+			}
+			continue
+		}
+		peer, found := svr.ConnectionGet(id)
+		if found && peer.State() == PeerStateSyncing {
+			continue
+		}
+		readable = append(readable, id)
+	}
+	if len(readable) == 0 {
+		return ids
+	}
+	return readable
+}
+
+// Rebalance sends a peer that has just joined the cluster every key and tombstone this node holds that the peer
+// is now a replica of, then tells it that the copy is complete. Keys that this node is no longer a replica of are
+// then removed, once every peer that has joined has been sent its keys without error. It returns the number of
+// keys sent.
+func (svr *TLSServer) Rebalance(peer *Peer) (int, error) {
+	id := peer.ServerNetworkNode.ID
+	sent, err := svr.handOver(id, &remoteReplica{svr: svr, id: id})
+	if peer.Available() {
+		peer.SendPacket(packets.NewPacket(packets.CMD_SYNC_COMPLETE, nil))
+	}
+	svr.finishRebalance(id, sent, err)
+	return sent, err
+}
+
+// beginRebalance records that the peer has joined and is to be sent its keys. Until it has been, no keys are
+// removed by the rebalance of another peer.
+func (svr *TLSServer) beginRebalance(id ch.NodeId) {
+	svr.syncMutex.Lock()
+	svr.handingOver[id] = true
+	svr.syncMutex.Unlock()
+}
+
+// finishRebalance records that the peer has been sent its keys, or that sending failed, then removes the keys
+// this node is no longer a replica of if no peer is still to be sent its keys and none failed. A failed peer is
+// sent its keys again after RebalanceRetryDelay.
+func (svr *TLSServer) finishRebalance(id ch.NodeId, sent int, err error) {
+	svr.syncMutex.Lock()
+	delete(svr.handingOver, id)
+	if err != nil {
+		svr.handOverFailed[id] = true
+	} else {
+		delete(svr.handOverFailed, id)
+	}
+	pending, failed := len(svr.handingOver), len(svr.handOverFailed)
+	svr.syncMutex.Unlock()
+
+	if err != nil {
+		svr.Logger.Warn("Server", "Rebalance: Sent %d keys to %02X, Keeping Old Keys, Retrying in %s: %s", sent, id, svr.RebalanceRetryDelay, err.Error())
+		svr.retryRebalance(id)
+		return
+	}
+	if pending > 0 || failed > 0 {
+		svr.Logger.Info("Server", "Rebalance: Sent %d keys to %02X, Keeping Old Keys for %d Pending, %d Failed Peers", sent, id, pending, failed)
+		return
+	}
+	forgotten := svr.forgetKeys()
+	svr.Logger.Info("Server", "Rebalance: Sent %d keys to %02X, Removed %d keys", sent, id, forgotten)
+}
+
+// retryRebalance sends the peer its keys again after RebalanceRetryDelay, unless it has gone.
+func (svr *TLSServer) retryRebalance(id ch.NodeId) {
+	time.AfterFunc(svr.RebalanceRetryDelay, func() {
+		peer, found := svr.ConnectionGet(id)
+		if !found {
+			return
+		}
+		if !peer.Available() {
+			svr.retryRebalance(id)
+			return
+		}
+		svr.beginRebalance(id)
+		svr.Rebalance(peer)
+	})
+}
+
+// handOver sends the replica every key and tombstone this node holds that the replica is now a replica of,
+// returning how many were sent and the first error.
+func (svr *TLSServer) handOver(id ch.NodeId, replica merkleReplica) (int, error) {
+	sent := 0
+	var first error
+	cursor := svr.KVStore.Scan(kvstore.ScanOptions{Tombstones: true})
+	for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+		if !svr.isReplica(ch.NewMD5Key(item.Key), id) {
+			continue
+		}
+		err := replica.put(item)
+		if err != nil {
+			svr.Logger.Warn("Server", "Rebalance: [%s] to %02X Failed: %s", item.Key, id, err.Error())
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, first
+}
+
+// forgetKeys removes the keys and tombstones this node is no longer a replica of, returning how many live keys
+// were removed.
+func (svr *TLSServer) forgetKeys() int {
+	versions := map[string]uint64{}
+	cursor := svr.KVStore.Scan(kvstore.ScanOptions{Tombstones: true})
+	for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+		if !svr.isReplica(ch.NewMD5Key(item.Key), svr.ServerNode.ID) {
+			versions[item.Key] = item.Version
+		}
+	}
+	count := 0
+	for key, version := range versions {
+		if svr.KVStore.Forget(key, version) {
+			count++
+		}
+	}
+	return count
+}
+
+// isReplica returns true if the node is one of the replicas of the key with the given MD5.
+func (svr *TLSServer) isReplica(keymd5 ch.Key, id ch.NodeId) bool {
+	for _, replica := range svr.replicasFor(keymd5) {
+		if replica == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestHandOver(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	a.ReplicationFactor, b.ReplicationFactor = 1, 1
+	for i := 0; i < 100; i++ {
+		a.KVStore.SetVersion(fmt.Sprintf("key%d", i), []byte("value"), 0, nil, 10)
+	}
+	a.KVStore.SetVersion("deleted", []byte("value"), 0, nil, 10)
+	a.KVStore.DeleteVersion("deleted", 11)
+
+	// b joins, and now holds some of the keys
+	a.ServerNode.RegisterNode(&b.ServerNode.ServerNetworkNode)
+	b.ServerNode.RegisterNode(&a.ServerNode.ServerNetworkNode)
+	moved := 0
+	for i := 0; i < 100; i++ {
+		if a.isReplica(ch.NewMD5Key(fmt.Sprintf("key%d", i)), b.ServerNode.ID) {
+			moved++
+		}
+	}
+	if a.isReplica(ch.NewMD5Key("deleted"), b.ServerNode.ID) {
+		moved++
+	}
+
+	sent, err := a.handOver(b.ServerNode.ID, &localReplica{svr: b, requester: a.ServerNode.ID})
+	assert.Nil(t, err)
+	assert.Equal(t, moved, sent)
+	a.forgetKeys()
+
+	// Each key is held by its replica only, with its version
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner, other := a, b
+		if a.isReplica(ch.NewMD5Key(key), b.ServerNode.ID) {
+			owner, other = b, a
+		}
+		item, found := owner.KVStore.GetItem(key)
+		assert.True(t, found)
+		assert.Equal(t, uint64(10), item.Version)
+		assert.False(t, other.KVStore.IsSet(key))
+	}
+	owner := a
+	if a.isReplica(ch.NewMD5Key("deleted"), b.ServerNode.ID) {
+		owner = b
+	}
+	tombstone, found := owner.KVStore.Lookup("deleted")
+	assert.True(t, found)
+	assert.True(t, tombstone.Tombstone)
+}
+
+func TestRebalanceJoiners(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	x := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "x", false)
+	y := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "y", false)
+	a.ReplicationFactor = 1
+	for i := 0; i < 100; i++ {
+		a.KVStore.SetVersion(fmt.Sprintf("key%d", i), []byte("value"), 0, nil, 10)
+	}
+
+	// x and y join at once
+	a.ServerNode.RegisterNode(&x.ServerNode.ServerNetworkNode)
+	a.ServerNode.RegisterNode(&y.ServerNode.ServerNetworkNode)
+	a.beginRebalance(x.ServerNode.ID)
+	a.beginRebalance(y.ServerNode.ID)
+
+	// Nothing is removed once x has its keys, as y does not yet
+	sent, err := a.handOver(x.ServerNode.ID, &localReplica{svr: x, requester: a.ServerNode.ID})
+	assert.Nil(t, err)
+	a.finishRebalance(x.ServerNode.ID, sent, err)
+	for i := 0; i < 100; i++ {
+		assert.True(t, a.KVStore.IsSet(fmt.Sprintf("key%d", i)))
+	}
+
+	// Nor if sending y its keys fails
+	a.finishRebalance(y.ServerNode.ID, 0, errors.New("Timeout"))
+	for i := 0; i < 100; i++ {
+		assert.True(t, a.KVStore.IsSet(fmt.Sprintf("key%d", i)))
+	}
+
+	// Once y has its keys too, a keeps only its own
+	a.beginRebalance(y.ServerNode.ID)
+	sent, err = a.handOver(y.ServerNode.ID, &localReplica{svr: y, requester: a.ServerNode.ID})
+	assert.Nil(t, err)
+	a.finishRebalance(y.ServerNode.ID, sent, err)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := a.replicasFor(ch.NewMD5Key(key))[0]
+		for _, svr := range []*TLSServer{a, x, y} {
+			assert.Equal(t, svr.ServerNode.ID == owner, svr.KVStore.IsSet(key), key)
+		}
+	}
+}
+
+func TestRebalanceRetry(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	a.ReplicationFactor, b.ReplicationFactor = 1, 1
+	a.RebalanceRetryDelay = 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		a.KVStore.SetVersion(fmt.Sprintf("key%d", i), []byte("value"), 0, nil, 10)
+	}
+	connectServers(a, b)
+
+	// Sending b its keys failed, so a keeps them
+	a.beginRebalance(b.ServerNode.ID)
+	a.finishRebalance(b.ServerNode.ID, 0, errors.New("Timeout"))
+	for i := 0; i < 100; i++ {
+		assert.True(t, a.KVStore.IsSet(fmt.Sprintf("key%d", i)))
+	}
+
+	// Until they are sent again
+	moved := func() bool {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			owner := a.replicasFor(ch.NewMD5Key(key))[0]
+			if a.KVStore.IsSet(key) != (owner == a.ServerNode.ID) || b.KVStore.IsSet(key) != (owner == b.ServerNode.ID) {
+				return false
+			}
+		}
+		return true
+	}
+	for start := time.Now(); !moved() && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, moved())
+}
+
+func TestSyncStates(t *testing.T) {
+	logger := util.NewLogger("error")
+	inst := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "HOSTNAME", false)
+	joined, ready := ch.NodeId(ch.NewMD5Key("a")), ch.NodeId(ch.NewMD5Key("b"))
+	inst.ConnectionSet(joined, peerInState(PeerStateSyncing))
+	inst.ConnectionSet(ready, peerInState(PeerStateReady))
+	ids := []ch.NodeId{joined, inst.ServerNode.ID, ready}
+
+	// Syncing peers are not read from
+	assert.Equal(t, []ch.NodeId{inst.ServerNode.ID, ready}, inst.readableReplicas(ids))
+
+	// Nor is this node while it waits for keys
+	assert.True(t, inst.awaitSync(joined))
+	assert.True(t, inst.Syncing())
+	assert.Equal(t, []ch.NodeId{ready}, inst.readableReplicas(ids))
+	assert.Equal(t, []ch.NodeId{joined, inst.ServerNode.ID}, inst.readableReplicas([]ch.NodeId{joined, inst.ServerNode.ID}))
+
+	// A peer that goes stops being waited for
+	inst.ConnectionClear(ready)
+	inst.ConnectionClear(joined)
+	assert.False(t, inst.Syncing())
+
+	// Once it has synced, it does not wait for nodes that join after it
+	assert.False(t, inst.awaitSync(joined))
+	assert.False(t, inst.Syncing())
+
+	for state, available := range map[uint]bool{PeerStateConnected: true, PeerStateSyncing: true, PeerStateReady: true, PeerStateDefib: false, PeerStateDisconnected: false} {
+		assert.Equal(t, available, peerInState(state).Available())
+	}
+}
+
+func peerInState(state uint) *Peer {
+	peer := &Peer{}
+	peer.SetState(state)
+	return peer
+}
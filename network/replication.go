@@ -0,0 +1,222 @@
+package network
+
+import (
+	"fmt"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// DefaultReplicationFactor is the number of nodes that hold each key unless ReplicationFactor is set.
+const DefaultReplicationFactor = 3
+
+// WriteResult reports the outcome of a write to the replicas of a key.
+type WriteResult struct {
+	// Version is the version of the write, as assigned by the first replica to accept it.
+	Version uint64
+	// Replicas is the number of nodes the write was sent to.
+	Replicas int
+	// Acks is the number of replicas that acknowledged the write before it returned. Replicas written in the
+	// background are not counted.
+	Acks int
+	// Found is true if a delete removed a live item from any replica that acknowledged it.
+	Found bool
+}
+
+// Complete returns true if every replica acknowledged the write.
+func (wr WriteResult) Complete() bool {
+	return wr.Acks == wr.Replicas
+}
+
+// replicasFor returns the IDs of the ReplicationFactor nodes that hold the key, in order of preference. Nodes that
+// are leaving the cluster are followed by the nodes that will inherit their keys, so that writes reach both.
+func (svr *TLSServer) replicasFor(keymd5 ch.Key) []ch.NodeId {
+	svr.syncMutex.Lock()
+	defer svr.syncMutex.Unlock()
+	ids := []ch.NodeId{}
+	count := 0
+	for _, node := range svr.ServerNode.GetNodesFor(keymd5, svr.ReplicationFactor+len(svr.leaving)) {
+		if count == svr.ReplicationFactor {
+			break
+		}
+		ids = append(ids, node.ID)
+		if !svr.leaving[node.ID] {
+			count++
+		}
+	}
+	return ids
+}
+
+// consistency returns the consistency mode of a write, which is the server's mode if mode is 0.
+func (svr *TLSServer) consistency(mode packets.Consistency) packets.Consistency {
+	if mode == 0 {
+		return svr.Consistency
+	}
+	return mode
+}
+
+// acksFor returns how many of the given number of replicas must acknowledge a write in the consistency mode
+// before it returns.
+func acksFor(mode packets.Consistency, replicas int) int {
+	switch mode {
+	case packets.WRITE_UNCOMMITTED:
+		return 0
+	case packets.WRITE_REPLICATED:
+		return replicas
+	}
+	return 1
+}
+
+// persist syncs the writes made on this node to stable storage if the consistency mode is durable.
+func (svr *TLSServer) persist(mode packets.Consistency) error {
+	if !mode.Durable() {
+		return nil
+	}
+	return svr.KVStore.Sync()
+}
+
+// writeAck is the outcome of a write to one node.
+type writeAck struct {
+	id    ch.NodeId
+	found bool
+	err   error
+}
+
+// writeOn writes to the given nodes with the given version or, if version is 0, with the version assigned by the
+// first node that accepts the write, which is written to on its own before the others are written to in
+// parallel. write returns the version the node stored and whether it held a live item. writeOn returns once wait
+// nodes have acknowledged the write, and the remaining writes complete in the background. Nodes that are
+// unavailable, do not reply or fail are skipped, and hint is called with the version for those that could not be
+// reached, and for lost nodes that would have been replicas. If fewer than wait nodes acknowledge the write, the first error is returned if none did, and
+// ErrQuorumNotMet otherwise.
+func (svr *TLSServer) writeOn(op string, ids []ch.NodeId, key string, version uint64, wait int, write func(id ch.NodeId, version uint64) (uint64, bool, error), hint func(id ch.NodeId, version uint64)) (WriteResult, error) {
+	result := WriteResult{Version: version, Replicas: len(ids)}
+	var first error
+	missed := []ch.NodeId{}
+	fail := func(id ch.NodeId, err error) {
+		svr.Logger.Warn("Server", "%s: Peer for key [%s] -> %02X Failed: %s", op, key, id, err.Error())
+		if first == nil {
+			first = err
+		}
+	}
+
+	// Until the version is known, nodes are written in turn
+	rest := ids
+	for result.Version == 0 && len(rest) > 0 {
+		if wait <= 0 {
+			go svr.writeOn(op, rest, key, 0, len(rest), write, hint)
+			return result, nil
+		}
+		id := rest[0]
+		rest = rest[1:]
+		stored, found, err := write(id, 0)
+		if err != nil {
+			fail(id, err)
+			if unavailable(err) {
+				missed = append(missed, id)
+			}
+			continue
+		}
+		result.Version, result.Acks, result.Found = stored, 1, found
+	}
+	if result.Version != 0 {
+		missed = append(missed, svr.downReplicas(ch.NewMD5Key(key))...)
+		for _, id := range missed {
+			hint(id, result.Version)
+		}
+	}
+
+	// Fan out
+	acks := make(chan writeAck, len(rest))
+	for _, id := range rest {
+		go func(id ch.NodeId, version uint64) {
+			_, found, err := write(id, version)
+			if unavailable(err) {
+				hint(id, version)
+			}
+			acks <- writeAck{id: id, found: found, err: err}
+		}(id, result.Version)
+	}
+	pending := len(rest)
+	for ; pending > 0 && result.Acks < wait; pending-- {
+		ack := <-acks
+		if ack.err != nil {
+			fail(ack.id, ack.err)
+			continue
+		}
+		result.Acks++
+		result.Found = result.Found || ack.found
+	}
+	if pending > 0 {
+		go svr.drainWrites(op, key, acks, pending)
+	}
+
+	if result.Acks < wait {
+		if result.Acks == 0 {
+			if first == nil {
+				first = errPeerUnavailable
+			}
+			return result, first
+		}
+		svr.Logger.Warn("Server", "%s: [%s] Acknowledged by %d of %d Replicas, %d Required", op, key, result.Acks, result.Replicas, wait)
+		return result, ErrQuorumNotMet
+	}
+	return result, nil
+}
+
+// drainWrites logs the failures of writes that complete after writeOn has returned.
+func (svr *TLSServer) drainWrites(op string, key string, acks chan writeAck, pending int) {
+	for ; pending > 0; pending-- {
+		ack := <-acks
+		if ack.err != nil {
+			svr.Logger.Warn("Server", "%s: Peer for key [%s] -> %02X Failed: %s", op, key, ack.id, ack.err.Error())
+		}
+	}
+}
+
+// deleteKeyOn deletes the key on each of the given nodes, leaving tombstones with the given version or, if
+// version is 0, with the version assigned by the first node that deletes it, returning once wait nodes have
+// acknowledged it.
+func (svr *TLSServer) deleteKeyOn(mode packets.Consistency, ids []ch.NodeId, key string, version uint64, wait int) (WriteResult, error) {
+	return svr.writeOn("DeleteKey", ids, key, version, wait, func(id ch.NodeId, version uint64) (uint64, bool, error) {
+		if id == svr.ServerNode.ID {
+			svr.Logger.Debug("Server", "DeleteKey: Peer for key [%s] -> %02X (Local)", key, id)
+			stored, found, err := svr.KVStore.DeleteVersion(key, version)
+			if err == nil {
+				err = svr.persist(mode)
+			}
+			return stored, found, err
+		}
+		svr.Logger.Debug("Server", "DeleteKey: Peer for key [%s] -> %02X (Remote)", key, id)
+		return svr.remoteDelete(mode, id, key, version)
+	}, func(id ch.NodeId, version uint64) {
+		svr.hint(id, &kvstore.Item{Key: key, Version: version, Tombstone: true})
+	})
+}
+
+// remoteDelete deletes the key on a remote node, returning the version of its tombstone and whether it held a
+// live item.
+func (svr *TLSServer) remoteDelete(mode packets.Consistency, id ch.NodeId, key string, version uint64) (uint64, bool, error) {
+	payload := packets.KVStorePacket{
+		Command:     packets.CMD_KVSTORE_DELETE,
+		Key:         key,
+		KeyHash:     ch.NewMD5Key(key),
+		Version:     version,
+		Consistency: mode,
+		TargetID:    id,
+	}
+	reply, err := svr.sendKVStorePacket(id, payload)
+	if err != nil {
+		return 0, false, err
+	}
+	switch reply.Command {
+	case packets.CMD_KVSTORE_ACK:
+		return reply.Payload.(packets.KVStorePacket).Version, true, nil
+	case packets.CMD_KVSTORE_NOT_FOUND:
+		return reply.Payload.(packets.KVStorePacket).Version, false, nil
+	case packets.CMD_KVSTORE_ERROR:
+		return 0, false, remoteError(reply.Payload.(string))
+	}
+	return 0, false, fmt.Errorf("Unknown Reply Command %d", reply.Command)
+}
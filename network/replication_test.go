@@ -0,0 +1,163 @@
+package network
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestWriteOnCountsAcks(t *testing.T) {
+	inst := NewTLSServer(util.NewLogger("error"), nil, nil, "HOSTNAME", false)
+	ids := []ch.NodeId{ch.NodeId(ch.NewMD5Key("a")), ch.NodeId(ch.NewMD5Key("b")), ch.NodeId(ch.NewMD5Key("c"))}
+
+	var mutex sync.Mutex
+	versions := map[ch.NodeId]uint64{}
+	write := func(id ch.NodeId, version uint64) (uint64, bool, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		versions[id] = version
+		if id == ids[0] {
+			return 0, false, errPeerUnavailable
+		}
+		return 7, id == ids[2], nil
+	}
+	hinted := map[ch.NodeId]uint64{}
+	hint := func(id ch.NodeId, version uint64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		hinted[id] = version
+	}
+	result, err := inst.writeOn("Test", ids, "key", 0, 2, write, hint)
+	assert.Nil(t, err)
+	assert.Equal(t, WriteResult{Version: 7, Replicas: 3, Acks: 2, Found: true}, result)
+	assert.False(t, result.Complete())
+	// The second node assigned the version, and the third stored it
+	assert.Equal(t, map[ch.NodeId]uint64{ids[0]: 0, ids[1]: 0, ids[2]: 7}, versions)
+	// The unavailable node is hinted once the version is known
+	assert.Equal(t, map[ch.NodeId]uint64{ids[0]: 7}, hinted)
+
+	// Every node is required
+	result, err = inst.writeOn("Test", ids, "key", 0, 3, write, hint)
+	assert.Equal(t, ErrQuorumNotMet, err)
+	assert.Equal(t, 2, result.Acks)
+
+	failed := errors.New("failed")
+	result, err = inst.writeOn("Test", ids, "key", 3, 3, func(id ch.NodeId, version uint64) (uint64, bool, error) {
+		return 0, false, failed
+	}, hint)
+	assert.Equal(t, failed, err)
+	assert.Equal(t, 0, result.Acks)
+	// Nodes that refuse a write are not hinted
+	assert.Equal(t, 1, len(hinted))
+}
+
+func TestWriteOnWaitsForAcks(t *testing.T) {
+	inst := NewTLSServer(util.NewLogger("error"), nil, nil, "HOSTNAME", false)
+	ids := []ch.NodeId{ch.NodeId(ch.NewMD5Key("a")), ch.NodeId(ch.NewMD5Key("b")), ch.NodeId(ch.NewMD5Key("c"))}
+
+	for wait := 0; wait <= len(ids); wait++ {
+		written := make(chan uint64, len(ids))
+		result, err := inst.writeOn("Test", ids, "key", 0, wait, func(id ch.NodeId, version uint64) (uint64, bool, error) {
+			if version == 0 {
+				version = 7
+			}
+			written <- version
+			return version, false, nil
+		}, func(id ch.NodeId, version uint64) {
+			t.Errorf("Unexpected hint for %02X", id)
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, wait, result.Acks)
+		// The rest are written in the background with the same version
+		for range ids {
+			assert.Equal(t, uint64(7), <-written)
+		}
+	}
+}
+
+func TestConsistencyAcks(t *testing.T) {
+	inst := NewTLSServer(util.NewLogger("error"), nil, nil, "HOSTNAME", false)
+	assert.Equal(t, packets.WRITE_COMMITTED, inst.consistency(0))
+	assert.Equal(t, packets.WRITE_REPLICATED, inst.consistency(packets.WRITE_REPLICATED))
+
+	assert.Equal(t, 0, acksFor(packets.WRITE_UNCOMMITTED, 3))
+	assert.Equal(t, 1, acksFor(packets.WRITE_COMMITTED, 3))
+	assert.Equal(t, 3, acksFor(packets.WRITE_REPLICATED, 3))
+}
+
+func TestSetAndDeleteKeyLocal(t *testing.T) {
+	logger := util.NewLogger("error")
+	kv := kvstore.NewKVStore(logger)
+	inst := NewTLSServer(logger, nil, kv, "HOSTNAME", false)
+
+	result, err := inst.SetKey("key", []byte("value"), 0, nil, WriteOptions{Consistency: packets.WRITE_REPLICATED})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.Acks)
+	assert.True(t, result.Complete())
+
+	result, err = inst.DeleteKey("key", WriteOptions{Consistency: packets.WRITE_REPLICATED})
+	assert.Nil(t, err)
+	assert.True(t, result.Found)
+	_, found, err := inst.GetItem("key", ReadOptions{})
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	// The tombstone keeps the version of the delete
+	item, _ := kv.Scan(kvstore.ScanOptions{Tombstones: true}).Next()
+	assert.True(t, item.Tombstone)
+	assert.Equal(t, result.Version, item.Version)
+
+	result, err = inst.DeleteKey("key", WriteOptions{Consistency: packets.WRITE_REPLICATED})
+	assert.Nil(t, err)
+	assert.False(t, result.Found)
+}
+
+func TestReplicaWriteDoesNotHoldUpPeer(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	peer, _ := connectServers(a, b)
+
+	// Hold up writes to b's store, as a slow disk would
+	b.KVStore.Set("held", []byte("value"), 0, nil)
+	holding, release := make(chan bool), make(chan bool)
+	go b.KVStore.Iterate(func(*kvstore.Item) bool {
+		close(holding)
+		<-release
+		return false
+	})
+	<-holding
+
+	payload := packets.KVStorePacket{
+		Command:  packets.CMD_KVSTORE_SET,
+		Key:      "key",
+		KeyHash:  ch.NewMD5Key("key"),
+		Data:     []byte("value"),
+		Version:  1,
+		TargetID: b.ServerNode.ID,
+	}
+	payload.Compress(a.CompressThreshold)
+	assert.Nil(t, peer.SendPacket(packets.NewPacket(packets.CMD_KVSTORE, payload)))
+
+	// b still answers a while the write waits
+	answered := make(chan error, 1)
+	go func() { answered <- a.sendNodePacket(peer, packets.CMD_NODE_STAYING) }()
+	select {
+	case err := <-answered:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Error("b did not answer while a write was held up")
+	}
+
+	close(release)
+	for !b.KVStore.IsSet("key") {
+		time.Sleep(time.Millisecond)
+	}
+}
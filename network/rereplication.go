@@ -0,0 +1,101 @@
+package network
+
+import (
+	"time"
+
+	ch "github.com/tomdionysus/consistenthash"
+)
+
+// DefaultRereplicationDelay is how long a node must stay disconnected before its keys are re-replicated unless
+// RereplicationDelay is set.
+const DefaultRereplicationDelay = time.Minute
+
+// RereplicationProgress reports the progress of restoring the replication factor after a node was lost.
+type RereplicationProgress struct {
+	// Lost is the node whose keys are, or were last, being re-replicated.
+	Lost ch.NodeId
+	// Running is true while keys are being re-replicated.
+	Running bool
+	// Peers is the number of peers this node compares its keys with, and Done how many it has compared with.
+	Peers int
+	Done  int
+	// Keys is the number of keys copied so far.
+	Keys int
+}
+
+// Rereplication returns the progress of the current, or last, re-replication.
+func (svr *TLSServer) Rereplication() RereplicationProgress {
+	svr.rereplicationMutex.Lock()
+	defer svr.rereplicationMutex.Unlock()
+	return svr.rereplication
+}
+
+// nodeLost is called when a peer that was not leaving the cluster disconnects, and has been deregistered. Writes
+// it would have been a replica of are hinted for it, and if it has not returned after RereplicationDelay, its keys
+// are re-replicated in the background. Nothing is done if this node is leaving the cluster itself.
+func (svr *TLSServer) nodeLost(node *ch.ServerNetworkNode) {
+	id := node.ID
+	if id == svr.ServerNode.ID || svr.isLeaving(svr.ServerNode.ID) {
+		return
+	}
+	svr.markDown(node)
+	svr.Logger.Warn("Server", "Rereplicate: %02X Lost, Waiting %s", id, svr.RereplicationDelay)
+	go func() {
+		time.Sleep(svr.RereplicationDelay)
+		if svr.ServerNode.NodeRegistered(id) {
+			svr.Logger.Info("Server", "Rereplicate: %02X Returned, Skipping", id)
+			return
+		}
+		svr.Rereplicate(id)
+	}()
+}
+
+// Rereplicate restores the replication factor of the keys held by a node that has left the cluster without being
+// decommissioned, returning the number of keys copied. The lost node has been removed from the circle, so for
+// each key it held a replica of, the next node on the circle is now a replica. This node compares the keys it
+// shares with each peer by anti-entropy, which copies the keys the new replicas are missing at no more than
+// AntiEntropyRate keys per second. Only one re-replication runs at a time.
+func (svr *TLSServer) Rereplicate(lost ch.NodeId) int {
+	peers := []ch.NodeId{}
+	for id, peer := range svr.Connections() {
+		if peer.Available() {
+			peers = append(peers, id)
+		}
+	}
+	return svr.rereplicate(lost, peers, func(id ch.NodeId) merkleReplica {
+		return &remoteReplica{svr: svr, id: id}
+	})
+}
+
+// rereplicate runs anti-entropy with each of the peers in turn on behalf of the lost node.
+func (svr *TLSServer) rereplicate(lost ch.NodeId, peers []ch.NodeId, replica func(id ch.NodeId) merkleReplica) int {
+	svr.rereplicateMutex.Lock()
+	defer svr.rereplicateMutex.Unlock()
+
+	svr.updateRereplication(func(progress *RereplicationProgress) {
+		*progress = RereplicationProgress{Lost: lost, Running: true, Peers: len(peers)}
+	})
+	svr.Logger.Info("Server", "Rereplicate: %02X, Comparing Keys with %d Peers", lost, len(peers))
+	keys := 0
+	for i, id := range peers {
+		count, err := svr.syncReplica(id, replica(id))
+		if err != nil {
+			svr.Logger.Warn("Server", "Rereplicate: %02X with %02X Failed: %s", lost, id, err.Error())
+		}
+		keys += count
+		svr.updateRereplication(func(progress *RereplicationProgress) {
+			progress.Done, progress.Keys = i+1, keys
+		})
+		svr.Logger.Info("Server", "Rereplicate: %02X, %d of %d Peers, %d Keys Copied", lost, i+1, len(peers), keys)
+	}
+	svr.updateRereplication(func(progress *RereplicationProgress) {
+		progress.Running = false
+	})
+	return keys
+}
+
+func (svr *TLSServer) updateRereplication(fn func(progress *RereplicationProgress)) {
+	svr.rereplicationMutex.Lock()
+	fn(&svr.rereplication)
+	svr.rereplicationMutex.Unlock()
+}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func TestRereplicate(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	c := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "c", false)
+	servers := map[ch.NodeId]*TLSServer{a.ServerNode.ID: a, b.ServerNode.ID: b, c.ServerNode.ID: c}
+	for _, svr := range servers {
+		for _, other := range servers {
+			if other != svr {
+				svr.ServerNode.RegisterNode(&other.ServerNode.ServerNetworkNode)
+			}
+		}
+		svr.ReplicationFactor = 2
+		svr.AntiEntropyRate = 0
+	}
+
+	// Each key is on two of the three nodes
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		for _, id := range a.replicasFor(ch.NewMD5Key(key)) {
+			servers[id].KVStore.SetVersion(key, []byte("value"), 0, nil, 10)
+		}
+	}
+
+	// c is lost, so a and b are now the replicas of every key
+	a.ServerNode.DeregisterNode(&c.ServerNode.ServerNetworkNode)
+	b.ServerNode.DeregisterNode(&c.ServerNode.ServerNetworkNode)
+	copied := a.rereplicate(c.ServerNode.ID, []ch.NodeId{b.ServerNode.ID}, func(id ch.NodeId) merkleReplica {
+		return &localReplica{svr: b, requester: a.ServerNode.ID}
+	})
+	assert.True(t, copied > 0)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		assert.True(t, a.KVStore.IsSet(key), key)
+		assert.True(t, b.KVStore.IsSet(key), key)
+	}
+	assert.Equal(t, RereplicationProgress{Lost: c.ServerNode.ID, Peers: 1, Done: 1, Keys: copied}, a.Rereplication())
+
+	// Nothing is copied once the replicas agree
+	copied = a.rereplicate(c.ServerNode.ID, []ch.NodeId{b.ServerNode.ID}, func(id ch.NodeId) merkleReplica {
+		return &localReplica{svr: b, requester: a.ServerNode.ID}
+	})
+	assert.Equal(t, 0, copied)
+}
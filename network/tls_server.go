@@ -29,6 +29,11 @@ const (
 
 // TLSServer represents the running Trinity instance, and is the highest level type in the stack.
 type TLSServer struct {
+	// readRepairs counts replicas repaired after reads, and antiEntropyRepairs keys repaired by anti-entropy.
+	// They are first for 64 bit atomic alignment.
+	readRepairs        uint64
+	antiEntropyRepairs uint64
+
 	ServerNode *ch.ServerNode
 
 	CACertificate  *tls.Certificate
@@ -38,7 +43,32 @@ type TLSServer struct {
 	StatusChannel  chan (int)
 
 	CAPool  *CAPool
-	KVStore *kvstore.KVStore
+	KVStore kvstore.Engine
+
+	// CompressThreshold is the size in bytes from which values are compressed between peers, or 0 to disable.
+	CompressThreshold int
+	// ReplicationFactor is the number of nodes that hold each key.
+	ReplicationFactor int
+	// Consistency is the consistency mode of writes that do not select one.
+	Consistency packets.Consistency
+	// ReadQuorum is the number of replicas a read waits for, unless the read selects another.
+	ReadQuorum int
+	// WriteQuorum is the number of replicas a write waits for, unless the write selects another, or 0 to let the
+	// consistency mode decide.
+	WriteQuorum int
+	// Hints holds the writes missed by unavailable replicas until they reconnect.
+	Hints *HintStore
+	// ReadRepairChance is the probability, from 0 to 1, that a read compares the copies held by every replica in
+	// the background and repairs those that are stale.
+	ReadRepairChance float64
+	// AntiEntropyInterval is the time between runs of anti-entropy with each peer, or 0 to disable it.
+	AntiEntropyInterval time.Duration
+	// AntiEntropyRate is the maximum number of keys per second anti-entropy repairs, or 0 for no limit.
+	AntiEntropyRate int
+	// RereplicationDelay is how long a node must stay disconnected before its keys are re-replicated.
+	RereplicationDelay time.Duration
+	// RebalanceRetryDelay is how long to wait before sending a joining node its keys again after sending failed.
+	RebalanceRetryDelay time.Duration
 
 	SessionCache tls.ClientSessionCache
 
@@ -46,11 +76,33 @@ type TLSServer struct {
 	connectionsMutex sync.Mutex
 	disableHeartbeat bool
 
+	merkleTrees map[ch.NodeId]*merkleTree
+	merkleMutex sync.Mutex
+
+	// syncingFrom holds the peers that are still to send this node the keys it holds a replica of, and synced is
+	// set once every peer has, after which this node does not wait for the nodes that join after it. leaving holds
+	// the nodes, including this one, that are being decommissioned. handingOver holds the joining peers this node
+	// is still to send their keys to, and handOverFailed those it could not send every key to. down holds the
+	// nodes that were lost, and are hinted the writes they miss. All are guarded by syncMutex.
+	syncingFrom    map[ch.NodeId]bool
+	synced         bool
+	leaving        map[ch.NodeId]bool
+	handingOver    map[ch.NodeId]bool
+	handOverFailed map[ch.NodeId]bool
+	down           map[ch.NodeId]*downNode
+	syncMutex      sync.Mutex
+
+	// rereplication is the progress of the current, or last, re-replication, guarded by rereplicationMutex.
+	// rereplicateMutex is held while keys are re-replicated.
+	rereplication      RereplicationProgress
+	rereplicationMutex sync.Mutex
+	rereplicateMutex   sync.Mutex
+
 	Listener net.Listener
 }
 
 // NewTLSServer creates and returns a new TLSServer with the given logger, CA Pool, KV Store and host name
-func NewTLSServer(logger *util.Logger, caPool *CAPool, kvStore *kvstore.KVStore, hostname string, disableHeartbeat bool) *TLSServer {
+func NewTLSServer(logger *util.Logger, caPool *CAPool, kvStore kvstore.Engine, hostname string, disableHeartbeat bool) *TLSServer {
 	inst := &TLSServer{
 		ServerNode:     ch.NewServerNode(hostname),
 		Logger:         logger,
@@ -60,8 +112,23 @@ func NewTLSServer(logger *util.Logger, caPool *CAPool, kvStore *kvstore.KVStore,
 		KVStore:        kvStore,
 		CAPool:         caPool,
 
+		ReplicationFactor:   DefaultReplicationFactor,
+		Consistency:         packets.WRITE_COMMITTED,
+		ReadQuorum:          1,
+		ReadRepairChance:    DefaultReadRepairChance,
+		Hints:               NewHintStore(logger, DefaultHintWindow),
+		AntiEntropyRate:     DefaultAntiEntropyRate,
+		RereplicationDelay:  DefaultRereplicationDelay,
+		RebalanceRetryDelay: DefaultRebalanceRetryDelay,
+
 		connections:      map[ch.NodeId]*Peer{},
 		disableHeartbeat: disableHeartbeat,
+		merkleTrees:      map[ch.NodeId]*merkleTree{},
+		syncingFrom:      map[ch.NodeId]bool{},
+		leaving:          map[ch.NodeId]bool{},
+		handingOver:      map[ch.NodeId]bool{},
+		handOverFailed:   map[ch.NodeId]bool{},
+		down:             map[ch.NodeId]*downNode{},
 	}
 	return inst
 }
@@ -133,6 +200,9 @@ func (svr *TLSServer) ConnectionSet(id ch.NodeId, peer *Peer) {
 	svr.connectionsMutex.Lock()
 	svr.connections[id] = peer
 	svr.connectionsMutex.Unlock()
+	svr.syncMutex.Lock()
+	delete(svr.down, id)
+	svr.syncMutex.Unlock()
 }
 
 // ConnectionGet returns the peer for the given ID, and whether that ID was found.
@@ -145,9 +215,18 @@ func (svr *TLSServer) ConnectionGet(id ch.NodeId) (*Peer, bool) {
 
 // ConnectionClear clears the peer for the given Instance ID.
 func (svr *TLSServer) ConnectionClear(id ch.NodeId) {
+	svr.merkleMutex.Lock()
+	delete(svr.merkleTrees, id)
+	svr.merkleMutex.Unlock()
 	svr.connectionsMutex.Lock()
 	delete(svr.connections, id)
 	svr.connectionsMutex.Unlock()
+	svr.syncMutex.Lock()
+	delete(svr.leaving, id)
+	delete(svr.handingOver, id)
+	delete(svr.handOverFailed, id)
+	svr.syncMutex.Unlock()
+	svr.syncComplete(id)
 }
 
 // Connections returns a current copy of all connections.
@@ -180,176 +259,357 @@ func (svr *TLSServer) NotifyAllPeers() {
 	}
 }
 
-// SetKey sets the given key to the given value in the cluster.
-func (svr *TLSServer) SetKey(key string, value []byte, flags int16, expiry *time.Time) {
+// SetKey sets the given key to the given value on every replica in the cluster, returning how many replicas
+// acknowledged the write before it returned. The write returns once the write quorum of replicas have
+// acknowledged it, and ErrQuorumNotMet is returned if too few did. The first available node assigns the item
+// version, and the other nodes store the value with that version in parallel.
+func (svr *TLSServer) SetKey(key string, value []byte, flags int16, expiry *time.Time, options WriteOptions) (WriteResult, error) {
 	keymd5 := ch.NewMD5Key(key)
-	nodes := svr.ServerNode.GetNodesFor(keymd5, 3)
-	svr.Logger.Debug("Server", "SetKey: %d peers for key %02X", len(nodes), keymd5)
-	for _, node := range nodes {
-		if node.ID == svr.ServerNode.ID {
-			svr.Logger.Debug("Server", "SetKey: Peer for key %02X -> %02X (Local)", keymd5, node.ID)
-			// Local set.
-			svr.KVStore.Set(key, value, flags, expiry)
-		} else {
-			svr.Logger.Debug("Server", "SetKey: Peer for key %02X -> %02X (Remote)", keymd5, node.ID)
+	ids := svr.replicasFor(keymd5)
+	mode := svr.consistency(options.Consistency)
+	w := svr.writeQuorum(options, mode, len(ids))
+	svr.Logger.Debug("Server", "SetKey: %d peers for key %02X (%s, W=%d)", len(ids), keymd5, mode, w)
+	return svr.setKeyOn(mode, ids, key, value, flags, expiry, 0, w)
+}
 
-			peer, _ := svr.ConnectionGet(node.ID)
-			if peer.State != PeerStateConnected {
-				svr.Logger.Warn("Server", "SetKey: Peer for key %02X -> %02X (Remote) Unavailable", keymd5, node.ID)
-				continue
-			}
-			// Remote Set.
-			payload := packets.KVStorePacket{
-				Command:   packets.CMD_KVSTORE_SET,
-				Key:       key,
-				KeyHash:   keymd5,
-				Data:      value,
-				ExpiresAt: expiry,
-				Flags:     flags,
-				TargetID:  node.ID,
-			}
-			packet := packets.NewPacket(packets.CMD_KVSTORE, payload)
-			peer.SendPacketWaitReply(packet, 5*time.Second)
+// CompareAndSetKey sets the given key to the given value in the cluster if its version is expected, returning
+// the new version. The first available node that owns the key performs the compare and set, and the other
+// nodes then store the value with the new version.
+func (svr *TLSServer) CompareAndSetKey(key string, value []byte, flags int16, expiry *time.Time, expected uint64, options WriteOptions) (uint64, error) {
+	payload := packets.KVStorePacket{
+		Command:   packets.CMD_KVSTORE_CAS,
+		Key:       key,
+		Data:      value,
+		ExpiresAt: expiry,
+		Flags:     flags,
+		Version:   expected,
+	}
+	item, err := svr.updateKey(payload, options, func() (*kvstore.Item, error) {
+		version, err := svr.KVStore.CompareAndSet(key, value, flags, expiry, expected)
+		if err != nil {
+			return nil, err
 		}
+		return &kvstore.Item{Key: key, Data: value, Flags: flags, ExpiresAt: expiry, Version: version}, nil
+	})
+	if err != nil {
+		return 0, err
 	}
+	return item.Version, nil
 }
 
-// GetKey returns a value for the given key in the cluster, and if that key was found
-func (svr *TLSServer) GetKey(key string) ([]byte, int16, bool) {
-	keymd5 := ch.NewMD5Key(key)
-	nodes := svr.ServerNode.GetNodesFor(keymd5, 3)
-	for _, node := range nodes {
-		if node.ID == svr.ServerNode.ID {
-			svr.Logger.Debug("Server", "GetKey: Peer for key %02X -> %02X (Local)", keymd5, node.ID)
-			// Local set.
-			return svr.KVStore.Get(key)
-		} else {
-			svr.Logger.Debug("Server", "GetKey: Peer for key %02X -> %02X (Remote)", keymd5, node.ID)
+// IncrKey atomically adds delta to the decimal value of the given key in the cluster, returning the updated item.
+func (svr *TLSServer) IncrKey(key string, delta uint64, options WriteOptions) (*kvstore.Item, error) {
+	payload := packets.KVStorePacket{Command: packets.CMD_KVSTORE_INCR, Key: key, Delta: delta}
+	return svr.updateKey(payload, options, func() (*kvstore.Item, error) {
+		return svr.KVStore.Incr(key, delta)
+	})
+}
 
-			peer, _ := svr.ConnectionGet(node.ID)
-			if peer.State != PeerStateConnected {
-				svr.Logger.Warn("Server", "GetKey: Peer for key %02X -> %02X (Remote) Unavailable", keymd5, node.ID)
-				continue
-			}
+// DecrKey atomically subtracts delta from the decimal value of the given key in the cluster, stopping at 0,
+// returning the updated item.
+func (svr *TLSServer) DecrKey(key string, delta uint64, options WriteOptions) (*kvstore.Item, error) {
+	payload := packets.KVStorePacket{Command: packets.CMD_KVSTORE_DECR, Key: key, Delta: delta}
+	return svr.updateKey(payload, options, func() (*kvstore.Item, error) {
+		return svr.KVStore.Decr(key, delta)
+	})
+}
 
-			// Remote Set.
-			payload := packets.KVStorePacket{
-				Command:  packets.CMD_KVSTORE_GET,
-				Key:      key,
-				KeyHash:  keymd5,
-				TargetID: node.ID,
-			}
-			packet := packets.NewPacket(packets.CMD_KVSTORE, payload)
-			reply, err := peer.SendPacketWaitReply(packet, 5*time.Second)
+// AppendKey atomically adds data to the end of the value of the given key in the cluster, returning the updated item.
+func (svr *TLSServer) AppendKey(key string, data []byte, options WriteOptions) (*kvstore.Item, error) {
+	payload := packets.KVStorePacket{Command: packets.CMD_KVSTORE_APPEND, Key: key, Data: data}
+	return svr.updateKey(payload, options, func() (*kvstore.Item, error) {
+		return svr.KVStore.Append(key, data)
+	})
+}
 
-			// Process reply or timeout
-			if err == nil {
-				switch reply.Command {
-				case packets.CMD_KVSTORE_ACK:
-					kvpacket := reply.Payload.(packets.KVStorePacket)
-					svr.Logger.Debug("Server", "GetKey: Reply from Remote %s = %s", key, kvpacket.Data)
-					return kvpacket.Data, kvpacket.Flags, true
-				case packets.CMD_KVSTORE_NOT_FOUND:
-					svr.Logger.Debug("Server", "GetKey: Reply from Remote %s Not Found", key)
-					return []byte{}, 0, false
-				default:
-					svr.Logger.Warn("Server", "GetKey: Unknown Reply Command %d", reply.Command)
-				}
-			} else {
-				svr.Logger.Warn("Server", "GetKey: Reply Timeout")
-			}
-		}
-	}
-	return []byte{}, 0, false
+// PrependKey atomically adds data to the start of the value of the given key in the cluster, returning the
+// updated item.
+func (svr *TLSServer) PrependKey(key string, data []byte, options WriteOptions) (*kvstore.Item, error) {
+	payload := packets.KVStorePacket{Command: packets.CMD_KVSTORE_PREPEND, Key: key, Data: data}
+	return svr.updateKey(payload, options, func() (*kvstore.Item, error) {
+		return svr.KVStore.Prepend(key, data)
+	})
 }
 
-// IsSet return if a key is set
-func (svr *TLSServer) IsSet(key string) bool {
-	keymd5 := ch.NewMD5Key(key)
-	nodes := svr.ServerNode.GetNodesFor(keymd5, 3)
-	for _, node := range nodes {
-		if node.ID == svr.ServerNode.ID {
-			svr.Logger.Debug("Server", "IsSet: Peer for key %02X -> %02X (Local)", keymd5, node.ID)
-			// Local set.
-			return svr.KVStore.IsSet(key)
+// updateKey performs a read-modify-write on the first available node for the key in one round trip, by calling
+// local if that is this node or otherwise sending it payload, then stores the updated item on the other nodes
+// with the version the first node assigned. The first node always completes the update before it returns, as
+// its result is needed, and it counts towards the write quorum.
+func (svr *TLSServer) updateKey(payload packets.KVStorePacket, options WriteOptions, local func() (*kvstore.Item, error)) (*kvstore.Item, error) {
+	keymd5 := ch.NewMD5Key(payload.Key)
+	ids := svr.replicasFor(keymd5)
+	mode := svr.consistency(options.Consistency)
+	payload.KeyHash = keymd5
+	payload.Consistency = mode
+	payload.Compress(svr.CompressThreshold)
+	missed := []ch.NodeId{}
+	for i, id := range ids {
+		var item *kvstore.Item
+		var err error
+		if id == svr.ServerNode.ID {
+			svr.Logger.Debug("Server", "UpdateKey: Peer for key %02X -> %02X (Local)", keymd5, id)
+			item, err = local()
+			if err == nil {
+				err = svr.persist(mode)
+			}
 		} else {
-			svr.Logger.Debug("Server", "IsSet: Peer for key %02X -> %02X (Remote)", keymd5, node.ID)
-
-			peer, _ := svr.ConnectionGet(node.ID)
-			if peer.State != PeerStateConnected {
-				svr.Logger.Warn("Server", "IsSet: Peer for key %02X -> %02X (Remote) Unavailable", keymd5, node.ID)
+			svr.Logger.Debug("Server", "UpdateKey: Peer for key %02X -> %02X (Remote)", keymd5, id)
+			payload.TargetID = id
+			item, err = svr.remoteUpdate(id, payload)
+			if err == errPeerUnavailable {
+				svr.Logger.Warn("Server", "UpdateKey: Peer for key %02X -> %02X (Remote) Unavailable", keymd5, id)
+				missed = append(missed, id)
 				continue
 			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range missed {
+			svr.hint(id, item)
+		}
 
-			// Remote Set.
-			payload := packets.KVStorePacket{
-				Command:  packets.CMD_KVSTORE_IS_SET,
-				Key:      key,
-				KeyHash:  keymd5,
-				TargetID: node.ID,
+		// Replicate the new version
+		if i+1 == len(ids) {
+			for _, id := range svr.downReplicas(keymd5) {
+				svr.hint(id, item)
 			}
-			packet := packets.NewPacket(packets.CMD_KVSTORE, payload)
-			reply, err := peer.SendPacketWaitReply(packet, 5*time.Second)
+			return item, nil
+		}
+		wait := svr.writeQuorum(options, mode, len(ids)) - 1
+		if wait < 0 {
+			wait = 0
+		}
+		_, err = svr.setKeyOn(mode, ids[i+1:], item.Key, item.Data, item.Flags, item.ExpiresAt, item.Version, wait)
+		if err == ErrQuorumNotMet {
+			return nil, err
+		}
+		if err != nil {
+			svr.Logger.Warn("Server", "UpdateKey: Replication of %02X Failed: %s", keymd5, err.Error())
+		}
+		return item, nil
+	}
+	return nil, errPeerUnavailable
+}
+
+// remoteUpdate sends an update to a remote node, returning the updated item.
+func (svr *TLSServer) remoteUpdate(id ch.NodeId, payload packets.KVStorePacket) (*kvstore.Item, error) {
+	reply, err := svr.sendKVStorePacket(id, payload)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.Command {
+	case packets.CMD_KVSTORE_ACK:
+		kvpacket := reply.Payload.(packets.KVStorePacket)
+		if err := kvpacket.Decompress(); err != nil {
+			return nil, err
+		}
+		if err := unpackKeyspace(&kvpacket); err != nil {
+			return nil, err
+		}
+		return &kvstore.Item{Key: kvpacket.Key, Data: kvpacket.Data, Flags: kvpacket.Flags, ExpiresAt: kvpacket.ExpiresAt, Version: kvpacket.Version}, nil
+	case packets.CMD_KVSTORE_NOT_FOUND:
+		return nil, kvstore.ErrNotFound
+	case packets.CMD_KVSTORE_ERROR:
+		return nil, remoteError(reply.Payload.(string))
+	}
+	return nil, fmt.Errorf("Unknown Reply Command %d", reply.Command)
+}
 
-			// Process reply or timeout
+// setKeyOn sets the key on each of the given nodes in turn with the given version or, if version is 0, with the
+// version assigned by the first node that stores it, returning once wait nodes have acknowledged it.
+func (svr *TLSServer) setKeyOn(mode packets.Consistency, ids []ch.NodeId, key string, value []byte, flags int16, expiry *time.Time, version uint64, wait int) (WriteResult, error) {
+	return svr.writeOn("SetKey", ids, key, version, wait, func(id ch.NodeId, version uint64) (uint64, bool, error) {
+		if id == svr.ServerNode.ID {
+			svr.Logger.Debug("Server", "SetKey: Peer for key [%s] -> %02X (Local)", key, id)
+			stored, err := svr.KVStore.SetVersion(key, value, flags, expiry, version)
 			if err == nil {
-				switch reply.Command {
-				case packets.CMD_KVSTORE_ACK:
-					svr.Logger.Debug("Server", "IsSet: Reply from Remote %s", key)
-					return true
-				case packets.CMD_KVSTORE_NOT_FOUND:
-					svr.Logger.Debug("Server", "IsSet: Reply from Remote %s Not Found", key)
-					return false
-				default:
-					svr.Logger.Warn("Server", "IsSet: Unknown Reply Command %d", reply.Command)
-				}
-			} else {
-				svr.Logger.Warn("Server", "IsSet: Reply Timeout")
+				err = svr.persist(mode)
 			}
+			return stored, false, err
 		}
+		svr.Logger.Debug("Server", "SetKey: Peer for key [%s] -> %02X (Remote)", key, id)
+		stored, err := svr.remoteSet(mode, id, key, value, flags, expiry, version)
+		return stored, false, err
+	}, func(id ch.NodeId, version uint64) {
+		svr.hint(id, &kvstore.Item{Key: key, Data: value, Flags: flags, ExpiresAt: expiry, Version: version})
+	})
+}
+
+// remoteSet sets the key on a remote node, returning the version it stored.
+func (svr *TLSServer) remoteSet(mode packets.Consistency, id ch.NodeId, key string, value []byte, flags int16, expiry *time.Time, version uint64) (uint64, error) {
+	payload := packets.KVStorePacket{
+		Command:     packets.CMD_KVSTORE_SET,
+		Key:         key,
+		KeyHash:     ch.NewMD5Key(key),
+		Data:        value,
+		ExpiresAt:   expiry,
+		Flags:       flags,
+		Version:     version,
+		Consistency: mode,
+		TargetID:    id,
+	}
+	payload.Compress(svr.CompressThreshold)
+	reply, err := svr.sendKVStorePacket(id, payload)
+	if err != nil {
+		return 0, err
+	}
+	switch reply.Command {
+	case packets.CMD_KVSTORE_ACK:
+		return reply.Payload.(packets.KVStorePacket).Version, nil
+	case packets.CMD_KVSTORE_ERROR:
+		return 0, remoteError(reply.Payload.(string))
+	}
+	return 0, fmt.Errorf("Unknown Reply Command %d", reply.Command)
+}
+
+// sendKVStorePacket sends a CMD_KVSTORE packet to a connected peer and waits for the reply.
+func (svr *TLSServer) sendKVStorePacket(id ch.NodeId, payload packets.KVStorePacket) (*packets.Packet, error) {
+	peer, found := svr.ConnectionGet(id)
+	if !found || !peer.Available() {
+		return nil, errPeerUnavailable
+	}
+	packKeyspace(&payload)
+	return peer.SendPacketWaitReply(packets.NewPacket(packets.CMD_KVSTORE, payload), 5*time.Second)
+}
+
+// remoteError returns the error for the message of a CMD_KVSTORE_ERROR reply, so that known
+// kvstore errors can be compared.
+func remoteError(message string) error {
+	switch message {
+	case kvstore.ErrOutOfMemory.Error():
+		return kvstore.ErrOutOfMemory
+	case kvstore.ErrVersionMismatch.Error():
+		return kvstore.ErrVersionMismatch
+	case kvstore.ErrNotNumeric.Error():
+		return kvstore.ErrNotNumeric
+	case kvstore.ErrQuotaExceeded.Error():
+		return kvstore.ErrQuotaExceeded
+	case packets.ErrChecksumMismatch.Error():
+		return packets.ErrChecksumMismatch
 	}
-	return false
+	return errors.New(message)
 }
 
-// DeleteKey clears the given key in the cluster.
-func (svr *TLSServer) DeleteKey(key string) bool {
+// GetKey returns a value for the given key in the cluster with the server's read quorum, and if that key was
+// found
+func (svr *TLSServer) GetKey(key string) ([]byte, int16, bool) {
+	item, found, err := svr.GetItem(key, ReadOptions{})
+	if err != nil || !found {
+		return []byte{}, 0, false
+	}
+	return item.Data, item.Flags, true
+}
+
+// GetItem returns the item for the given key in the cluster, including its version, and if that key was found.
+// The key is read from R replicas in parallel, and the newest version any of them holds is returned, so that a
+// key written with a write quorum of W is always read if R + W is more than the replication factor. Some reads
+// are followed by a read repair in the background, see ReadRepairChance. Replicas that are syncing after joining
+// the cluster are not read from.
+// ErrQuorumNotMet is returned if fewer than R replicas answer, or there are no replicas to read from.
+func (svr *TLSServer) GetItem(key string, options ReadOptions) (*kvstore.Item, bool, error) {
 	keymd5 := ch.NewMD5Key(key)
-	node := svr.ServerNode.GetNodeFor(keymd5)
-	if node.ID == svr.ServerNode.ID {
-		svr.Logger.Debug("Server", "DeleteKey: Peer for key %02X -> %02X (Local)", keymd5, node.ID)
-		// Local set.
-		return svr.KVStore.Delete(key)
-	} else {
-		svr.Logger.Debug("Server", "DeleteKey: Peer for key %02X -> %02X (Remote)", keymd5, node.ID)
-		// Remote Set.
-		payload := packets.KVStorePacket{
-			Command:  packets.CMD_KVSTORE_DELETE,
-			Key:      key,
-			KeyHash:  keymd5,
-			TargetID: node.ID,
-		}
+	ids := svr.readableReplicas(svr.replicasFor(keymd5))
+	if len(ids) == 0 {
+		svr.Logger.Warn("Server", "GetKey: [%s] No Readable Replicas", key)
+		return nil, false, ErrQuorumNotMet
+	}
+	r := svr.readQuorum(options, len(ids))
+	replies := svr.readFrom(ids, key, r)
+	if len(replies) < r {
+		svr.Logger.Warn("Server", "GetKey: [%s] Answered by %d of %d Replicas", key, len(replies), r)
+		return nil, false, ErrQuorumNotMet
+	}
+	newest := newestReply(replies)
+	svr.maybeReadRepair(key, ids, replies)
+	if newest == nil || newest.Tombstone {
+		svr.Logger.Debug("Server", "GetKey: [%s] Not Found (%d replicas)", key, len(replies))
+		return nil, false, nil
+	}
+	svr.Logger.Debug("Server", "GetKey: [%s] = %s (v%d, %d replicas)", key, newest.Data, newest.Version, len(replies))
+	return newest, true, nil
+}
 
-		packet := packets.NewPacket(packets.CMD_KVSTORE, payload)
-		peer, _ := svr.ConnectionGet(node.ID)
-		reply, err := peer.SendPacketWaitReply(packet, 5*time.Second)
+// remoteGet gets the item or tombstone for the key from a remote node, returning kvstore.ErrNotFound if it holds
+// neither.
+func (svr *TLSServer) remoteGet(id ch.NodeId, key string) (*kvstore.Item, error) {
+	payload := packets.KVStorePacket{
+		Command:  packets.CMD_KVSTORE_GET,
+		Key:      key,
+		KeyHash:  ch.NewMD5Key(key),
+		TargetID: id,
+	}
+	reply, err := svr.sendKVStorePacket(id, payload)
+	if err != nil {
+		return nil, err
+	}
+	switch reply.Command {
+	case packets.CMD_KVSTORE_ACK:
+		kvpacket := reply.Payload.(packets.KVStorePacket)
+		if err := kvpacket.Decompress(); err != nil {
+			return nil, err
+		}
+		return &kvstore.Item{Key: key, Data: kvpacket.Data, Flags: kvpacket.Flags, ExpiresAt: kvpacket.ExpiresAt, Version: kvpacket.Version, Tombstone: kvpacket.Command == packets.CMD_KVSTORE_DELETE}, nil
+	case packets.CMD_KVSTORE_NOT_FOUND:
+		return nil, kvstore.ErrNotFound
+	}
+	return nil, fmt.Errorf("Unknown Reply Command %d", reply.Command)
+}
 
-		// Process reply or timeout
-		if err == nil {
-			switch reply.Command {
-			case packets.CMD_KVSTORE_ACK:
-				svr.Logger.Debug("Server", "DeleteKey: Reply from Remote %s Deleted", key)
-				return true
-			case packets.CMD_KVSTORE_NOT_FOUND:
-				svr.Logger.Debug("Server", "DeleteKey: Reply from Remote %s Not Found", key)
-				return false
-			default:
-				svr.Logger.Warn("Server", "DeleteKey: Unknown Reply Command %d", reply.Command)
+// RepairKey replaces the local copy of the key with the newest copy held by the other nodes for the key. It is
+// called by the KVStore when it finds a corrupt item.
+func (svr *TLSServer) RepairKey(key string) {
+	var newest *kvstore.Item
+	var source ch.NodeId
+	for _, id := range svr.replicasFor(ch.NewMD5Key(key)) {
+		if id == svr.ServerNode.ID {
+			continue
+		}
+		item, err := svr.remoteGet(id, key)
+		if err != nil {
+			if err != kvstore.ErrNotFound {
+				svr.Logger.Warn("Server", "RepairKey: [%s] from %02X Failed: %s", key, id, err.Error())
 			}
-		} else {
-			svr.Logger.Warn("Server", "DeleteKey: Reply Timeout")
+			continue
+		}
+		if newest == nil || item.Version > newest.Version {
+			newest, source = item, id
 		}
 	}
-	return false
+	if newest == nil {
+		svr.Logger.Warn("Server", "RepairKey: [%s] No Replica Available", key)
+		return
+	}
+	var err error
+	if newest.Tombstone {
+		_, _, err = svr.KVStore.DeleteVersion(key, newest.Version)
+	} else {
+		_, err = svr.KVStore.SetVersion(key, newest.Data, newest.Flags, newest.ExpiresAt, newest.Version)
+	}
+	if err != nil {
+		svr.Logger.Error("Server", "RepairKey: [%s] Failed: %s", key, err.Error())
+		return
+	}
+	svr.Logger.Info("Server", "RepairKey: [%s] Repaired from %02X (v%d)", key, source, newest.Version)
+}
+
+// IsSet returns if a key is set in the cluster. It is read in the same way as GetItem, so the two always agree.
+func (svr *TLSServer) IsSet(key string, options ReadOptions) (bool, error) {
+	_, found, err := svr.GetItem(key, options)
+	return found, err
+}
+
+// DeleteKey deletes the given key from every replica in the cluster, returning how many replicas acknowledged
+// the delete before it returned and whether any of them held the key. Like SetKey, it returns once the write
+// quorum of replicas have acknowledged it. Replicas keep a tombstone with the version assigned by the first
+// available node, so that a replica that missed the delete cannot restore the key.
+func (svr *TLSServer) DeleteKey(key string, options WriteOptions) (WriteResult, error) {
+	keymd5 := ch.NewMD5Key(key)
+	ids := svr.replicasFor(keymd5)
+	mode := svr.consistency(options.Consistency)
+	w := svr.writeQuorum(options, mode, len(ids))
+	svr.Logger.Debug("Server", "DeleteKey: %d peers for key %02X (%s, W=%d)", len(ids), keymd5, mode, w)
+	return svr.deleteKeyOn(mode, ids, key, 0, w)
 }
 
 // server_loop starts the main server runloop, accepting connections. The peers have individual runloops which handle
@@ -369,6 +629,11 @@ func (svr *TLSServer) server_loop() {
 		}
 	}()
 
+	stop := make(chan bool)
+	if svr.AntiEntropyInterval > 0 {
+		go svr.antiEntropy(stop)
+	}
+
 	// Control / Stop loop
 	for {
 		select {
@@ -383,6 +648,7 @@ func (svr *TLSServer) server_loop() {
 
 end:
 
+	close(stop)
 	svr.Logger.Debug("Server", "Closing Peer Connections")
 	for _, peer := range svr.Connections() {
 		peer.Disconnect()
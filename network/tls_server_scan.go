@@ -0,0 +1,189 @@
+package network
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"time"
+
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/packets"
+)
+
+// ScanKeys returns the next page of up to options.Limit items from across the cluster in key order, and the
+// continuation token for the page after it, which is empty when the scan is complete. Pass an empty token to
+// start a scan, and the same options with each token to continue it.
+//
+// Every connected node is asked for its next items after the token, and the pages are merged, keeping the
+// newest version of keys held on several replicas and dropping keys whose newest version is a tombstone. Nodes
+// that do not reply are skipped, so a scan carries on when nodes disappear, returning the keys held by the
+// remaining replicas. A page may hold fewer than options.Limit items even when the scan is not complete.
+func (svr *TLSServer) ScanKeys(options kvstore.ScanOptions, token string) ([]*kvstore.Item, string, error) {
+	if options.Limit <= 0 {
+		options.Limit = kvstore.ScanPageSize
+	}
+	if token != "" {
+		last, err := decodeScanToken(token)
+		if err != nil {
+			return nil, "", err
+		}
+		if options.Reverse {
+			options.End = last
+		} else {
+			// The smallest key after last
+			options.Start = last + "\x00"
+		}
+	}
+
+	// Fan out
+	type result struct {
+		id    ch.NodeId
+		items []*kvstore.Item
+		err   error
+	}
+	results := make(chan result)
+	count := 0
+	for id, peer := range svr.Connections() {
+		if !peer.Available() {
+			continue
+		}
+		count++
+		go func(id ch.NodeId, peer *Peer, options kvstore.ScanOptions) {
+			items, err := svr.remoteScan(peer, options)
+			results <- result{id: id, items: items, err: err}
+		}(id, peer, options)
+	}
+	options.Tombstones = true
+	pages := [][]*kvstore.Item{scanLocal(svr.KVStore, options)}
+	for i := 0; i < count; i++ {
+		res := <-results
+		if res.err != nil {
+			svr.Logger.Warn("Server", "ScanKeys: Peer %02X Skipped: %s", res.id, res.err.Error())
+			continue
+		}
+		pages = append(pages, res.items)
+	}
+
+	items, more := mergeScanPages(pages, options.Limit, options.Reverse)
+	last := ""
+	if len(items) > 0 {
+		last = items[len(items)-1].Key
+	}
+	items = liveItems(items)
+	svr.Logger.Debug("Server", "ScanKeys: %d items from %d nodes", len(items), len(pages))
+	if !more || last == "" {
+		return items, "", nil
+	}
+	return items, encodeScanToken(last), nil
+}
+
+// remoteScan requests a page of a peer's items.
+func (svr *TLSServer) remoteScan(peer *Peer, options kvstore.ScanOptions) ([]*kvstore.Item, error) {
+	payload := packets.ScanPacket{
+		Start:   options.Start,
+		End:     options.End,
+		Prefix:  options.Prefix,
+		Limit:   options.Limit,
+		Reverse: options.Reverse,
+	}
+	reply, err := peer.SendPacketWaitReply(packets.NewPacket(packets.CMD_KVSTORE_SCAN, payload), 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	page, ok := reply.Payload.(packets.ScanPagePacket)
+	if reply.Command != packets.CMD_KVSTORE_ACK || !ok {
+		return nil, errors.New("Unexpected Scan Reply")
+	}
+	items := make([]*kvstore.Item, len(page.Items))
+	for i, kvpacket := range page.Items {
+		if err := kvpacket.Decompress(); err != nil {
+			return nil, err
+		}
+		if err := unpackKeyspace(&kvpacket); err != nil {
+			return nil, err
+		}
+		items[i] = &kvstore.Item{Key: kvpacket.Key, Data: kvpacket.Data, Flags: kvpacket.Flags, ExpiresAt: kvpacket.ExpiresAt, Version: kvpacket.Version, Tombstone: kvpacket.Command == packets.CMD_KVSTORE_DELETE}
+	}
+	return items, nil
+}
+
+// scanLocal returns the first options.Limit items of a scan of the local store.
+func scanLocal(engine kvstore.Engine, options kvstore.ScanOptions) []*kvstore.Item {
+	items := []*kvstore.Item{}
+	cursor := engine.Scan(options)
+	for item, ok := cursor.Next(); ok; item, ok = cursor.Next() {
+		items = append(items, item)
+	}
+	return items
+}
+
+// mergeScanPages merges the pages of nodes' items, each in key order and of at most limit items, into one page
+// of at most limit items in key order, keeping the newest version of each key. It returns whether there may
+// be more items after the page.
+//
+// A node that returned a full page may hold keys after its last one that the others did not return, so the
+// merged page stops at the earliest such last key.
+func mergeScanPages(pages [][]*kvstore.Item, limit int, reverse bool) ([]*kvstore.Item, bool) {
+	before := func(a, b string) bool {
+		if reverse {
+			return a > b
+		}
+		return a < b
+	}
+
+	newest := map[string]*kvstore.Item{}
+	more := false
+	cutoff := ""
+	for _, page := range pages {
+		for _, item := range page {
+			if existing, found := newest[item.Key]; !found || item.Version > existing.Version {
+				newest[item.Key] = item
+			}
+		}
+		if len(page) >= limit && len(page) > 0 {
+			last := page[len(page)-1].Key
+			if !more || before(last, cutoff) {
+				cutoff = last
+			}
+			more = true
+		}
+	}
+
+	items := make([]*kvstore.Item, 0, len(newest))
+	for _, item := range newest {
+		if more && before(cutoff, item.Key) {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return before(items[i].Key, items[j].Key) })
+	if len(items) > limit {
+		items = items[:limit]
+		more = true
+	}
+	return items, more
+}
+
+// liveItems returns the items that are not tombstones.
+func liveItems(items []*kvstore.Item) []*kvstore.Item {
+	live := items[:0]
+	for _, item := range items {
+		if !item.Tombstone {
+			live = append(live, item)
+		}
+	}
+	return live
+}
+
+func encodeScanToken(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+func decodeScanToken(token string) (string, error) {
+	last, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", errors.New("Invalid Scan Token")
+	}
+	return string(last), nil
+}
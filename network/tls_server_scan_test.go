@@ -0,0 +1,116 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/util"
+)
+
+func scanPage(version uint64, keys ...string) []*kvstore.Item {
+	items := []*kvstore.Item{}
+	for _, key := range keys {
+		items = append(items, &kvstore.Item{Key: key, Version: version})
+	}
+	return items
+}
+
+func itemKeys(items []*kvstore.Item) []string {
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	return keys
+}
+
+func TestMergeScanPagesDeduplicates(t *testing.T) {
+	pages := [][]*kvstore.Item{
+		scanPage(1, "a", "c"),
+		scanPage(2, "b", "c"),
+		scanPage(1, "a", "b"),
+	}
+	items, more := mergeScanPages(pages, 5, false)
+	assert.Equal(t, []string{"a", "b", "c"}, itemKeys(items))
+	assert.Equal(t, uint64(2), items[2].Version)
+	assert.False(t, more)
+}
+
+func TestMergeScanPagesCutoff(t *testing.T) {
+	// The first node has more after "c", so "d" from the second cannot be returned yet
+	pages := [][]*kvstore.Item{
+		scanPage(1, "a", "b", "c"),
+		scanPage(1, "b", "d"),
+	}
+	items, more := mergeScanPages(pages, 3, false)
+	assert.Equal(t, []string{"a", "b", "c"}, itemKeys(items))
+	assert.True(t, more)
+
+	items, more = mergeScanPages([][]*kvstore.Item{scanPage(1, "e", "d"), scanPage(1, "c")}, 2, true)
+	assert.Equal(t, []string{"e", "d"}, itemKeys(items))
+	assert.True(t, more)
+
+	items, more = mergeScanPages([][]*kvstore.Item{scanPage(1, "a", "c"), scanPage(1, "b", "d")}, 3, false)
+	assert.Equal(t, []string{"a", "b", "c"}, itemKeys(items))
+	assert.True(t, more)
+}
+
+func TestScanToken(t *testing.T) {
+	last, err := decodeScanToken(encodeScanToken("key\x00\xff"))
+	assert.Nil(t, err)
+	assert.Equal(t, "key\x00\xff", last)
+
+	_, err = decodeScanToken("!!")
+	assert.NotNil(t, err)
+}
+
+func TestScanKeysLocal(t *testing.T) {
+	logger := util.NewLogger("error")
+	kv := kvstore.NewKVStore(logger)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		kv.Set(key, []byte(key), 0, nil)
+	}
+	inst := NewTLSServer(logger, nil, kv, "HOSTNAME", false)
+
+	keys := []string{}
+	token := ""
+	for {
+		items, next, err := inst.ScanKeys(kvstore.ScanOptions{Limit: 2}, token)
+		assert.Nil(t, err)
+		keys = append(keys, itemKeys(items)...)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, keys)
+}
+
+func TestScanKeysPeers(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	connectServers(a, b)
+
+	a.KVStore.SetVersion("a", []byte("a"), 0, nil, 1)
+	b.KVStore.SetVersion("b", []byte("b"), 0, nil, 1)
+	// Deleted on one replica and not yet on the other
+	a.KVStore.SetVersion("c", []byte("c"), 0, nil, 1)
+	b.KVStore.DeleteVersion("c", 2)
+	a.KVStore.DeleteVersion("d", 2)
+	b.KVStore.SetVersion("d", []byte("d"), 0, nil, 1)
+	b.KVStore.SetVersion("e", []byte("e"), 0, nil, 1)
+
+	keys := []string{}
+	token := ""
+	for {
+		items, next, err := a.ScanKeys(kvstore.ScanOptions{Limit: 2}, token)
+		assert.Nil(t, err)
+		keys = append(keys, itemKeys(items)...)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	assert.Equal(t, []string{"a", "b", "e"}, keys)
+}
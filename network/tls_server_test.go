@@ -1,9 +1,15 @@
 package network
 
 import (
+	"encoding/gob"
+	"fmt"
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/kvstore"
+	"github.com/tomdionysus/trinity/util"
 )
 
 func TestTLSServer(t *testing.T) {
@@ -11,3 +17,81 @@ func TestTLSServer(t *testing.T) {
 
 	assert.NotNil(t, inst)
 }
+
+func TestTLSServerIsSetNoConnection(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	a.ServerNode.RegisterNode(&b.ServerNode.ServerNetworkNode)
+
+	// A key that b owns, and a holds the second replica of
+	key := ""
+	for i := 0; key == ""; i++ {
+		if candidate := fmt.Sprintf("key%d", i); a.replicasFor(ch.NewMD5Key(candidate))[0] == b.ServerNode.ID {
+			key = candidate
+		}
+	}
+	a.KVStore.Set(key, []byte("value"), 0, nil)
+
+	// b has no connection, so the next replica is asked
+	found, err := a.IsSet(key, ReadOptions{})
+	assert.Nil(t, err)
+	assert.True(t, found)
+	a.ReplicationFactor = 1
+	_, err = a.IsSet(key, ReadOptions{})
+	assert.Equal(t, ErrQuorumNotMet, err)
+
+	// With no replicas to read from, the key is not reported missing
+	a.ServerNode.DeregisterNode(&b.ServerNode.ServerNetworkNode)
+	a.ServerNode.DeregisterNode(&a.ServerNode.ServerNetworkNode)
+	_, err = a.IsSet(key, ReadOptions{})
+	assert.Equal(t, ErrQuorumNotMet, err)
+	_, _, err = a.GetItem(key, ReadOptions{})
+	assert.Equal(t, ErrQuorumNotMet, err)
+}
+
+func TestTLSServerIsSetQuorum(t *testing.T) {
+	logger := util.NewLogger("error")
+	a := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "a", false)
+	b := NewTLSServer(logger, nil, kvstore.NewKVStore(logger), "b", false)
+	connectServers(a, b)
+
+	// A key that b owns and does not hold, but a does
+	key := ""
+	for i := 0; key == ""; i++ {
+		if candidate := fmt.Sprintf("key%d", i); a.replicasFor(ch.NewMD5Key(candidate))[0] == b.ServerNode.ID {
+			key = candidate
+		}
+	}
+	a.KVStore.Set(key, []byte("value"), 0, nil)
+
+	// IsSet agrees with GetItem for every read quorum
+	for _, r := range []int{1, 2} {
+		_, expected, err := a.GetItem(key, ReadOptions{R: r})
+		assert.Nil(t, err)
+		found, err := a.IsSet(key, ReadOptions{R: r})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, found)
+		assert.True(t, found)
+	}
+}
+
+// connectServers connects two servers in the same process over a pipe, as if they had completed the connection
+// protocol, registering each in the other's circle. It returns the peers of a and b.
+func connectServers(a *TLSServer, b *TLSServer) (*Peer, *Peer) {
+	left, right := net.Pipe()
+	return pipePeer(a, b, left), pipePeer(b, a, right)
+}
+
+// pipePeer returns the connected peer of svr for remote over the given end of a pipe.
+func pipePeer(svr *TLSServer, remote *TLSServer, conn net.Conn) *Peer {
+	peer := NewPeer(svr.Logger, svr, conn.RemoteAddr().String())
+	peer.ServerNetworkNode = &remote.ServerNode.ServerNetworkNode
+	peer.Reader = gob.NewDecoder(conn)
+	peer.Writer = gob.NewEncoder(conn)
+	peer.SetState(PeerStateConnected)
+	svr.ServerNode.RegisterNode(peer.ServerNetworkNode)
+	svr.ConnectionSet(remote.ServerNode.ID, peer)
+	go peer.process()
+	return peer
+}
@@ -0,0 +1,48 @@
+package packets
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Consistency is the consistency mode of a write, selectable per client session. See docs/consistency_modes.md.
+type Consistency uint8
+
+// Consistency Modes. The zero value selects the server's default mode.
+const (
+	// WRITE_UNCOMMITTED writes return immediately, and are persisted and replicated asynchronously.
+	WRITE_UNCOMMITTED Consistency = 1
+	// WRITE_COMMITTED writes return when they have been persisted on one replica, and are replicated to the
+	// others asynchronously.
+	WRITE_COMMITTED Consistency = 2
+	// WRITE_REPLICATED writes return when they have been persisted on every available replica.
+	WRITE_REPLICATED Consistency = 3
+)
+
+var consistencyNames = map[Consistency]string{
+	WRITE_UNCOMMITTED: "WRITE_UNCOMMITTED",
+	WRITE_COMMITTED:   "WRITE_COMMITTED",
+	WRITE_REPLICATED:  "WRITE_REPLICATED",
+}
+
+// ParseConsistency returns the consistency mode with the given name, ignoring case.
+func ParseConsistency(name string) (Consistency, error) {
+	for mode, modeName := range consistencyNames {
+		if strings.EqualFold(name, modeName) {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown consistency mode '%s'", name)
+}
+
+// Durable returns true if a write in this mode must be persisted before it is acknowledged.
+func (mode Consistency) Durable() bool {
+	return mode != WRITE_UNCOMMITTED
+}
+
+func (mode Consistency) String() string {
+	if name, found := consistencyNames[mode]; found {
+		return name
+	}
+	return fmt.Sprintf("Consistency(%d)", mode)
+}
@@ -0,0 +1,26 @@
+package packets
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConsistency(t *testing.T) {
+	for _, mode := range []Consistency{WRITE_UNCOMMITTED, WRITE_COMMITTED, WRITE_REPLICATED} {
+		parsed, err := ParseConsistency(mode.String())
+		assert.Nil(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	mode, err := ParseConsistency("write_replicated")
+	assert.Nil(t, err)
+	assert.Equal(t, WRITE_REPLICATED, mode)
+
+	_, err = ParseConsistency("eventual")
+	assert.NotNil(t, err)
+
+	assert.False(t, WRITE_UNCOMMITTED.Durable())
+	assert.True(t, WRITE_COMMITTED.Durable())
+	assert.True(t, Consistency(0).Durable())
+}
@@ -2,34 +2,87 @@ package packets
 
 import (
 	"encoding/gob"
+	"errors"
 	"time"
 
 	ch "github.com/tomdionysus/consistenthash"
+	"github.com/tomdionysus/trinity/util"
 )
 
 const (
 	CMD_KVSTORE           = 10
 	CMD_KVSTORE_ACK       = 11
 	CMD_KVSTORE_NOT_FOUND = 12
+	CMD_KVSTORE_ERROR     = 13
 
-	CMD_KVSTORE_SET    = 1
-	CMD_KVSTORE_GET    = 2
-	CMD_KVSTORE_DELETE = 3
-	CMD_KVSTORE_IS_SET = 4
+	CMD_KVSTORE_SET     = 1
+	CMD_KVSTORE_GET     = 2
+	CMD_KVSTORE_DELETE  = 3
+	CMD_KVSTORE_IS_SET  = 4
+	CMD_KVSTORE_CAS     = 5
+	CMD_KVSTORE_INCR    = 6
+	CMD_KVSTORE_DECR    = 7
+	CMD_KVSTORE_APPEND  = 8
+	CMD_KVSTORE_PREPEND = 9
+
+	CMD_KVSTORE_DROP_KEYSPACE = 10
 )
 
+// ErrChecksumMismatch is returned by Decompress when Data does not match its checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch in transit")
+
 type KVStorePacket struct {
 	Command int16
 
+	// Keyspace is the keyspace of Key, or the keyspace to drop for CMD_KVSTORE_DROP_KEYSPACE.
+	Keyspace  string
 	Key       string
 	KeyHash   [16]byte
 	Data      []byte
 	ExpiresAt *time.Time
 	Flags     int16
+	// Version is the item version; for CMD_KVSTORE_CAS, the version expected.
+	Version uint64
+	// Delta is the amount for CMD_KVSTORE_INCR and CMD_KVSTORE_DECR.
+	Delta uint64
+	// Compressed is true if Data is compressed.
+	Compressed bool
+	// Checksum is the CRC32C of the uncompressed Data.
+	Checksum uint32
+	// Consistency is the consistency mode of a write. Writes in a durable mode are persisted before they are
+	// acknowledged.
+	Consistency Consistency
 
 	TargetID ch.NodeId
 }
 
+// Compress sets the checksum of Data, then compresses it if it is at least threshold bytes and compression
+// makes it smaller. A threshold of 0 disables compression. It is called on every packet carrying a value before
+// it is sent.
+func (kvp *KVStorePacket) Compress(threshold int) {
+	if kvp.Compressed {
+		return
+	}
+	kvp.Checksum = util.Checksum(kvp.Data)
+	kvp.Data, kvp.Compressed = util.CompressIfSmaller(kvp.Data, threshold)
+}
+
+// Decompress restores Data if it is compressed, and returns ErrChecksumMismatch if it does not match its
+// checksum. It is called on every packet carrying a value when it is received.
+func (kvp *KVStorePacket) Decompress() error {
+	if kvp.Compressed {
+		data, err := util.Decompress(kvp.Data)
+		if err != nil {
+			return ErrChecksumMismatch
+		}
+		kvp.Data, kvp.Compressed = data, false
+	}
+	if util.Checksum(kvp.Data) != kvp.Checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
 func init() {
 	gob.Register(KVStorePacket{})
 }
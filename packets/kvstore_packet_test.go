@@ -1,6 +1,7 @@
 package packets
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,3 +12,32 @@ func TestKVStorePacket(t *testing.T) {
 
 	assert.NotNil(t, inst)
 }
+
+func TestKVStorePacketCompress(t *testing.T) {
+	data := bytes.Repeat([]byte("trinity "), 64)
+	inst := &KVStorePacket{Key: "key", Data: data}
+
+	inst.Compress(0)
+	assert.False(t, inst.Compressed)
+	inst.Compress(64)
+	assert.True(t, inst.Compressed)
+	assert.True(t, len(inst.Data) < len(data))
+
+	assert.Nil(t, inst.Decompress())
+	assert.False(t, inst.Compressed)
+	assert.Equal(t, data, inst.Data)
+}
+
+func TestKVStorePacketChecksum(t *testing.T) {
+	inst := &KVStorePacket{Key: "key", Data: []byte("value")}
+	inst.Compress(0)
+	assert.Nil(t, inst.Decompress())
+
+	inst.Data[0] ^= 0xff
+	assert.Equal(t, ErrChecksumMismatch, inst.Decompress())
+
+	compressed := &KVStorePacket{Key: "key", Data: bytes.Repeat([]byte("trinity "), 64)}
+	compressed.Compress(64)
+	compressed.Data[len(compressed.Data)/2] ^= 0xff
+	assert.Equal(t, ErrChecksumMismatch, compressed.Decompress())
+}
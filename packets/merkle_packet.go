@@ -0,0 +1,32 @@
+package packets
+
+import (
+	"encoding/gob"
+)
+
+const (
+	CMD_MERKLE_HASHES = 15
+	CMD_MERKLE_KEYS   = 16
+)
+
+// MerkleHashesPacket requests the hashes of the nodes at Level of the Merkle tree of the keys the sender shares
+// with the receiver, for each of Indices. It is answered with CMD_KVSTORE_ACK and a MerkleHashesPacket with
+// Hashes in the same order. A request for level 0 causes the receiver to rebuild its tree.
+type MerkleHashesPacket struct {
+	Level   int
+	Indices []uint32
+	Hashes  [][16]byte
+}
+
+// MerkleKeysPacket requests the keys in the given Leaves of the Merkle tree of the keys the sender shares with
+// the receiver. It is answered with CMD_KVSTORE_ACK and a MerkleKeysPacket with Items holding the key, version
+// and whether it is deleted of each, without their values. Deleted keys have the command CMD_KVSTORE_DELETE.
+type MerkleKeysPacket struct {
+	Leaves []uint32
+	Items  []KVStorePacket
+}
+
+func init() {
+	gob.Register(MerkleHashesPacket{})
+	gob.Register(MerkleKeysPacket{})
+}
@@ -0,0 +1,29 @@
+package packets
+
+import (
+	"encoding/gob"
+)
+
+const (
+	CMD_KVSTORE_SCAN = 14
+)
+
+// ScanPacket requests a page of up to Limit of a node's items in key order, selected as by
+// kvstore.ScanOptions. It is answered with CMD_KVSTORE_ACK and a ScanPagePacket.
+type ScanPacket struct {
+	Start   string
+	End     string
+	Prefix  string
+	Limit   int
+	Reverse bool
+}
+
+// ScanPagePacket is a page of items in key order, in answer to a ScanPacket.
+type ScanPagePacket struct {
+	Items []KVStorePacket
+}
+
+func init() {
+	gob.Register(ScanPacket{})
+	gob.Register(ScanPagePacket{})
+}
@@ -0,0 +1,16 @@
+package packets
+
+const (
+	// CMD_SYNC_COMPLETE tells the receiver, a node that has joined, that the sender has sent it every key it
+	// now holds a replica of. It has no payload.
+	CMD_SYNC_COMPLETE = 17
+	// CMD_SYNC_READY tells the receiver that the sender has been sent its keys by every node and can be read
+	// from. It has no payload.
+	CMD_SYNC_READY = 18
+	// CMD_NODE_LEAVING tells the receiver that the sender is being decommissioned, so writes should also go to
+	// the nodes that will inherit its keys. It is answered with CMD_KVSTORE_ACK, and has no payload.
+	CMD_NODE_LEAVING = 19
+	// CMD_NODE_STAYING tells the receiver that the sender has stopped being decommissioned, cancelling
+	// CMD_NODE_LEAVING. It is answered with CMD_KVSTORE_ACK, and has no payload.
+	CMD_NODE_STAYING = 20
+)
@@ -0,0 +1,10 @@
+package util
+
+import "hash/crc32"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum returns the CRC32C of data, used to detect corruption of values in storage and in transit.
+func Checksum(data []byte) uint32 {
+	return crc32.Checksum(data, castagnoli)
+}
@@ -0,0 +1,14 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	// The standard CRC32C check value
+	assert.Equal(t, uint32(0xe3069283), Checksum([]byte("123456789")))
+	assert.Equal(t, uint32(0), Checksum(nil))
+	assert.NotEqual(t, Checksum([]byte{1, 2, 3}), Checksum([]byte{1, 2, 4}))
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+// Compress returns data compressed with flate at its fastest level.
+func Compress(data []byte) []byte {
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+// Decompress returns the data compressed by Compress.
+func Decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// CompressIfSmaller compresses data if it is at least threshold bytes long and compression makes it smaller,
+// returning the result and whether it is compressed. A threshold of 0 or less disables compression.
+func CompressIfSmaller(data []byte, threshold int) ([]byte, bool) {
+	if threshold <= 0 || len(data) < threshold {
+		return data, false
+	}
+	compressed := Compress(data)
+	if len(compressed) >= len(data) {
+		return data, false
+	}
+	return compressed, true
+}
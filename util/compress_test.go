@@ -0,0 +1,41 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"name":"trinity","value":12345}`), 100)
+
+	compressed := Compress(data)
+	assert.True(t, len(compressed) < len(data)/5)
+	result, err := Decompress(compressed)
+	assert.Nil(t, err)
+	assert.Equal(t, data, result)
+
+	_, err = Decompress([]byte{0xff, 0xff, 0xff})
+	assert.NotNil(t, err)
+}
+
+func TestCompressIfSmaller(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 100)
+
+	result, compressed := CompressIfSmaller(data, 0)
+	assert.False(t, compressed)
+	assert.Equal(t, data, result)
+
+	result, compressed = CompressIfSmaller(data, 101)
+	assert.False(t, compressed)
+
+	result, compressed = CompressIfSmaller(data, 100)
+	assert.True(t, compressed)
+	assert.True(t, len(result) < len(data))
+
+	// Incompressible
+	result, compressed = CompressIfSmaller([]byte{1, 2, 3, 4}, 1)
+	assert.False(t, compressed)
+	assert.Equal(t, []byte{1, 2, 3, 4}, result)
+}